@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/dht"
+)
+
+func runDHT(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: pebl dht put|get [flags] <argument>")
+	}
+	switch args[0] {
+	case "put":
+		return runDHTPut(args[1:])
+	case "get":
+		return runDHTGet(args[1:])
+	default:
+		return fmt.Errorf("unknown dht command %q", args[0])
+	}
+}
+
+type dhtFlags struct {
+	addr      *string
+	bootstrap *string
+	timeout   *time.Duration
+	salt      *string
+	state     *string
+}
+
+func addDHTFlags(fs *flag.FlagSet) dhtFlags {
+	return dhtFlags{
+		addr:      fs.String("addr", ":0", "UDP address for the DHT node"),
+		bootstrap: fs.String("bootstrap", strings.Join(dht.DefaultBootstrapNodes, ","), "comma separated bootstrap nodes"),
+		timeout:   fs.Duration("timeout", time.Minute, "time limit for the whole operation"),
+		salt:      fs.String("salt", "", "salt of a mutable item"),
+		state:     fs.String("state", "", "file keeping the node ID and known nodes between runs"),
+	}
+}
+
+// start joins the DHT and returns the node together with a context bounded
+// by the timeout flag.
+func (f dhtFlags) start() (*dht.DHT, context.Context, context.CancelFunc, error) {
+	node, err := dht.New(dht.Config{
+		Addr:           *f.addr,
+		BootstrapNodes: strings.Split(*f.bootstrap, ","),
+		StateFile:      *f.state,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *f.timeout)
+	if err := node.Bootstrap(ctx); err != nil {
+		cancel()
+		node.Close()
+		return nil, nil, nil, fmt.Errorf("DHT bootstrap failed: %v", err)
+	}
+	return node, ctx, cancel, nil
+}
+
+func runDHTPut(args []string) error {
+	fs := flag.NewFlagSet("dht put", flag.ExitOnError)
+	flags := addDHTFlags(fs)
+	keyFile := fs.String("key", "", "file with a hex ed25519 seed; makes the item mutable and is created if missing")
+	seq := fs.Int64("seq", -1, "sequence number of a mutable item; by default one more than the current item")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: pebl dht put [-key file] [-salt salt] [-seq n] <value>")
+	}
+	value := fs.Arg(0)
+
+	node, ctx, cancel, err := flags.start()
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	defer cancel()
+
+	if *keyFile == "" {
+		target, err := node.PutImmutable(ctx, value)
+		if err != nil {
+			return err
+		}
+		fmt.Println(target)
+		return nil
+	}
+
+	key, err := loadOrCreateKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	salt := []byte(*flags.salt)
+
+	cas := int64(-1)
+	if *seq < 0 {
+		*seq = 1
+		if current, err := node.GetMutable(ctx, pub, salt); err == nil {
+			*seq = current.Seq + 1
+			cas = current.Seq
+		}
+	}
+
+	item, err := dht.SignMutable(key, salt, *seq, value)
+	if err != nil {
+		return err
+	}
+	if cas >= 0 {
+		err = node.PutMutableCAS(ctx, item, cas)
+	} else {
+		err = node.PutMutable(ctx, item)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Public key: %x\n", pub)
+	fmt.Printf("Target: %s\n", item.Target())
+	fmt.Printf("Sequence: %d\n", item.Seq)
+	return nil
+}
+
+func runDHTGet(args []string) error {
+	fs := flag.NewFlagSet("dht get", flag.ExitOnError)
+	flags := addDHTFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: pebl dht get [-salt salt] <target | public key>")
+	}
+	raw, err := hex.DecodeString(fs.Arg(0))
+	if err != nil || (len(raw) != 20 && len(raw) != ed25519.PublicKeySize) {
+		return fmt.Errorf("expected a 40 character target or a 64 character public key in hex")
+	}
+
+	node, ctx, cancel, err := flags.start()
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	defer cancel()
+
+	if len(raw) == 20 {
+		v, err := node.GetImmutable(ctx, dht.ID(raw))
+		if err != nil {
+			return err
+		}
+		fmt.Println(formatDHTValue(v))
+		return nil
+	}
+
+	item, err := node.GetMutable(ctx, ed25519.PublicKey(raw), []byte(*flags.salt))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sequence: %d\n", item.Seq)
+	fmt.Println(formatDHTValue(item.Value))
+	return nil
+}
+
+func formatDHTValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// loadOrCreateKey reads an ed25519 seed in hex from path, generating and
+// saving a new one if the file does not exist.
+func loadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		seed := make([]byte, ed25519.SeedSize)
+		rand.Read(seed)
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Generated new key in %s\n", path)
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s does not contain a hex ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -1,3 +1,41 @@
 package main
 
-func main() {}
+import (
+	"fmt"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pebl <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  dht put <value>    store a value in the DHT")
+	fmt.Fprintln(os.Stderr, "  dht get <key>      fetch a value from the DHT")
+	fmt.Fprintln(os.Stderr, "  scrape <torrent>   show seeders, leechers and completed counts")
+	fmt.Fprintln(os.Stderr, "  tracker            run a BitTorrent tracker")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "dht":
+		err = runDHT(os.Args[2:])
+	case "scrape":
+		err = runScrape(os.Args[2:])
+	case "tracker":
+		err = runTracker(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pebl:", err)
+		os.Exit(1)
+	}
+}
@@ -145,7 +145,9 @@ func decodeAt(data []byte, pos *int) (interface{}, error) {
 			return nil, err
 		}
 		*pos++
-		if *pos+length > len(data) {
+		// Comparing against what is left cannot overflow, unlike
+		// *pos+length.
+		if length < 0 || length > len(data)-*pos {
 			return nil, errors.New("string out of bounds")
 		}
 		str := string(data[*pos : *pos+length])
@@ -21,6 +21,20 @@ func TestBencodeDecodeString(t *testing.T) {
 	}
 }
 
+func TestBencodeDecodeOversizedString(t *testing.T) {
+	for _, data := range []string{
+		"9223372036854775807:x",
+		"9223372036854775806:x",
+		"5:abc",
+		"d3:key99999999999:xe",
+		"l18446744073709551615:xe",
+	} {
+		if _, err := Decode([]byte(data)); err == nil {
+			t.Errorf("decoded %q", data)
+		}
+	}
+}
+
 func TestBencodeDecodeInt(t *testing.T) {
 	data := []byte("i42e")
 	result, err := Decode(data)
@@ -62,3 +76,29 @@ func TestBencodeDecodeDict(t *testing.T) {
 		t.Errorf(`expected "spam" = "eggs", got %v (type %T)`, val, val)
 	}
 }
+
+func TestBencodeEncode(t *testing.T) {
+	value := map[string]interface{}{
+		"spam": []interface{}{"a", 1},
+		"cow":  "moo",
+		"num":  int64(-3),
+	}
+
+	data, err := Encode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "d3:cow3:moo3:numi-3e4:spaml1:ai1eee"
+	if string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dict, ok := decoded.(map[string]interface{}); !ok || dict["cow"] != "moo" {
+		t.Errorf("round trip failed, got %v", decoded)
+	}
+}
@@ -0,0 +1,85 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Encode serializes strings, byte slices, integers, lists and string-keyed
+// dictionaries. Dictionary keys are written in sorted order.
+func Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeTo(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeTo(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case string:
+		buf.WriteString(strconv.Itoa(len(val)))
+		buf.WriteByte(':')
+		buf.WriteString(val)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(val)))
+		buf.WriteByte(':')
+		buf.Write(val)
+	case int:
+		writeInt(buf, int64(val))
+	case int32:
+		writeInt(buf, int64(val))
+	case int64:
+		writeInt(buf, val)
+	case uint16:
+		writeInt(buf, int64(val))
+	case uint32:
+		writeInt(buf, int64(val))
+	case bool:
+		if val {
+			writeInt(buf, 1)
+		} else {
+			writeInt(buf, 0)
+		}
+	case []string:
+		buf.WriteByte('l')
+		for _, item := range val {
+			encodeTo(buf, item)
+		}
+		buf.WriteByte('e')
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range val {
+			if err := encodeTo(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, k := range keys {
+			encodeTo(buf, k)
+			if err := encodeTo(buf, val[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot encode value of type %T", v)
+	}
+	return nil
+}
+
+func writeInt(buf *bytes.Buffer, n int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(n, 10))
+	buf.WriteByte('e')
+}
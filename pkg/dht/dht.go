@@ -0,0 +1,749 @@
+// Package dht implements a Mainline DHT node (BEP 5) for finding peers
+// without a tracker.
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// alpha is the number of queries a lookup keeps in flight.
+	alpha               = 3
+	defaultQueryTimeout = 5 * time.Second
+	maintenanceInterval = time.Minute
+)
+
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var (
+	errQueryTimeout = errors.New("dht query timed out")
+	errClosed       = errors.New("dht closed")
+	errNoNodes      = errors.New("dht routing table is empty")
+)
+
+type Config struct {
+	// Addr is the UDP address to listen on, e.g. ":6881". Only IPv4 is
+	// supported.
+	Addr string
+	// ID is our node ID. When zero, an ID derived from ExternalIP as
+	// BEP 42 requires is used, or a random one that is replaced once other
+	// nodes tell us our external address.
+	ID ID
+	// ExternalIP is our public address, if known.
+	ExternalIP netip.Addr
+	// StateFile, when set, keeps our node ID and the nodes that were
+	// answering us across restarts. It is read by New and written by Close.
+	StateFile string
+	// ReadOnly makes the node query others without answering queries
+	// itself (BEP 43), for nodes that cannot receive unsolicited packets.
+	ReadOnly bool
+	// BootstrapNodes are "host:port" addresses contacted by Bootstrap.
+	BootstrapNodes []string
+	// QueryTimeout bounds each KRPC query; zero uses a default.
+	QueryTimeout time.Duration
+}
+
+// DHT is a node taking part in the Mainline DHT. It answers queries from
+// other nodes and performs iterative lookups on behalf of the client.
+type DHT struct {
+	id      ID
+	conn    *net.UDPConn
+	timeout time.Duration
+	cfg     Config
+
+	table   *routingTable
+	tokens  *tokenManager
+	peers   *peerStore
+	items   *itemStore
+	samples *sampler
+
+	mu         sync.Mutex
+	pending    map[string]pendingQuery
+	nextTx     uint16
+	externalIP netip.Addr
+	ipVoters   map[netip.Addr]map[netip.Addr]bool
+
+	closeOnce sync.Once
+	closeC    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// New listens on cfg.Addr and starts serving queries. Call Bootstrap to
+// join the network.
+func New(cfg Config) (*DHT, error) {
+	addr, err := net.ResolveUDPAddr("udp4", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DHT address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved *state
+	if cfg.StateFile != "" {
+		saved, err = loadState(cfg.StateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Ignoring DHT state: %v\n", err)
+		}
+	}
+
+	id := cfg.ID
+	if id == (ID{}) && saved != nil &&
+		(!cfg.ExternalIP.IsValid() || NodeIDValid(saved.ID, cfg.ExternalIP)) {
+		id = saved.ID
+	}
+	if id == (ID{}) {
+		if cfg.ExternalIP.IsValid() {
+			id = GenerateNodeID(cfg.ExternalIP)
+		} else {
+			id = RandomID()
+		}
+	}
+	timeout := cfg.QueryTimeout
+	if timeout <= 0 {
+		timeout = defaultQueryTimeout
+	}
+
+	d := &DHT{
+		id:      id,
+		conn:    conn,
+		timeout: timeout,
+		cfg:     cfg,
+		table:   newRoutingTable(id),
+		tokens:  newTokenManager(),
+		peers:   newPeerStore(),
+		items:   newItemStore(),
+		samples: &sampler{},
+		pending: make(map[string]pendingQuery),
+		closeC:  make(chan struct{}),
+
+		externalIP: cfg.ExternalIP,
+		ipVoters:   make(map[netip.Addr]map[netip.Addr]bool),
+	}
+	var tx [2]byte
+	copy(tx[:], id[:2])
+	d.nextTx = binary.BigEndian.Uint16(tx[:])
+
+	if saved != nil {
+		for _, n := range saved.Nodes {
+			if n.ID != id && NodeIDValid(n.ID, n.Addr.Addr()) {
+				d.table.restore(n)
+			}
+		}
+	}
+
+	d.wg.Add(2)
+	go d.readLoop()
+	go d.maintain()
+	return d, nil
+}
+
+func (d *DHT) ID() ID {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.id
+}
+
+// Addr returns the address the node listens on.
+func (d *DHT) Addr() netip.AddrPort {
+	return d.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// Nodes returns the nodes currently in the routing table.
+func (d *DHT) Nodes() []NodeInfo {
+	return d.table.closest(d.ID(), idBits*K)
+}
+
+// Close stops the node and saves its state if a state file is configured.
+func (d *DHT) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.closeC)
+		err = d.conn.Close()
+		d.wg.Wait()
+		if saveErr := d.SaveState(); saveErr != nil && err == nil {
+			err = fmt.Errorf("error saving DHT state: %w", saveErr)
+		}
+	})
+	return err
+}
+
+// Bootstrap looks up our own ID to fill the routing table. Nodes restored
+// from the state file are tried first; the configured bootstrap nodes are
+// contacted when there are none or none of them answer.
+func (d *DHT) Bootstrap(ctx context.Context) error {
+	id := d.ID()
+	if d.table.len() > 0 {
+		if nodes, err := d.FindNode(ctx, id); err == nil && len(nodes) > 0 {
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, hostport := range d.cfg.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp4", hostport)
+		if err != nil {
+			fmt.Printf("DHT bootstrap node %s: %v\n", hostport, err)
+			continue
+		}
+		wg.Add(1)
+		go func(addr netip.AddrPort) {
+			defer wg.Done()
+			resp, err := d.query(ctx, addr, "find_node", map[string]interface{}{
+				"target": string(id[:]),
+			})
+			if err == nil {
+				d.addResponseNodes(resp)
+			}
+		}(unmap(addr.AddrPort()))
+	}
+	wg.Wait()
+
+	if d.table.len() == 0 {
+		return errNoNodes
+	}
+	_, err := d.FindNode(ctx, id)
+	return err
+}
+
+// Ping checks that a node at addr is alive and returns its ID.
+func (d *DHT) Ping(ctx context.Context, addr netip.AddrPort) (ID, error) {
+	resp, err := d.query(ctx, addr, "ping", map[string]interface{}{})
+	if err != nil {
+		return ID{}, err
+	}
+	id, _ := resp.senderID()
+	return id, nil
+}
+
+// FindNode returns the K nodes closest to target that answered us.
+func (d *DHT) FindNode(ctx context.Context, target ID) ([]NodeInfo, error) {
+	res, err := d.lookup(ctx, target, "find_node", nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.closest(), nil
+}
+
+// GetPeers searches the DHT for peers of infoHash.
+func (d *DHT) GetPeers(ctx context.Context, infoHash ID) ([]netip.AddrPort, error) {
+	res, err := d.lookup(ctx, infoHash, "get_peers", nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.peers, nil
+}
+
+// Announce tells the nodes closest to infoHash that we are downloading it
+// and accept connections on port. A zero port asks them to use the source
+// port of our UDP packets instead (implied_port), and seed marks us as
+// having the complete torrent (BEP 33). The peers found along the way are
+// returned.
+func (d *DHT) Announce(ctx context.Context, infoHash ID, port uint16, seed bool) ([]netip.AddrPort, error) {
+	res, err := d.lookup(ctx, infoHash, "get_peers", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		announced int
+	)
+	for _, c := range res.closestWithToken() {
+		args := map[string]interface{}{
+			"info_hash": string(infoHash[:]),
+			"port":      int(port),
+			"token":     c.token,
+		}
+		if port == 0 {
+			args["implied_port"] = 1
+		}
+		if seed {
+			args["seed"] = 1
+		}
+		wg.Add(1)
+		go func(addr netip.AddrPort) {
+			defer wg.Done()
+			if _, err := d.query(ctx, addr, "announce_peer", args); err == nil {
+				mu.Lock()
+				announced++
+				mu.Unlock()
+			}
+		}(c.Addr)
+	}
+	wg.Wait()
+
+	if announced == 0 {
+		return res.peers, fmt.Errorf("no DHT node accepted the announce")
+	}
+	return res.peers, nil
+}
+
+type candidate struct {
+	NodeInfo
+	queried   bool
+	responded bool
+	failed    bool
+	token     string
+	// reply is the body of the node's response to a get or get_peers
+	// query.
+	reply map[string]interface{}
+}
+
+type lookupResult struct {
+	target     ID
+	candidates []*candidate
+	peers      []netip.AddrPort
+}
+
+func (r *lookupResult) responders() []*candidate {
+	var out []*candidate
+	for _, c := range r.candidates {
+		if c.responded {
+			out = append(out, c)
+		}
+	}
+	if len(out) > K {
+		out = out[:K]
+	}
+	return out
+}
+
+func (r *lookupResult) closest() []NodeInfo {
+	var nodes []NodeInfo
+	for _, c := range r.responders() {
+		nodes = append(nodes, c.NodeInfo)
+	}
+	return nodes
+}
+
+func (r *lookupResult) closestWithToken() []*candidate {
+	var out []*candidate
+	for _, c := range r.responders() {
+		if c.token != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+type lookupReply struct {
+	c    *candidate
+	resp *msg
+	err  error
+}
+
+// lookup runs an iterative Kademlia search for target, sending method
+// (find_node, get_peers or get) with any extra arguments to ever closer
+// nodes until the K closest known nodes have all been queried.
+func (d *DHT) lookup(ctx context.Context, target ID, method string, extra map[string]interface{}) (*lookupResult, error) {
+	start := d.table.closest(target, K)
+	if len(start) == 0 {
+		return nil, errNoNodes
+	}
+
+	self := d.ID()
+	res := &lookupResult{target: target}
+	seen := make(map[ID]bool)
+	seenPeers := make(map[netip.AddrPort]bool)
+	add := func(n NodeInfo) {
+		if n.ID == self || seen[n.ID] {
+			return
+		}
+		seen[n.ID] = true
+		res.candidates = append(res.candidates, &candidate{NodeInfo: n})
+	}
+	for _, n := range start {
+		add(n)
+	}
+
+	key := "target"
+	if method == "get_peers" {
+		key = "info_hash"
+	}
+	args := map[string]interface{}{key: string(target[:])}
+	for k, v := range extra {
+		args[k] = v
+	}
+
+	replies := make(chan lookupReply)
+	inflight := 0
+	for {
+		sort.Slice(res.candidates, func(i, j int) bool {
+			return closerTo(target, res.candidates[i].ID, res.candidates[j].ID)
+		})
+
+		// waiting counts the K closest candidates that have not answered
+		// yet; once there are none the lookup is done.
+		considered, waiting := 0, 0
+		for _, c := range res.candidates {
+			if considered == K {
+				break
+			}
+			if c.failed {
+				continue
+			}
+			considered++
+			if c.responded {
+				continue
+			}
+			waiting++
+			if c.queried || inflight == alpha || ctx.Err() != nil {
+				continue
+			}
+			c.queried = true
+			inflight++
+			go func(c *candidate) {
+				resp, err := d.query(ctx, c.Addr, method, args)
+				replies <- lookupReply{c, resp, err}
+			}(c)
+		}
+		if waiting == 0 || inflight == 0 {
+			// Queries to nodes that are no longer among the closest are
+			// left to finish on their own.
+			go func(n int) {
+				for ; n > 0; n-- {
+					<-replies
+				}
+			}(inflight)
+			break
+		}
+
+		reply := <-replies
+		inflight--
+		if reply.err != nil {
+			reply.c.failed = true
+			d.table.markFailed(reply.c.ID)
+			continue
+		}
+		reply.c.responded = true
+
+		if nodes, ok := stringArg(reply.resp.R, "nodes"); ok {
+			for _, n := range decodeCompactNodes(nodes) {
+				add(n)
+			}
+		}
+		switch method {
+		case "get":
+			reply.c.token, _ = stringArg(reply.resp.R, "token")
+			reply.c.reply = reply.resp.R
+		case "get_peers":
+			reply.c.token, _ = stringArg(reply.resp.R, "token")
+			reply.c.reply = reply.resp.R
+			values, _ := reply.resp.R["values"].([]interface{})
+			for _, v := range values {
+				s, _ := v.(string)
+				if addr, ok := decodeCompactAddr([]byte(s)); ok && !seenPeers[addr] {
+					seenPeers[addr] = true
+					res.peers = append(res.peers, addr)
+				}
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil && len(res.responders()) == 0 {
+		return nil, err
+	}
+	return res, nil
+}
+
+// pendingQuery is a query waiting for its response, which must come from
+// the node it was sent to.
+type pendingQuery struct {
+	addr netip.AddrPort
+	ch   chan *msg
+}
+
+// query sends a KRPC query and waits for the matching response.
+func (d *DHT) query(ctx context.Context, addr netip.AddrPort, method string, args map[string]interface{}) (*msg, error) {
+	id := d.ID()
+	a := map[string]interface{}{"id": string(id[:])}
+	for k, v := range args {
+		a[k] = v
+	}
+
+	d.mu.Lock()
+	d.nextTx++
+	var tx [2]byte
+	binary.BigEndian.PutUint16(tx[:], d.nextTx)
+	t := string(tx[:])
+	ch := make(chan *msg, 1)
+	d.pending[t] = pendingQuery{addr: unmap(addr), ch: ch}
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, t)
+		d.mu.Unlock()
+	}()
+
+	if err := d.send(addr, &msg{T: t, Y: "q", Q: method, A: a, RO: d.cfg.ReadOnly}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-ch:
+		if err := resp.err(); err != nil {
+			return nil, err
+		}
+		id, ok := resp.senderID()
+		if !ok {
+			return nil, fmt.Errorf("dht response from %s missing node id", addr)
+		}
+		if ip, ok := decodeCompactAddr([]byte(resp.IP)); ok {
+			d.voteExternalIP(ip.Addr(), addr)
+		}
+		d.addNode(NodeInfo{ID: id, Addr: addr})
+		return resp, nil
+	case <-timer.C:
+		return nil, errQueryTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.closeC:
+		return nil, errClosed
+	}
+}
+
+func (d *DHT) send(addr netip.AddrPort, m *msg) error {
+	data, err := m.encode()
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDPAddrPort(data, addr)
+	return err
+}
+
+// addNode records a node we heard from. Nodes whose ID does not match
+// their address (BEP 42) are ignored. If the node's bucket is full of
+// nodes that have not been heard from recently, the oldest one is pinged
+// and replaced if it does not answer.
+func (d *DHT) addNode(info NodeInfo) {
+	if !NodeIDValid(info.ID, info.Addr.Addr()) {
+		return
+	}
+	questionable := d.table.insert(info)
+	if questionable == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		defer cancel()
+		if _, err := d.Ping(ctx, questionable.Addr); err != nil {
+			d.table.replace(questionable.ID, info)
+		}
+	}()
+}
+
+func (d *DHT) addResponseNodes(resp *msg) {
+	self := d.ID()
+	nodes, _ := stringArg(resp.R, "nodes")
+	for _, n := range decodeCompactNodes(nodes) {
+		if n.ID != self {
+			d.addNode(n)
+		}
+	}
+}
+
+func (d *DHT) readLoop() {
+	defer d.wg.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := d.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-d.closeC:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		m, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		from = unmap(from)
+
+		switch m.Y {
+		case "q":
+			if !d.cfg.ReadOnly {
+				d.handleQuery(m, from)
+			}
+		default:
+			// A response from anyone but the queried node is ignored, so
+			// guessing a transaction ID is not enough to answer for it.
+			d.mu.Lock()
+			p, ok := d.pending[m.T]
+			if ok && p.addr == from {
+				delete(d.pending, m.T)
+			}
+			d.mu.Unlock()
+			if ok && p.addr == from {
+				p.ch <- m
+			}
+		}
+	}
+}
+
+func (d *DHT) handleQuery(m *msg, from netip.AddrPort) {
+	id, ok := m.senderID()
+	if !ok {
+		d.replyError(m, from, errProtocol, "missing id")
+		return
+	}
+
+	self := d.ID()
+	r := map[string]interface{}{"id": string(self[:])}
+	switch m.Q {
+	case "ping":
+	case "find_node":
+		target, ok := idArg(m.A, "target")
+		if !ok {
+			d.replyError(m, from, errProtocol, "invalid target")
+			return
+		}
+		r["nodes"] = string(encodeCompactNodes(d.table.closest(target, K)))
+	case "get_peers":
+		infoHash, ok := idArg(m.A, "info_hash")
+		if !ok {
+			d.replyError(m, from, errProtocol, "invalid info_hash")
+			return
+		}
+		r["token"] = d.tokens.token(from.Addr())
+		if scrape, _ := m.A["scrape"].(int); scrape == 1 {
+			seeds, peers := d.peers.blooms(infoHash)
+			r["BFsd"] = string(seeds[:])
+			r["BFpe"] = string(peers[:])
+		}
+		noSeed, _ := m.A["noseed"].(int)
+		if peers := d.peers.get(infoHash, noSeed == 1); len(peers) > 0 {
+			values := make([]interface{}, 0, len(peers))
+			for _, p := range peers {
+				values = append(values, string(encodeCompactAddr(p)))
+			}
+			r["values"] = values
+		} else {
+			r["nodes"] = string(encodeCompactNodes(d.table.closest(infoHash, K)))
+		}
+	case "announce_peer":
+		infoHash, ok := idArg(m.A, "info_hash")
+		if !ok {
+			d.replyError(m, from, errProtocol, "invalid info_hash")
+			return
+		}
+		token, _ := stringArg(m.A, "token")
+		if !d.tokens.valid(token, from.Addr()) {
+			d.replyError(m, from, errProtocol, "bad token")
+			return
+		}
+		port := from.Port()
+		if implied, _ := m.A["implied_port"].(int); implied == 0 {
+			p, ok := m.A["port"].(int)
+			if !ok || p <= 0 || p > 65535 {
+				d.replyError(m, from, errProtocol, "invalid port")
+				return
+			}
+			port = uint16(p)
+		}
+		seed, _ := m.A["seed"].(int)
+		d.peers.add(infoHash, netip.AddrPortFrom(from.Addr(), port), seed == 1)
+	case "get":
+		if kerr := d.handleGet(m.A, r); kerr != nil {
+			d.replyError(m, from, kerr.Code, kerr.Message)
+			return
+		}
+		r["token"] = d.tokens.token(from.Addr())
+	case "sample_infohashes":
+		if kerr := d.handleSampleInfoHashes(m.A, r); kerr != nil {
+			d.replyError(m, from, kerr.Code, kerr.Message)
+			return
+		}
+	case "put":
+		token, _ := stringArg(m.A, "token")
+		if !d.tokens.valid(token, from.Addr()) {
+			d.replyError(m, from, errProtocol, "bad token")
+			return
+		}
+		if kerr := d.handlePut(m.A); kerr != nil {
+			d.replyError(m, from, kerr.Code, kerr.Message)
+			return
+		}
+	default:
+		d.replyError(m, from, errMethodUnknown, "method unknown")
+		return
+	}
+
+	d.send(from, &msg{T: m.T, Y: "r", R: r, IP: string(encodeCompactAddr(from))})
+	// Read-only nodes cannot be queried, so they stay out of the table.
+	if !m.RO {
+		d.addNode(NodeInfo{ID: id, Addr: from})
+	}
+}
+
+func (d *DHT) replyError(m *msg, to netip.AddrPort, code int, message string) {
+	d.send(to, &msg{T: m.T, Y: "e", E: []interface{}{code, message}})
+}
+
+// maintain rotates tokens, expires stored peers, pings nodes we have not
+// heard from and refreshes buckets that have been idle.
+func (d *DHT) maintain() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closeC:
+			return
+		case now := <-ticker.C:
+			d.tokens.rotate(now)
+			d.peers.expire(now)
+			d.items.expire(now)
+
+			for _, n := range d.table.questionableNodes(now) {
+				go func(n NodeInfo) {
+					ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+					defer cancel()
+					if _, err := d.Ping(ctx, n.Addr); err != nil {
+						d.table.markFailed(n.ID)
+					}
+				}(n)
+			}
+
+			for _, target := range d.table.staleBuckets(now) {
+				go func(target ID) {
+					ctx, cancel := context.WithTimeout(context.Background(), 4*d.timeout)
+					defer cancel()
+					d.FindNode(ctx, target)
+				}(target)
+			}
+		}
+	}
+}
+
+func unmap(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
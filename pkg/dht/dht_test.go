@@ -0,0 +1,295 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newTestNodes starts n nodes on loopback and bootstraps all of them from
+// the first one.
+func newTestNodes(t *testing.T, n int) []*DHT {
+	t.Helper()
+
+	var nodes []*DHT
+	for i := 0; i < n; i++ {
+		cfg := Config{Addr: "127.0.0.1:0", QueryTimeout: time.Second}
+		if i > 0 {
+			cfg.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+		d, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		nodes = append(nodes, d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, d := range nodes[1:] {
+		if err := d.Bootstrap(ctx); err != nil {
+			t.Fatalf("bootstrap: %v", err)
+		}
+	}
+	return nodes
+}
+
+func TestPing(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+
+	id, err := nodes[1].Ping(context.Background(), nodes[0].Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nodes[0].ID() {
+		t.Errorf("ping returned id %s, want %s", id, nodes[0].ID())
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	nodes := newTestNodes(t, 6)
+
+	// The bootstrap node learns about everyone who queried it.
+	if got := nodes[0].table.len(); got != 5 {
+		t.Errorf("bootstrap node knows %d nodes, want 5", got)
+	}
+	// Later nodes find earlier ones through the bootstrap node.
+	if got := nodes[5].table.len(); got < 5 {
+		t.Errorf("last node knows %d nodes, want at least 5", got)
+	}
+}
+
+func TestBootstrapWithoutNodes(t *testing.T) {
+	d, err := New(Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Bootstrap(context.Background()); !errors.Is(err, errNoNodes) {
+		t.Errorf("got %v, want errNoNodes", err)
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	nodes := newTestNodes(t, 6)
+
+	found, err := nodes[5].FindNode(context.Background(), nodes[3].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) == 0 || found[0].ID != nodes[3].ID() {
+		t.Fatalf("closest node is not the target: %v", found)
+	}
+	if found[0].Addr != nodes[3].Addr() {
+		t.Errorf("got addr %s, want %s", found[0].Addr, nodes[3].Addr())
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := newTestNodes(t, 6)
+	ctx := context.Background()
+	infoHash := RandomID()
+
+	peers, err := nodes[1].GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("got peers before any announce: %v", peers)
+	}
+
+	if _, err := nodes[2].Announce(ctx, infoHash, 51413, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[3].Announce(ctx, infoHash, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err = nodes[5].GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[netip.AddrPort]bool{
+		netip.MustParseAddrPort("127.0.0.1:51413"): true,
+		// implied_port uses the DHT port of the announcing node.
+		nodes[3].Addr(): true,
+	}
+	if len(peers) != len(want) {
+		t.Fatalf("got peers %v, want %v", peers, want)
+	}
+	for _, p := range peers {
+		if !want[p] {
+			t.Errorf("unexpected peer %s", p)
+		}
+	}
+}
+
+func TestAnnounceBadToken(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+
+	_, err := nodes[1].query(context.Background(), nodes[0].Addr(), "announce_peer", map[string]interface{}{
+		"info_hash": string(make([]byte, 20)),
+		"port":      6881,
+		"token":     "bogus",
+	})
+	var kerr *krpcError
+	if !errors.As(err, &kerr) || kerr.Code != errProtocol {
+		t.Fatalf("got %v, want protocol error", err)
+	}
+	if peers := nodes[0].peers.get(ID{}, false); len(peers) != 0 {
+		t.Errorf("peer stored despite bad token: %v", peers)
+	}
+}
+
+func TestPeerStoreLimits(t *testing.T) {
+	s := newPeerStore()
+	infoHash := RandomID()
+	peerAddr := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 6881)
+	}
+	for i := 0; i <= maxStoredPeers; i++ {
+		s.add(infoHash, peerAddr(i), false)
+	}
+	if n := len(s.peers[infoHash].peers); n != maxStoredPeers {
+		t.Errorf("stored %d peers, want %d", n, maxStoredPeers)
+	}
+	if _, ok := s.peers[infoHash].peers[peerAddr(0)]; ok {
+		t.Error("oldest peer not evicted")
+	}
+
+	for i := 1; i < maxStoredHashes; i++ {
+		s.add(RandomID(), peerAddr(0), false)
+	}
+	// Announcing again keeps the first swarm fresh.
+	s.add(infoHash, peerAddr(1), false)
+	s.add(RandomID(), peerAddr(0), false)
+	if n := len(s.peers); n != maxStoredHashes {
+		t.Errorf("stored %d infohashes, want %d", n, maxStoredHashes)
+	}
+	if s.peers[infoHash] == nil {
+		t.Error("recently announced infohash evicted")
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+
+	_, err := nodes[1].query(context.Background(), nodes[0].Addr(), "frobnicate", map[string]interface{}{})
+	var kerr *krpcError
+	if !errors.As(err, &kerr) || kerr.Code != errMethodUnknown {
+		t.Fatalf("got %v, want method unknown error", err)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	d, err := New(Config{Addr: "127.0.0.1:0", QueryTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Nothing listens on port 9 of loopback.
+	_, err = d.Ping(context.Background(), netip.MustParseAddrPort("127.0.0.1:9"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestResponseFromOtherAddressIgnored(t *testing.T) {
+	d, err := New(Config{Addr: "127.0.0.1:0", QueryTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	node, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+
+	type result struct {
+		id  ID
+		err error
+	}
+	resultC := make(chan result, 1)
+	go func() {
+		id, err := d.Ping(context.Background(), node.LocalAddr().(*net.UDPAddr).AddrPort())
+		resultC <- result{id, err}
+	}()
+
+	buf := make([]byte, 1500)
+	node.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := node.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := decodeMsg(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := func(conn *net.UDPConn, id ID) {
+		data, err := (&msg{T: query.T, Y: "r", R: map[string]interface{}{"id": string(id[:])}}).encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.WriteToUDPAddrPort(data, d.Addr())
+	}
+
+	// The attacker knows the transaction ID but not the node's address.
+	forged, real := RandomID(), RandomID()
+	reply(attacker, forged)
+	time.Sleep(50 * time.Millisecond)
+	reply(node, real)
+
+	r := <-resultC
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.id != real {
+		t.Errorf("ping returned %s, want the queried node's %s", r.id, real)
+	}
+}
+
+func TestKRPCRoundTrip(t *testing.T) {
+	m := &msg{T: "aa", Y: "q", Q: "ping", A: map[string]interface{}{"id": "abcdefghij0123456789"}}
+	data, err := m.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe" {
+		t.Errorf("got %q", data)
+	}
+
+	decoded, err := decodeMsg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Q != "ping" || decoded.T != "aa" {
+		t.Errorf("got %+v", decoded)
+	}
+	if id, ok := decoded.senderID(); !ok || string(id[:]) != "abcdefghij0123456789" {
+		t.Errorf("got sender %s", id)
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []NodeInfo{
+		{ID: RandomID(), Addr: netip.MustParseAddrPort("1.2.3.4:6881")},
+		{ID: RandomID(), Addr: netip.MustParseAddrPort("[::1]:6881")},
+		{ID: RandomID(), Addr: netip.MustParseAddrPort("10.0.0.1:1")},
+	}
+	got := decodeCompactNodes(string(encodeCompactNodes(nodes)))
+	if len(got) != 2 || got[0] != nodes[0] || got[1] != nodes[2] {
+		t.Errorf("got %v", got)
+	}
+}
@@ -0,0 +1,193 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
+)
+
+// KRPC error codes from BEP 5.
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// msg is a decoded KRPC message. Queries carry Q and A, responses R and
+// errors E. IP is the compact address a response was sent to (BEP 42) and
+// RO marks queries from read-only nodes (BEP 43).
+type msg struct {
+	T  string
+	Y  string
+	Q  string
+	A  map[string]interface{}
+	R  map[string]interface{}
+	E  []interface{}
+	IP string
+	RO bool
+}
+
+type krpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *krpcError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+func decodeMsg(data []byte) (*msg, error) {
+	decoded, err := bencode.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("krpc message is not a dictionary")
+	}
+
+	m := &msg{}
+	if m.T, ok = dict["t"].(string); !ok {
+		return nil, fmt.Errorf("krpc message missing transaction id")
+	}
+	if m.Y, ok = dict["y"].(string); !ok {
+		return nil, fmt.Errorf("krpc message missing type")
+	}
+	m.IP, _ = dict["ip"].(string)
+	m.RO = dict["ro"] == 1
+
+	switch m.Y {
+	case "q":
+		if m.Q, ok = dict["q"].(string); !ok {
+			return nil, fmt.Errorf("krpc query missing method")
+		}
+		if m.A, ok = dict["a"].(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("krpc query missing arguments")
+		}
+	case "r":
+		if m.R, ok = dict["r"].(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("krpc response missing body")
+		}
+	case "e":
+		if m.E, ok = dict["e"].([]interface{}); !ok {
+			return nil, fmt.Errorf("krpc error missing body")
+		}
+	default:
+		return nil, fmt.Errorf("unknown krpc message type %q", m.Y)
+	}
+	return m, nil
+}
+
+func (m *msg) encode() ([]byte, error) {
+	dict := map[string]interface{}{
+		"t": m.T,
+		"y": m.Y,
+	}
+	if m.IP != "" {
+		dict["ip"] = m.IP
+	}
+	if m.RO {
+		dict["ro"] = 1
+	}
+	switch m.Y {
+	case "q":
+		dict["q"] = m.Q
+		dict["a"] = m.A
+	case "r":
+		dict["r"] = m.R
+	case "e":
+		dict["e"] = m.E
+	}
+	return bencode.Encode(dict)
+}
+
+func (m *msg) err() error {
+	if m.Y != "e" {
+		return nil
+	}
+	e := &krpcError{Code: errGeneric}
+	if len(m.E) > 0 {
+		if code, ok := m.E[0].(int); ok {
+			e.Code = code
+		}
+	}
+	if len(m.E) > 1 {
+		e.Message, _ = m.E[1].(string)
+	}
+	return e
+}
+
+// senderID returns the "id" of the querying or responding node.
+func (m *msg) senderID() (ID, bool) {
+	body := m.A
+	if m.Y == "r" {
+		body = m.R
+	}
+	raw, ok := body["id"].(string)
+	if !ok || len(raw) != 20 {
+		return ID{}, false
+	}
+	return ID([]byte(raw)), true
+}
+
+func stringArg(args map[string]interface{}, key string) (string, bool) {
+	v, ok := args[key].(string)
+	return v, ok
+}
+
+func idArg(args map[string]interface{}, key string) (ID, bool) {
+	v, ok := args[key].(string)
+	if !ok || len(v) != 20 {
+		return ID{}, false
+	}
+	return ID([]byte(v)), true
+}
+
+// encodeCompactNodes packs IPv4 nodes into the 26-byte compact node info
+// format.
+func encodeCompactNodes(nodes []NodeInfo) []byte {
+	b := make([]byte, 0, 26*len(nodes))
+	for _, n := range nodes {
+		if !n.Addr.Addr().Is4() {
+			continue
+		}
+		b = append(b, n.ID[:]...)
+		b = append(b, encodeCompactAddr(n.Addr)...)
+	}
+	return b
+}
+
+func decodeCompactNodes(b string) []NodeInfo {
+	var nodes []NodeInfo
+	for i := 0; i+26 <= len(b); i += 26 {
+		addr, ok := decodeCompactAddr([]byte(b[i+20 : i+26]))
+		if !ok {
+			continue
+		}
+		nodes = append(nodes, NodeInfo{ID: ID([]byte(b[i : i+20])), Addr: addr})
+	}
+	return nodes
+}
+
+func encodeCompactAddr(addr netip.AddrPort) []byte {
+	b := addr.Addr().Unmap().AsSlice()
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+func decodeCompactAddr(b []byte) (netip.AddrPort, bool) {
+	if len(b) != 6 && len(b) != 18 {
+		return netip.AddrPort{}, false
+	}
+	ip, ok := netip.AddrFromSlice(b[:len(b)-2])
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	port := binary.BigEndian.Uint16(b[len(b)-2:])
+	if port == 0 {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ip, port), true
+}
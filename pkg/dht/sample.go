@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSamples is the number of infohashes that fit in a
+	// sample_infohashes response next to the nodes (BEP 51).
+	maxSamples = 20
+	// sampleRefresh is how long a sample is handed out before a new one is
+	// drawn, and so the longest a requester is asked to wait.
+	sampleRefresh = 5 * time.Minute
+)
+
+// sampler keeps the random sample of the infohashes we hold peers for that
+// is returned to sample_infohashes queries.
+type sampler struct {
+	mu     sync.Mutex
+	hashes []ID
+	total  int
+	drawn  time.Time
+}
+
+// sample returns the current sample, the number of infohashes it was drawn
+// from and the time until it is replaced.
+func (s *sampler) sample(peers *peerStore, now time.Time) ([]ID, int, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.hashes) == 0 || now.Sub(s.drawn) >= sampleRefresh {
+		all := peers.infoHashes()
+		rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+		s.total = len(all)
+		if len(all) > maxSamples {
+			all = all[:maxSamples]
+		}
+		s.hashes = all
+		s.drawn = now
+	}
+	return s.hashes, s.total, sampleRefresh - now.Sub(s.drawn)
+}
+
+// handleSampleInfoHashes answers a sample_infohashes query (BEP 51).
+func (d *DHT) handleSampleInfoHashes(args map[string]interface{}, r map[string]interface{}) *krpcError {
+	target, ok := idArg(args, "target")
+	if !ok {
+		return &krpcError{errProtocol, "invalid target"}
+	}
+	r["nodes"] = string(encodeCompactNodes(d.table.closest(target, K)))
+
+	hashes, total, wait := d.samples.sample(d.peers, time.Now())
+	samples := make([]byte, 0, len(hashes)*20)
+	for _, h := range hashes {
+		samples = append(samples, h[:]...)
+	}
+	r["samples"] = string(samples)
+	r["num"] = total
+	r["interval"] = int(wait / time.Second)
+	return nil
+}
+
+// Samples is a node's answer to a sample_infohashes query.
+type Samples struct {
+	// InfoHashes is a random sample of the infohashes the node stores
+	// peers for.
+	InfoHashes []ID
+	// Num is the total number of infohashes the node stores.
+	Num int
+	// Interval is how long the node keeps returning the same sample.
+	Interval time.Duration
+	// Nodes are the nodes the queried node knows closest to the target,
+	// for walking the keyspace.
+	Nodes []NodeInfo
+}
+
+// SampleInfoHashes asks the node at addr for a sample of the infohashes it
+// stores (BEP 51). Crawlers walk the DHT by querying the returned nodes
+// with targets spread across the keyspace.
+func (d *DHT) SampleInfoHashes(ctx context.Context, addr netip.AddrPort, target ID) (*Samples, error) {
+	resp, err := d.query(ctx, addr, "sample_infohashes", map[string]interface{}{
+		"target": string(target[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	raw, _ := stringArg(resp.R, "samples")
+	if len(raw)%20 != 0 {
+		return nil, fmt.Errorf("invalid samples length %d", len(raw))
+	}
+	s := &Samples{}
+	for i := 0; i < len(raw); i += 20 {
+		var h ID
+		copy(h[:], raw[i:i+20])
+		s.InfoHashes = append(s.InfoHashes, h)
+	}
+	s.Num, _ = resp.R["num"].(int)
+	interval, _ := resp.R["interval"].(int)
+	s.Interval = time.Duration(interval) * time.Second
+	if nodes, ok := stringArg(resp.R, "nodes"); ok {
+		s.Nodes = decodeCompactNodes(nodes)
+	}
+	return s, nil
+}
@@ -0,0 +1,73 @@
+package dht
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSampleInfoHashes(t *testing.T) {
+	nodes := newTestNodes(t, 3)
+	addr := netip.MustParseAddrPort("10.0.0.1:6881")
+
+	stored := make(map[ID]bool)
+	for i := 0; i < maxSamples+5; i++ {
+		h := RandomID()
+		stored[h] = true
+		nodes[0].peers.add(h, addr, false)
+	}
+
+	s, err := nodes[1].SampleInfoHashes(context.Background(), nodes[0].Addr(), RandomID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Num != maxSamples+5 || len(s.InfoHashes) != maxSamples {
+		t.Fatalf("got num %d with %d samples", s.Num, len(s.InfoHashes))
+	}
+	for _, h := range s.InfoHashes {
+		if !stored[h] {
+			t.Errorf("sampled unknown infohash %s", h)
+		}
+	}
+	if s.Interval <= 0 || s.Interval > sampleRefresh {
+		t.Errorf("got interval %s", s.Interval)
+	}
+	if len(s.Nodes) == 0 {
+		t.Error("no nodes returned")
+	}
+
+	// The same sample is handed out until it is refreshed.
+	again, err := nodes[2].SampleInfoHashes(context.Background(), nodes[0].Addr(), RandomID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range again.InfoHashes {
+		if again.InfoHashes[i] != s.InfoHashes[i] {
+			t.Fatal("sample changed before the refresh interval")
+		}
+	}
+}
+
+func TestSamplerRefresh(t *testing.T) {
+	peers := newPeerStore()
+	var s sampler
+	now := time.Now()
+
+	// An empty sample is redrawn as soon as there is something to sample.
+	if hashes, num, _ := s.sample(peers, now); len(hashes) != 0 || num != 0 {
+		t.Fatalf("got %d samples of %d", len(hashes), num)
+	}
+	peers.add(RandomID(), netip.MustParseAddrPort("10.0.0.1:6881"), false)
+	if hashes, num, _ := s.sample(peers, now); len(hashes) != 1 || num != 1 {
+		t.Fatalf("got %d samples of %d", len(hashes), num)
+	}
+
+	peers.add(RandomID(), netip.MustParseAddrPort("10.0.0.1:6881"), false)
+	if _, num, _ := s.sample(peers, now.Add(time.Minute)); num != 1 {
+		t.Errorf("sample redrawn early, num %d", num)
+	}
+	if _, num, _ := s.sample(peers, now.Add(sampleRefresh)); num != 2 {
+		t.Errorf("sample not redrawn, num %d", num)
+	}
+}
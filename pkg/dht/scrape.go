@@ -0,0 +1,80 @@
+package dht
+
+import (
+	"context"
+	"crypto/sha1"
+	"math"
+	"net/netip"
+)
+
+// bloomBits is the size of the BEP 33 scrape bloom filters.
+const bloomBits = 2048
+
+// bloomFilter is the 256-byte filter of peer addresses returned in BFsd
+// and BFpe by get_peers scrapes (BEP 33).
+type bloomFilter [bloomBits / 8]byte
+
+func (f *bloomFilter) add(ip netip.Addr) {
+	h := sha1.Sum(ip.Unmap().AsSlice())
+	for _, index := range []int{int(h[0]) | int(h[1])<<8, int(h[2]) | int(h[3])<<8} {
+		index %= bloomBits
+		f[index/8] |= 1 << (index % 8)
+	}
+}
+
+func (f *bloomFilter) merge(other []byte) {
+	if len(other) != len(f) {
+		return
+	}
+	for i := range f {
+		f[i] |= other[i]
+	}
+}
+
+// estimate returns the approximate number of distinct addresses added to
+// the filter.
+func (f *bloomFilter) estimate() int {
+	zeros := 0
+	for _, b := range f {
+		for i := 0; i < 8; i++ {
+			if b&(1<<i) == 0 {
+				zeros++
+			}
+		}
+	}
+	if zeros == 0 {
+		zeros = 1
+	}
+	m := float64(bloomBits)
+	return int(math.Round(estimateCount(float64(zeros), m)))
+}
+
+func estimateCount(zeros, m float64) float64 {
+	return math.Log(zeros/m) / (2 * math.Log(1-1/m))
+}
+
+// ScrapeResult is the estimated size of a swarm from a DHT scrape.
+type ScrapeResult struct {
+	Seeders int
+	Peers   int
+}
+
+// Scrape estimates the number of seeders and downloaders of infoHash by
+// merging the bloom filters returned by the nodes closest to it (BEP 33).
+func (d *DHT) Scrape(ctx context.Context, infoHash ID) (ScrapeResult, error) {
+	res, err := d.lookup(ctx, infoHash, "get_peers", map[string]interface{}{"scrape": 1})
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	var seeds, peers bloomFilter
+	for _, c := range res.responders() {
+		if bf, ok := stringArg(c.reply, "BFsd"); ok {
+			seeds.merge([]byte(bf))
+		}
+		if bf, ok := stringArg(c.reply, "BFpe"); ok {
+			peers.merge([]byte(bf))
+		}
+	}
+	return ScrapeResult{Seeders: seeds.estimate(), Peers: peers.estimate()}, nil
+}
@@ -0,0 +1,100 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/netip"
+	"testing"
+)
+
+func TestBloomFilterEstimate(t *testing.T) {
+	// The test vector from BEP 33.
+	var f bloomFilter
+	for i := 0; i < 256; i++ {
+		f.add(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}))
+	}
+	for i := 0; i <= 0x3e8; i++ {
+		f.add(netip.MustParseAddr(fmt.Sprintf("2001:db8::%x", i)))
+	}
+
+	zeros := 0
+	for _, b := range f {
+		for i := 0; i < 8; i++ {
+			if b&(1<<i) == 0 {
+				zeros++
+			}
+		}
+	}
+	if got := estimateCount(float64(zeros), bloomBits); math.Abs(got-1224.93) > 0.01 {
+		t.Errorf("got estimate %.2f, want 1224.93", got)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	nodes := newTestNodes(t, 6)
+	ctx := context.Background()
+	infoHash := RandomID()
+
+	// Announces from loopback all share one IP, so each swarm member needs
+	// its own address to be counted; store them directly.
+	for _, d := range nodes {
+		for i := 1; i <= 3; i++ {
+			d.peers.add(infoHash, netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881), true)
+		}
+		for i := 1; i <= 5; i++ {
+			d.peers.add(infoHash, netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 1, byte(i)}), 6881), false)
+		}
+	}
+
+	res, err := nodes[1].Scrape(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Seeders != 3 || res.Peers != 5 {
+		t.Errorf("got %+v, want 3 seeders and 5 peers", res)
+	}
+}
+
+func TestGetPeersNoSeed(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+	ctx := context.Background()
+	infoHash := RandomID()
+	seed := netip.MustParseAddrPort("10.0.0.1:6881")
+	leech := netip.MustParseAddrPort("10.0.0.2:6881")
+	nodes[0].peers.add(infoHash, seed, true)
+	nodes[0].peers.add(infoHash, leech, false)
+
+	resp, err := nodes[1].query(ctx, nodes[0].Addr(), "get_peers", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"noseed":    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ := resp.R["values"].([]interface{})
+	if len(values) != 1 {
+		t.Fatalf("got %d values, want 1", len(values))
+	}
+	s, _ := values[0].(string)
+	if addr, _ := decodeCompactAddr([]byte(s)); addr != leech {
+		t.Errorf("got %s, want %s", addr, leech)
+	}
+}
+
+func TestAnnounceSeed(t *testing.T) {
+	nodes := newTestNodes(t, 4)
+	ctx := context.Background()
+	infoHash := RandomID()
+
+	if _, err := nodes[1].Announce(ctx, infoHash, 6881, true); err != nil {
+		t.Fatal(err)
+	}
+	res, err := nodes[2].Scrape(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Seeders != 1 || res.Peers != 0 {
+		t.Errorf("got %+v, want 1 seeder", res)
+	}
+}
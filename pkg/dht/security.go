@@ -0,0 +1,96 @@
+package dht
+
+import (
+	"hash/crc32"
+	"net/netip"
+)
+
+// BEP 42 masks applied to an address before hashing it into a node ID.
+var (
+	v4Mask = []byte{0x03, 0x0f, 0x3f, 0xff}
+	v6Mask = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// nodeIDPrefix returns the CRC32-C that the first 21 bits of a node ID for
+// ip must match, given the random value r stored in the ID's last byte.
+func nodeIDPrefix(ip netip.Addr, r byte) uint32 {
+	ip = ip.Unmap()
+	mask := v4Mask
+	if ip.Is6() {
+		mask = v6Mask
+	}
+	b := ip.AsSlice()[:len(mask)]
+	for i := range b {
+		b[i] &= mask[i]
+	}
+	b[0] |= (r & 0x7) << 5
+	return crc32.Checksum(b, castagnoli)
+}
+
+// GenerateNodeID returns a random node ID that is valid for ip under
+// BEP 42.
+func GenerateNodeID(ip netip.Addr) ID {
+	id := RandomID()
+	crc := nodeIDPrefix(ip, id[19])
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x7
+	return id
+}
+
+// NodeIDValid reports whether id was derived from ip as BEP 42 requires.
+// Nodes on local networks are exempt.
+func NodeIDValid(id ID, ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	crc := nodeIDPrefix(ip, id[19])
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// externalIPVotes is the number of nodes that must agree on our external
+// address before we trust it.
+const externalIPVotes = 3
+
+// voteExternalIP records the address a node saw our queries coming from.
+// Once enough nodes agree on a new address our ID is regenerated to match
+// it, unless the ID was configured explicitly.
+func (d *DHT) voteExternalIP(ip netip.Addr, voter netip.AddrPort) {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() {
+		return
+	}
+
+	d.mu.Lock()
+	if d.ipVoters[ip] == nil {
+		d.ipVoters[ip] = make(map[netip.Addr]bool)
+	}
+	d.ipVoters[ip][voter.Addr()] = true
+	if len(d.ipVoters[ip]) < externalIPVotes || d.externalIP == ip {
+		d.mu.Unlock()
+		return
+	}
+	d.externalIP = ip
+	d.ipVoters = make(map[netip.Addr]map[netip.Addr]bool)
+	regenerate := d.cfg.ID == (ID{}) && !NodeIDValid(d.id, ip)
+	if regenerate {
+		d.id = GenerateNodeID(ip)
+	}
+	id := d.id
+	d.mu.Unlock()
+
+	if regenerate {
+		d.table.setSelf(id)
+	}
+}
+
+// ExternalIP returns our address as seen by other nodes, once enough of
+// them agree on it.
+func (d *DHT) ExternalIP() netip.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.externalIP
+}
@@ -0,0 +1,180 @@
+package dht
+
+import (
+	"context"
+	"encoding/hex"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// Test vectors from BEP 42: the first 21 bits of the ID are derived from
+// the IP and the random value in the last byte.
+var bep42Vectors = []struct {
+	ip     string
+	rand   byte
+	prefix string
+}{
+	{"124.31.75.21", 1, "5fbfbf"},
+	{"21.75.31.124", 86, "5a3ce9"},
+	{"65.23.51.170", 22, "a5d432"},
+	{"84.124.73.14", 65, "1b0321"},
+	{"43.213.53.83", 90, "e56f6c"},
+}
+
+func TestBEP42Vectors(t *testing.T) {
+	for _, v := range bep42Vectors {
+		ip := netip.MustParseAddr(v.ip)
+		crc := nodeIDPrefix(ip, v.rand)
+
+		var id ID
+		id[0] = byte(crc >> 24)
+		id[1] = byte(crc >> 16)
+		id[2] = byte(crc >> 8)
+		id[19] = v.rand
+		want, _ := hex.DecodeString(v.prefix)
+		// Only the top five bits of the third byte are fixed.
+		if id[0] != want[0] || id[1] != want[1] || id[2]&0xf8 != want[2]&0xf8 {
+			t.Errorf("%s: got prefix %x, want %s", v.ip, id[:3], v.prefix)
+		}
+
+		// The full IDs from the spec validate against their IP and no other.
+		id[2] = want[2]
+		if !NodeIDValid(id, ip) {
+			t.Errorf("%s: spec ID rejected", v.ip)
+		}
+		if NodeIDValid(id, netip.MustParseAddr("8.8.8.8")) {
+			t.Errorf("%s: spec ID accepted for another IP", v.ip)
+		}
+	}
+}
+
+func TestGenerateNodeID(t *testing.T) {
+	for _, s := range []string{"124.31.75.21", "2001:db8::1", "::ffff:21.75.31.124"} {
+		ip := netip.MustParseAddr(s)
+		for i := 0; i < 20; i++ {
+			if id := GenerateNodeID(ip); !NodeIDValid(id, ip) {
+				t.Fatalf("%s: generated ID %s is invalid", s, id)
+			}
+		}
+	}
+
+	public := netip.MustParseAddr("203.0.113.7")
+	if NodeIDValid(ID{}, public) {
+		t.Error("zero ID accepted for public IP")
+	}
+	for _, s := range []string{"127.0.0.1", "10.1.2.3", "192.168.1.1", "169.254.0.1"} {
+		if !NodeIDValid(ID{}, netip.MustParseAddr(s)) {
+			t.Errorf("local address %s not exempt", s)
+		}
+	}
+}
+
+func TestAddNodeRejectsInvalidID(t *testing.T) {
+	d, err := New(Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ip := netip.MustParseAddr("203.0.113.7")
+	d.addNode(NodeInfo{ID: RandomID(), Addr: netip.AddrPortFrom(ip, 6881)})
+	d.addNode(NodeInfo{ID: GenerateNodeID(ip), Addr: netip.AddrPortFrom(ip, 6881)})
+	if got := d.table.len(); got != 1 {
+		t.Errorf("table has %d nodes, want only the valid one", got)
+	}
+}
+
+func TestExternalIPVoteRegeneratesID(t *testing.T) {
+	d, err := New(Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ip := netip.MustParseAddr("203.0.113.7")
+	d.voteExternalIP(ip, netip.MustParseAddrPort("198.51.100.1:6881"))
+	d.voteExternalIP(ip, netip.MustParseAddrPort("198.51.100.1:6882"))
+	d.voteExternalIP(ip, netip.MustParseAddrPort("198.51.100.2:6881"))
+	if d.ExternalIP().IsValid() {
+		t.Fatal("external IP accepted from two distinct voters")
+	}
+
+	d.voteExternalIP(ip, netip.MustParseAddrPort("198.51.100.3:6881"))
+	if d.ExternalIP() != ip {
+		t.Fatalf("got external IP %s", d.ExternalIP())
+	}
+	if !NodeIDValid(d.ID(), ip) {
+		t.Error("ID was not regenerated for the external IP")
+	}
+
+	fixed := RandomID()
+	d2, err := New(Config{Addr: "127.0.0.1:0", ID: fixed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	for i := 1; i <= externalIPVotes; i++ {
+		d2.voteExternalIP(ip, netip.AddrPortFrom(netip.AddrFrom4([4]byte{198, 51, 100, byte(i)}), 6881))
+	}
+	if d2.ID() != fixed {
+		t.Error("configured ID was replaced")
+	}
+}
+
+func TestExternalIPConfig(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.7")
+	d, err := New(Config{Addr: "127.0.0.1:0", ExternalIP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if !NodeIDValid(d.ID(), ip) {
+		t.Error("ID not derived from configured external IP")
+	}
+}
+
+func TestReadOnlyNode(t *testing.T) {
+	nodes := newTestNodes(t, 4)
+	ctx := context.Background()
+	infoHash := RandomID()
+	if _, err := nodes[1].Announce(ctx, infoHash, 6881, false); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := New(Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: []string{nodes[0].Addr().String()},
+		QueryTimeout:   200 * time.Millisecond,
+		ReadOnly:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if err := ro.Bootstrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read-only node can still search the DHT.
+	peers, err := ro.GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 {
+		t.Errorf("got peers %v", peers)
+	}
+
+	// Nobody adds it to their routing table, and it does not answer.
+	for _, d := range nodes {
+		for _, n := range d.Nodes() {
+			if n.ID == ro.ID() {
+				t.Errorf("read-only node in routing table of %s", d.Addr())
+			}
+		}
+	}
+	if _, err := nodes[0].Ping(ctx, ro.Addr()); err == nil {
+		t.Error("read-only node answered a ping")
+	}
+}
@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
+)
+
+// state is what is kept in Config.StateFile between runs: our node ID and
+// the nodes that were answering us, so a restarted node can rejoin the
+// network without the bootstrap nodes.
+type state struct {
+	ID    ID
+	Nodes []NodeInfo
+}
+
+func loadState(path string) (*state, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := bencode.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DHT state file: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid DHT state file")
+	}
+
+	id, ok := idArg(dict, "id")
+	if !ok {
+		return nil, fmt.Errorf("DHT state file missing node id")
+	}
+	nodes, _ := stringArg(dict, "nodes")
+	return &state{ID: id, Nodes: decodeCompactNodes(nodes)}, nil
+}
+
+func (s *state) save(path string) error {
+	data, err := bencode.Encode(map[string]interface{}{
+		"id":    string(s.ID[:]),
+		"nodes": string(encodeCompactNodes(s.Nodes)),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a torn state
+	// file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SaveState writes our node ID and the nodes that are answering us to
+// Config.StateFile. It is called by Close.
+func (d *DHT) SaveState() error {
+	if d.cfg.StateFile == "" {
+		return nil
+	}
+	s := &state{ID: d.ID(), Nodes: d.table.responsiveNodes()}
+	return s.save(d.cfg.StateFile)
+}
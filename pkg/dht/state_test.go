@@ -0,0 +1,130 @@
+package dht
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.state")
+	s := &state{
+		ID: RandomID(),
+		Nodes: []NodeInfo{
+			{ID: RandomID(), Addr: netip.MustParseAddrPort("127.0.0.1:6881")},
+			{ID: RandomID(), Addr: netip.MustParseAddrPort("10.0.0.2:51413")},
+		},
+	}
+	if err := s.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID != s.ID || len(loaded.Nodes) != 2 || loaded.Nodes[0] != s.Nodes[0] || loaded.Nodes[1] != s.Nodes[1] {
+		t.Errorf("got %+v, want %+v", loaded, s)
+	}
+}
+
+func TestRestartRestoresState(t *testing.T) {
+	nodes := newTestNodes(t, 4)
+	path := filepath.Join(t.TempDir(), "dht.state")
+	ctx := context.Background()
+
+	first, err := New(Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: []string{nodes[0].Addr().String()},
+		StateFile:      path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Bootstrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	id := first.ID()
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without any bootstrap nodes the restarted node rejoins through the
+	// nodes it remembered.
+	second, err := New(Config{Addr: "127.0.0.1:0", StateFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if second.ID() != id {
+		t.Errorf("node ID not restored")
+	}
+	if got := second.table.len(); got != 4 {
+		t.Errorf("restored %d nodes, want 4", got)
+	}
+	if err := second.Bootstrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Ping(ctx, nodes[2].Addr()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBootstrapFallsBackFromStaleState(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+	path := filepath.Join(t.TempDir(), "dht.state")
+
+	// The only remembered node is gone.
+	dead := &state{
+		ID:    RandomID(),
+		Nodes: []NodeInfo{{ID: RandomID(), Addr: netip.MustParseAddrPort("127.0.0.1:9")}},
+	}
+	if err := dead.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(Config{
+		Addr:           "127.0.0.1:0",
+		BootstrapNodes: []string{nodes[0].Addr().String()},
+		StateFile:      path,
+		QueryTimeout:   200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Bootstrap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d.ID() != dead.ID {
+		t.Error("saved ID not used")
+	}
+}
+
+func TestCorruptStateIgnored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.state")
+	if err := os.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(Config{Addr: "127.0.0.1:0", StateFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.table.len() != 0 {
+		t.Error("nodes restored from corrupt state")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close replaced the corrupt file with a valid one.
+	if s, err := loadState(path); err != nil || s.ID != d.ID() {
+		t.Errorf("state not rewritten: %v", err)
+	}
+}
@@ -0,0 +1,378 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
+)
+
+// BEP 44 error codes and limits.
+const (
+	errValueTooBig   = 205
+	errInvalidSig    = 206
+	errSaltTooBig    = 207
+	errCASMismatch   = 301
+	errSeqTooLow     = 302
+	maxValueSize     = 1000
+	maxSaltSize      = 64
+	itemTTL          = 2 * time.Hour
+	itemStoreMaxSize = 10000
+)
+
+// ImmutableTarget returns the key an immutable item with value v is
+// stored under: the SHA-1 of its bencoded form.
+func ImmutableTarget(v interface{}) (ID, error) {
+	raw, err := bencode.Encode(v)
+	if err != nil {
+		return ID{}, err
+	}
+	return sha1.Sum(raw), nil
+}
+
+// MutableTarget returns the key a mutable item signed with pub and salt is
+// stored under.
+func MutableTarget(pub ed25519.PublicKey, salt []byte) ID {
+	return sha1.Sum(append(append([]byte{}, pub...), salt...))
+}
+
+// MutableItem is a signed, versioned value stored in the DHT (BEP 44).
+type MutableItem struct {
+	Key   ed25519.PublicKey
+	Salt  []byte
+	Seq   int64
+	Value interface{}
+	Sig   []byte
+}
+
+// SignMutable returns an item holding v signed with key.
+func SignMutable(key ed25519.PrivateKey, salt []byte, seq int64, v interface{}) (*MutableItem, error) {
+	item := &MutableItem{
+		Key:   key.Public().(ed25519.PublicKey),
+		Salt:  salt,
+		Seq:   seq,
+		Value: v,
+	}
+	msg, err := item.signedData()
+	if err != nil {
+		return nil, err
+	}
+	item.Sig = ed25519.Sign(key, msg)
+	return item, nil
+}
+
+func (m *MutableItem) Target() ID {
+	return MutableTarget(m.Key, m.Salt)
+}
+
+// signedData is the buffer covered by the signature: the bencoded salt,
+// seq and v keys as they would appear in a dictionary, without the outer
+// "d" and "e".
+func (m *MutableItem) signedData() ([]byte, error) {
+	raw, err := bencode.Encode(m.Value)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if len(m.Salt) > 0 {
+		buf.WriteString("4:salt" + strconv.Itoa(len(m.Salt)) + ":")
+		buf.Write(m.Salt)
+	}
+	buf.WriteString("3:seqi" + strconv.FormatInt(m.Seq, 10) + "e1:v")
+	buf.Write(raw)
+	return buf.Bytes(), nil
+}
+
+func (m *MutableItem) Verify() error {
+	if len(m.Key) != ed25519.PublicKeySize || len(m.Sig) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid key or signature size")
+	}
+	msg, err := m.signedData()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(m.Key, msg, m.Sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+type storedItem struct {
+	value   interface{}
+	raw     []byte
+	mutable *MutableItem
+	stored  time.Time
+}
+
+// itemStore holds the BEP 44 items other nodes put to us.
+type itemStore struct {
+	mu    sync.Mutex
+	items map[ID]*storedItem
+}
+
+func newItemStore() *itemStore {
+	return &itemStore{items: make(map[ID]*storedItem)}
+}
+
+func (s *itemStore) get(target ID) *storedItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items[target]
+}
+
+func (s *itemStore) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for target, item := range s.items {
+		if now.Sub(item.stored) > itemTTL {
+			delete(s.items, target)
+		}
+	}
+}
+
+// put stores an item, enforcing sequence numbers and compare-and-swap for
+// mutable items. cas is ignored when negative.
+func (s *itemStore) put(target ID, item *storedItem, cas int64) *krpcError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.items[target]
+	if old == nil && len(s.items) >= itemStoreMaxSize {
+		return &krpcError{errServer, "storage full"}
+	}
+	if old != nil && item.mutable != nil && old.mutable != nil {
+		if cas >= 0 && cas != old.mutable.Seq {
+			return &krpcError{errCASMismatch, "cas mismatch"}
+		}
+		if item.mutable.Seq < old.mutable.Seq ||
+			item.mutable.Seq == old.mutable.Seq && !bytes.Equal(item.raw, old.raw) {
+			return &krpcError{errSeqTooLow, "sequence number less than current"}
+		}
+	}
+	s.items[target] = item
+	return nil
+}
+
+// handleGet answers a BEP 44 get query, adding the stored item, if any, to
+// the response r.
+func (d *DHT) handleGet(args map[string]interface{}, r map[string]interface{}) *krpcError {
+	target, ok := idArg(args, "target")
+	if !ok {
+		return &krpcError{errProtocol, "invalid target"}
+	}
+	r["nodes"] = string(encodeCompactNodes(d.table.closest(target, K)))
+
+	item := d.items.get(target)
+	if item == nil {
+		return nil
+	}
+	if item.mutable == nil {
+		r["v"] = item.value
+		return nil
+	}
+	r["k"] = string(item.mutable.Key)
+	r["seq"] = item.mutable.Seq
+	r["sig"] = string(item.mutable.Sig)
+	// A requester that already has this sequence number gets no value.
+	if seq, ok := args["seq"].(int); !ok || int64(seq) < item.mutable.Seq {
+		r["v"] = item.value
+	}
+	return nil
+}
+
+// handlePut validates and stores an item sent with a BEP 44 put query.
+func (d *DHT) handlePut(args map[string]interface{}) *krpcError {
+	v, ok := args["v"]
+	if !ok {
+		return &krpcError{errProtocol, "missing v"}
+	}
+	raw, err := bencode.Encode(v)
+	if err != nil {
+		return &krpcError{errProtocol, "invalid v"}
+	}
+	if len(raw) > maxValueSize {
+		return &krpcError{errValueTooBig, "message (v field) too big"}
+	}
+
+	item := &storedItem{value: v, raw: raw, stored: time.Now()}
+	key, mutable := stringArg(args, "k")
+	if !mutable {
+		return d.items.put(sha1.Sum(raw), item, -1)
+	}
+
+	salt, _ := stringArg(args, "salt")
+	if len(salt) > maxSaltSize {
+		return &krpcError{errSaltTooBig, "salt (salt field) too big"}
+	}
+	seq, _ := args["seq"].(int)
+	sig, _ := stringArg(args, "sig")
+	item.mutable = &MutableItem{
+		Key:   ed25519.PublicKey(key),
+		Salt:  []byte(salt),
+		Seq:   int64(seq),
+		Value: v,
+		Sig:   []byte(sig),
+	}
+	if item.mutable.Verify() != nil {
+		return &krpcError{errInvalidSig, "invalid signature"}
+	}
+
+	cas := int64(-1)
+	if c, ok := args["cas"].(int); ok {
+		cas = int64(c)
+	}
+	return d.items.put(item.mutable.Target(), item, cas)
+}
+
+// PutImmutable stores v on the nodes closest to its target and returns the
+// target.
+func (d *DHT) PutImmutable(ctx context.Context, v interface{}) (ID, error) {
+	target, err := ImmutableTarget(v)
+	if err != nil {
+		return ID{}, err
+	}
+	return target, d.put(ctx, target, map[string]interface{}{"v": v})
+}
+
+// GetImmutable retrieves the immutable item stored under target, checking
+// that its value hashes to target.
+func (d *DHT) GetImmutable(ctx context.Context, target ID) (interface{}, error) {
+	res, err := d.lookup(ctx, target, "get", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range res.candidates {
+		v, ok := c.reply["v"]
+		if !ok {
+			continue
+		}
+		if got, err := ImmutableTarget(v); err == nil && got == target {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("item %s not found", target)
+}
+
+// PutMutable stores a signed item on the nodes closest to its target.
+func (d *DHT) PutMutable(ctx context.Context, item *MutableItem) error {
+	return d.putMutable(ctx, item, -1)
+}
+
+// PutMutableCAS stores item only on nodes whose current sequence number for
+// it is cas, so concurrent writers cannot overwrite each other unnoticed.
+func (d *DHT) PutMutableCAS(ctx context.Context, item *MutableItem, cas int64) error {
+	return d.putMutable(ctx, item, cas)
+}
+
+func (d *DHT) putMutable(ctx context.Context, item *MutableItem, cas int64) error {
+	if err := item.Verify(); err != nil {
+		return err
+	}
+	if len(item.Salt) > maxSaltSize {
+		return fmt.Errorf("salt longer than %d bytes", maxSaltSize)
+	}
+	args := map[string]interface{}{
+		"k":   string(item.Key),
+		"seq": item.Seq,
+		"sig": string(item.Sig),
+		"v":   item.Value,
+	}
+	if len(item.Salt) > 0 {
+		args["salt"] = string(item.Salt)
+	}
+	if cas >= 0 {
+		args["cas"] = cas
+	}
+	return d.put(ctx, item.Target(), args)
+}
+
+// GetMutable retrieves the mutable item for pub and salt with the highest
+// sequence number any node holds, ignoring items with bad signatures.
+func (d *DHT) GetMutable(ctx context.Context, pub ed25519.PublicKey, salt []byte) (*MutableItem, error) {
+	target := MutableTarget(pub, salt)
+	res, err := d.lookup(ctx, target, "get", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *MutableItem
+	for _, c := range res.candidates {
+		v, ok := c.reply["v"]
+		if !ok {
+			continue
+		}
+		seq, _ := c.reply["seq"].(int)
+		sig, _ := stringArg(c.reply, "sig")
+		item := &MutableItem{Key: pub, Salt: salt, Seq: int64(seq), Value: v, Sig: []byte(sig)}
+		if item.Verify() != nil {
+			continue
+		}
+		if best == nil || item.Seq > best.Seq {
+			best = item
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("item %s not found", target)
+	}
+	return best, nil
+}
+
+// put sends a put query with args to the closest nodes to target that gave
+// us a token. It fails if no node stored the item or any node reported a
+// sequence number conflict.
+func (d *DHT) put(ctx context.Context, target ID, args map[string]interface{}) error {
+	res, err := d.lookup(ctx, target, "get", nil)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		stored int
+		errs   []error
+	)
+	for _, c := range res.closestWithToken() {
+		a := map[string]interface{}{"token": c.token}
+		for k, v := range args {
+			a[k] = v
+		}
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			_, err := d.query(ctx, c.Addr, "put", a)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			stored++
+		}(c)
+	}
+	wg.Wait()
+
+	// A node holding a newer value means the put lost a race, even if
+	// nodes that had not seen that value accepted it.
+	for _, err := range errs {
+		var kerr *krpcError
+		if errors.As(err, &kerr) && (kerr.Code == errCASMismatch || kerr.Code == errSeqTooLow) {
+			return err
+		}
+	}
+	if stored == 0 {
+		if len(errs) > 0 {
+			return fmt.Errorf("no DHT node stored the item: %w", errs[0])
+		}
+		return fmt.Errorf("no DHT node stored the item")
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBEP44Vectors(t *testing.T) {
+	pub, _ := hex.DecodeString("77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+	sig, _ := hex.DecodeString("305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff" +
+		"1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01")
+
+	item := &MutableItem{Key: pub, Seq: 1, Value: "Hello World!", Sig: sig}
+	if err := item.Verify(); err != nil {
+		t.Errorf("test vector 1 signature: %v", err)
+	}
+	if got := item.Target().String(); got != "4a533d47ec9c7d95b1ad75f576cffc641853b750" {
+		t.Errorf("mutable target: got %s", got)
+	}
+	if got := MutableTarget(pub, []byte("foobar")).String(); got != "411eba73b6f087ca51a3795d9c8c938d365e32c1" {
+		t.Errorf("salted mutable target: got %s", got)
+	}
+
+	target, err := ImmutableTarget("Hello World!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := target.String(); got != "e5f96f6f38320f0f33959cb4d3d656452117aadb" {
+		t.Errorf("immutable target: got %s", got)
+	}
+
+	item.Seq = 2
+	if item.Verify() == nil {
+		t.Error("signature accepted for a different sequence number")
+	}
+}
+
+func TestPutGetImmutable(t *testing.T) {
+	nodes := newTestNodes(t, 6)
+	ctx := context.Background()
+
+	value := map[string]interface{}{"name": "pebl", "version": 2}
+	target, err := nodes[1].PutImmutable(ctx, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := nodes[5].GetImmutable(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, ok := got.(map[string]interface{})
+	if !ok || dict["name"] != "pebl" || dict["version"] != 2 {
+		t.Errorf("got %v", got)
+	}
+
+	if _, err := nodes[5].GetImmutable(ctx, RandomID()); err == nil {
+		t.Error("expected error for missing item")
+	}
+}
+
+func TestPutGetMutable(t *testing.T) {
+	nodes := newTestNodes(t, 6)
+	ctx := context.Background()
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	salt := []byte("release")
+
+	first, err := SignMutable(priv, salt, 1, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[1].PutMutable(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	second, _ := SignMutable(priv, salt, 2, "v1.1.0")
+	if err := nodes[2].PutMutableCAS(ctx, second, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := nodes[5].GetMutable(ctx, pub, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Seq != 2 || got.Value != "v1.1.0" {
+		t.Errorf("got seq %d value %v", got.Seq, got.Value)
+	}
+
+	// The same key without salt is a different item.
+	if _, err := nodes[5].GetMutable(ctx, pub, nil); err == nil {
+		t.Error("expected error for unsalted item")
+	}
+
+	// Older sequence numbers and stale CAS values are refused.
+	if err := nodes[3].PutMutable(ctx, first); err == nil {
+		t.Error("put with lower seq accepted")
+	}
+	third, _ := SignMutable(priv, salt, 3, "v1.2.0")
+	err = nodes[3].PutMutableCAS(ctx, third, 1)
+	var kerr *krpcError
+	if !errors.As(err, &kerr) || kerr.Code != errCASMismatch {
+		t.Errorf("got %v, want CAS mismatch", err)
+	}
+}
+
+func TestPutRejectsInvalidItems(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+	ctx := context.Background()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+
+	item, _ := SignMutable(priv, nil, 1, "signed")
+	putArgs := func(v interface{}, sig string) map[string]interface{} {
+		return map[string]interface{}{
+			"k":   string(item.Key),
+			"seq": 1,
+			"sig": sig,
+			"v":   v,
+		}
+	}
+
+	res, err := nodes[1].lookup(ctx, item.Target(), "get", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := res.closestWithToken()[0].token
+
+	tests := []struct {
+		name string
+		args map[string]interface{}
+		code int
+	}{
+		{"bad signature", putArgs("tampered", string(item.Sig)), errInvalidSig},
+		{"too big", map[string]interface{}{"v": strings.Repeat("x", maxValueSize)}, errValueTooBig},
+		{"bad token", putArgs("signed", string(item.Sig)), errProtocol},
+	}
+	for _, tt := range tests {
+		tt.args["token"] = token
+		if tt.name == "bad token" {
+			tt.args["token"] = "nope"
+		}
+		_, err := nodes[1].query(ctx, nodes[0].Addr(), "put", tt.args)
+		var kerr *krpcError
+		if !errors.As(err, &kerr) || kerr.Code != tt.code {
+			t.Errorf("%s: got %v, want code %d", tt.name, err, tt.code)
+		}
+	}
+	if nodes[0].items.get(item.Target()) != nil {
+		t.Error("invalid item was stored")
+	}
+}
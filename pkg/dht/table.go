@@ -0,0 +1,325 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"math/bits"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the bucket size and the number of nodes returned by lookups.
+	K = 8
+
+	idBits = 160
+
+	// A node that has not been heard from within this window is
+	// questionable and gets pinged before it may be replaced.
+	questionableAfter = 15 * time.Minute
+	// A node that failed this many queries in a row is bad.
+	maxNodeFailures = 3
+	bucketRefresh   = 15 * time.Minute
+)
+
+type ID [20]byte
+
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:])
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id ID) xor(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// commonPrefixLen returns the number of leading bits a and b share.
+func commonPrefixLen(a, b ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return idBits
+}
+
+// closerTo reports whether a is closer to target than b.
+func closerTo(target, a, b ID) bool {
+	da, db := a.xor(target), b.xor(target)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+type NodeInfo struct {
+	ID   ID
+	Addr netip.AddrPort
+}
+
+type node struct {
+	NodeInfo
+	lastSeen time.Time
+	failures int
+}
+
+func (n *node) good(now time.Time) bool {
+	return n.failures == 0 && now.Sub(n.lastSeen) < questionableAfter
+}
+
+type bucket struct {
+	nodes       []*node
+	lastChanged time.Time
+}
+
+// routingTable is a Kademlia routing table with one bucket per shared
+// prefix length with our own ID, each holding up to K nodes ordered from
+// least to most recently seen.
+type routingTable struct {
+	mu      sync.Mutex
+	self    ID
+	buckets [idBits]bucket
+}
+
+func newRoutingTable(self ID) *routingTable {
+	t := &routingTable{self: self}
+	now := time.Now()
+	for i := range t.buckets {
+		t.buckets[i].lastChanged = now
+	}
+	return t
+}
+
+// setSelf changes our own ID and re-sorts the known nodes into the buckets
+// for it, dropping those that no longer fit.
+func (t *routingTable) setSelf(self ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []*node
+	for i := range t.buckets {
+		nodes = append(nodes, t.buckets[i].nodes...)
+		t.buckets[i].nodes = nil
+	}
+	t.self = self
+	for _, n := range nodes {
+		if b := t.bucketFor(n.ID); b != nil && len(b.nodes) < K {
+			b.nodes = append(b.nodes, n)
+		}
+	}
+}
+
+func (t *routingTable) bucketFor(id ID) *bucket {
+	i := commonPrefixLen(t.self, id)
+	if i >= idBits {
+		return nil
+	}
+	return &t.buckets[i]
+}
+
+// insert adds or refreshes a node that we heard from. When its bucket is
+// full the node replaces a bad node if there is one; otherwise the least
+// recently seen questionable node is returned so the caller can ping it
+// and evict it with replace if it does not answer.
+func (t *routingTable) insert(info NodeInfo) (questionable *NodeInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(info.ID)
+	if b == nil {
+		return nil
+	}
+	now := time.Now()
+
+	for i, n := range b.nodes {
+		if n.ID == info.ID {
+			n.Addr = info.Addr
+			n.lastSeen = now
+			n.failures = 0
+			b.nodes = append(append(b.nodes[:i], b.nodes[i+1:]...), n)
+			b.lastChanged = now
+			return nil
+		}
+	}
+
+	fresh := &node{NodeInfo: info, lastSeen: now}
+	if len(b.nodes) < K {
+		b.nodes = append(b.nodes, fresh)
+		b.lastChanged = now
+		return nil
+	}
+
+	for i, n := range b.nodes {
+		if n.failures >= maxNodeFailures {
+			b.nodes = append(append(b.nodes[:i], b.nodes[i+1:]...), fresh)
+			b.lastChanged = now
+			return nil
+		}
+	}
+
+	if oldest := b.nodes[0]; !oldest.good(now) {
+		info := oldest.NodeInfo
+		return &info
+	}
+	return nil
+}
+
+// restore adds a node remembered from an earlier run. It has not been
+// heard from yet, so it is questionable until it answers.
+func (t *routingTable) restore(info NodeInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(info.ID)
+	if b == nil || len(b.nodes) >= K {
+		return
+	}
+	for _, n := range b.nodes {
+		if n.ID == info.ID {
+			return
+		}
+	}
+	b.nodes = append(b.nodes, &node{NodeInfo: info})
+}
+
+// responsiveNodes returns the nodes that answered their last query.
+func (t *routingTable) responsiveNodes() []NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []NodeInfo
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if n.failures == 0 && !n.lastSeen.IsZero() {
+				nodes = append(nodes, n.NodeInfo)
+			}
+		}
+	}
+	return nodes
+}
+
+// replace evicts old in favor of fresh if old is still in the table.
+func (t *routingTable) replace(old ID, fresh NodeInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(old)
+	if b == nil {
+		return
+	}
+	for i, n := range b.nodes {
+		if n.ID == old {
+			b.nodes = append(b.nodes[:i], b.nodes[i+1:]...)
+			b.nodes = append(b.nodes, &node{NodeInfo: fresh, lastSeen: time.Now()})
+			b.lastChanged = time.Now()
+			return
+		}
+	}
+}
+
+func (t *routingTable) markFailed(id ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(id)
+	if b == nil {
+		return
+	}
+	for _, n := range b.nodes {
+		if n.ID == id {
+			n.failures++
+			return
+		}
+	}
+}
+
+// closest returns up to n nodes ordered by distance to target, skipping
+// nodes known to be bad.
+func (t *routingTable) closest(target ID, n int) []NodeInfo {
+	t.mu.Lock()
+	var all []NodeInfo
+	for i := range t.buckets {
+		for _, nd := range t.buckets[i].nodes {
+			if nd.failures < maxNodeFailures {
+				all = append(all, nd.NodeInfo)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return closerTo(target, all[i].ID, all[j].ID)
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (t *routingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for i := range t.buckets {
+		n += len(t.buckets[i].nodes)
+	}
+	return n
+}
+
+// questionableNodes returns nodes that have not been heard from recently.
+func (t *routingTable) questionableNodes(now time.Time) []NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []NodeInfo
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if !n.good(now) {
+				nodes = append(nodes, n.NodeInfo)
+			}
+		}
+	}
+	return nodes
+}
+
+// staleBuckets returns a random target ID inside every non-empty bucket
+// that has not changed within the refresh interval.
+func (t *routingTable) staleBuckets(now time.Time) []ID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var targets []ID
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if len(b.nodes) > 0 && now.Sub(b.lastChanged) > bucketRefresh {
+			targets = append(targets, randomIDInBucket(t.self, i))
+			b.lastChanged = now
+		}
+	}
+	return targets
+}
+
+// randomIDInBucket returns a random ID sharing exactly prefix leading bits
+// with self.
+func randomIDInBucket(self ID, prefix int) ID {
+	id := RandomID()
+	for bit := 0; bit <= prefix && bit < idBits; bit++ {
+		mask := byte(0x80 >> (bit % 8))
+		want := self[bit/8] & mask
+		if bit == prefix {
+			want ^= mask
+		}
+		id[bit/8] = id[bit/8]&^mask | want
+	}
+	return id
+}
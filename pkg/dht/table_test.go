@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCommonPrefixLen(t *testing.T) {
+	var a, b ID
+	if got := commonPrefixLen(a, b); got != idBits {
+		t.Errorf("equal ids: got %d", got)
+	}
+	b[0] = 0x80
+	if got := commonPrefixLen(a, b); got != 0 {
+		t.Errorf("got %d, want 0", got)
+	}
+	b[0], b[2] = 0, 0x10
+	if got := commonPrefixLen(a, b); got != 19 {
+		t.Errorf("got %d, want 19", got)
+	}
+}
+
+func TestRandomIDInBucket(t *testing.T) {
+	self := RandomID()
+	for _, prefix := range []int{0, 1, 7, 8, 42, 159} {
+		id := randomIDInBucket(self, prefix)
+		if got := commonPrefixLen(self, id); got != prefix {
+			t.Errorf("prefix %d: got id sharing %d bits", prefix, got)
+		}
+	}
+}
+
+func TestRoutingTableInsert(t *testing.T) {
+	self := ID{}
+	table := newRoutingTable(self)
+	addr := netip.MustParseAddrPort("127.0.0.1:6881")
+
+	// All these IDs start with a one bit and land in bucket 0.
+	var ids []ID
+	for i := 0; i < K+1; i++ {
+		id := RandomID()
+		id[0] |= 0x80
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids[:K] {
+		if q := table.insert(NodeInfo{ID: id, Addr: addr}); q != nil {
+			t.Fatalf("unexpected questionable node for non-full bucket")
+		}
+	}
+	if table.insert(NodeInfo{ID: ids[K], Addr: addr}) != nil {
+		t.Fatal("good nodes should not be questioned")
+	}
+	if table.len() != K {
+		t.Fatalf("got %d nodes, want %d", table.len(), K)
+	}
+
+	// Once the oldest node goes stale it is offered for eviction.
+	table.buckets[0].nodes[0].lastSeen = time.Now().Add(-time.Hour)
+	q := table.insert(NodeInfo{ID: ids[K], Addr: addr})
+	if q == nil || q.ID != ids[0] {
+		t.Fatalf("got questionable %v, want %s", q, ids[0])
+	}
+	table.replace(q.ID, NodeInfo{ID: ids[K], Addr: addr})
+
+	// Bad nodes are replaced right away.
+	for i := 0; i < maxNodeFailures; i++ {
+		table.markFailed(ids[1])
+	}
+	fresh := RandomID()
+	fresh[0] |= 0x80
+	if table.insert(NodeInfo{ID: fresh, Addr: addr}) != nil {
+		t.Fatal("bad node should have been replaced without a ping")
+	}
+
+	have := make(map[ID]bool)
+	for _, n := range table.closest(self, idBits*K) {
+		have[n.ID] = true
+	}
+	if have[ids[0]] || have[ids[1]] || !have[ids[K]] || !have[fresh] {
+		t.Errorf("unexpected table contents: %v", have)
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	table := newRoutingTable(RandomID())
+	addr := netip.MustParseAddrPort("127.0.0.1:6881")
+	for i := 0; i < 50; i++ {
+		table.insert(NodeInfo{ID: RandomID(), Addr: addr})
+	}
+
+	target := RandomID()
+	closest := table.closest(target, K)
+	if len(closest) != K {
+		t.Fatalf("got %d nodes, want %d", len(closest), K)
+	}
+	for i := 1; i < len(closest); i++ {
+		if closerTo(target, closest[i].ID, closest[i-1].ID) {
+			t.Fatalf("nodes not sorted by distance")
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	m := newTokenManager()
+	ip := netip.MustParseAddr("10.0.0.1")
+
+	token := m.token(ip)
+	if !m.valid(token, ip) {
+		t.Fatal("fresh token rejected")
+	}
+	if m.valid(token, netip.MustParseAddr("10.0.0.2")) {
+		t.Fatal("token accepted from another address")
+	}
+
+	now := time.Now()
+	m.rotate(now.Add(tokenRotation))
+	if !m.valid(token, ip) {
+		t.Fatal("token rejected after one rotation")
+	}
+	m.rotate(now.Add(2 * tokenRotation))
+	if m.valid(token, ip) {
+		t.Fatal("token accepted after two rotations")
+	}
+}
@@ -0,0 +1,216 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Tokens are rotated every five minutes and the previous secret is still
+// accepted, so a token stays valid for up to ten minutes as BEP 5
+// recommends.
+const tokenRotation = 5 * time.Minute
+
+type tokenManager struct {
+	mu      sync.Mutex
+	secret  [16]byte
+	prev    [16]byte
+	rotated time.Time
+}
+
+func newTokenManager() *tokenManager {
+	m := &tokenManager{rotated: time.Now()}
+	rand.Read(m.secret[:])
+	m.prev = m.secret
+	return m
+}
+
+func (m *tokenManager) rotate(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.rotated) < tokenRotation {
+		return
+	}
+	m.prev = m.secret
+	rand.Read(m.secret[:])
+	m.rotated = now
+}
+
+// token returns the announce token handed to the node at ip.
+func (m *tokenManager) token(ip netip.Addr) string {
+	m.mu.Lock()
+	secret := m.secret
+	m.mu.Unlock()
+	return string(tokenFor(secret, ip))
+}
+
+func (m *tokenManager) valid(token string, ip netip.Addr) bool {
+	m.mu.Lock()
+	secret, prev := m.secret, m.prev
+	m.mu.Unlock()
+	return hmac.Equal([]byte(token), tokenFor(secret, ip)) ||
+		hmac.Equal([]byte(token), tokenFor(prev, ip))
+}
+
+func tokenFor(secret [16]byte, ip netip.Addr) []byte {
+	mac := hmac.New(sha1.New, secret[:])
+	mac.Write(ip.Unmap().AsSlice())
+	return mac.Sum(nil)[:8]
+}
+
+const (
+	peerTTL         = 30 * time.Minute
+	maxPeersPerHash = 50
+	// maxStoredPeers and maxStoredHashes bound what announce_peer can make
+	// us store; the oldest entries make room for new ones.
+	maxStoredPeers  = 1000
+	maxStoredHashes = 10000
+)
+
+type storedPeer struct {
+	seen time.Time
+	seed bool
+}
+
+// swarm is the peers stored for one infohash.
+type swarm struct {
+	peers map[netip.AddrPort]storedPeer
+	// updated is when a peer was last announced.
+	updated time.Time
+}
+
+// peerStore holds peers announced to us with announce_peer.
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[ID]*swarm
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[ID]*swarm)}
+}
+
+func (s *peerStore) add(infoHash ID, addr netip.AddrPort, seed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sw := s.peers[infoHash]
+	if sw == nil {
+		if len(s.peers) >= maxStoredHashes {
+			s.evictSwarmLocked()
+		}
+		sw = &swarm{peers: make(map[netip.AddrPort]storedPeer)}
+		s.peers[infoHash] = sw
+	}
+	if _, ok := sw.peers[addr]; !ok && len(sw.peers) >= maxStoredPeers {
+		sw.evictPeer()
+	}
+	sw.peers[addr] = storedPeer{seen: now, seed: seed}
+	sw.updated = now
+}
+
+// evictSwarmLocked drops the swarm announced to least recently. s.mu must
+// be held.
+func (s *peerStore) evictSwarmLocked() {
+	var (
+		oldest ID
+		found  bool
+		at     time.Time
+	)
+	for infoHash, sw := range s.peers {
+		if !found || sw.updated.Before(at) {
+			oldest, found, at = infoHash, true, sw.updated
+		}
+	}
+	delete(s.peers, oldest)
+}
+
+// evictPeer drops the peer announced least recently.
+func (sw *swarm) evictPeer() {
+	var (
+		oldest netip.AddrPort
+		found  bool
+		at     time.Time
+	)
+	for addr, p := range sw.peers {
+		if !found || p.seen.Before(at) {
+			oldest, found, at = addr, true, p.seen
+		}
+	}
+	delete(sw.peers, oldest)
+}
+
+// get returns up to maxPeersPerHash peers of infoHash, leaving out seeds
+// when noSeed is set.
+func (s *peerStore) get(infoHash ID, noSeed bool) []netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var peers []netip.AddrPort
+	sw := s.peers[infoHash]
+	if sw == nil {
+		return nil
+	}
+	for addr, p := range sw.peers {
+		if len(peers) == maxPeersPerHash {
+			break
+		}
+		if noSeed && p.seed {
+			continue
+		}
+		peers = append(peers, addr)
+	}
+	return peers
+}
+
+// blooms returns the BEP 33 bloom filters of the seeds and the other peers
+// of infoHash.
+func (s *peerStore) blooms(infoHash ID) (seeds, peers bloomFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw := s.peers[infoHash]
+	if sw == nil {
+		return seeds, peers
+	}
+	for addr, p := range sw.peers {
+		if p.seed {
+			seeds.add(addr.Addr())
+		} else {
+			peers.add(addr.Addr())
+		}
+	}
+	return seeds, peers
+}
+
+// infoHashes returns every infohash we hold peers for.
+func (s *peerStore) infoHashes() []ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashes := make([]ID, 0, len(s.peers))
+	for infoHash := range s.peers {
+		hashes = append(hashes, infoHash)
+	}
+	return hashes
+}
+
+func (s *peerStore) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for infoHash, sw := range s.peers {
+		for addr, p := range sw.peers {
+			if now.Sub(p.seen) > peerTTL {
+				delete(sw.peers, addr)
+			}
+		}
+		if len(sw.peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Package lsd implements Local Service Discovery (BEP 14), which finds
+// peers on the local network by multicasting the infohashes we download.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultGroup is the IPv4 multicast group of BEP 14. The IPv6 group
+	// is "[ff15::efc0:988f]:6771".
+	DefaultGroup = "239.192.152.143:6771"
+
+	// announceInterval is how often each torrent is announced, and
+	// minAnnounceInterval the shortest gap between two announces of the
+	// same torrent, however often it is added.
+	announceInterval    = 5 * time.Minute
+	minAnnounceInterval = time.Minute
+
+	// maxHashesPerMessage keeps announces within a single unfragmented
+	// packet; announces carrying more are truncated.
+	maxHashesPerMessage = 20
+	maxMessageSize      = 1400
+
+	// A source sending more than maxMessagesPerSource announces within
+	// rateWindow is ignored until the window ends.
+	maxMessagesPerSource = 10
+	rateWindow           = time.Minute
+)
+
+type Config struct {
+	// Port is the port we accept peer connections on, sent in announces.
+	Port uint16
+	// Group is the multicast "host:port" to announce on; empty uses
+	// DefaultGroup.
+	Group string
+	// Interface is the network interface to send and receive announces
+	// on; nil lets the system choose.
+	Interface *net.Interface
+}
+
+// LSD announces torrents on the local network and reports the peers that
+// announce the same torrents.
+type LSD struct {
+	conn   *net.UDPConn
+	group  *net.UDPAddr
+	port   uint16
+	cookie string
+
+	mu        sync.Mutex
+	torrents  map[[20]byte]func(netip.AddrPort)
+	announced map[[20]byte]time.Time
+	sources   map[netip.Addr]*sourceRate
+
+	announceC chan struct{}
+	closeOnce sync.Once
+	closeC    chan struct{}
+	wg        sync.WaitGroup
+}
+
+type sourceRate struct {
+	start    time.Time
+	messages int
+}
+
+// New joins the multicast group and starts listening for announces.
+func New(cfg Config) (*LSD, error) {
+	groupAddr := cfg.Group
+	if groupAddr == "" {
+		groupAddr = DefaultGroup
+	}
+	group, err := net.ResolveUDPAddr("udp", groupAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LSD group: %v", err)
+	}
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("LSD group %s is not a multicast address", group)
+	}
+	conn, err := net.ListenMulticastUDP("udp", cfg.Interface, group)
+	if err != nil {
+		return nil, err
+	}
+
+	var cookie [8]byte
+	rand.Read(cookie[:])
+
+	l := &LSD{
+		conn:      conn,
+		group:     group,
+		port:      cfg.Port,
+		cookie:    hex.EncodeToString(cookie[:]),
+		torrents:  make(map[[20]byte]func(netip.AddrPort)),
+		announced: make(map[[20]byte]time.Time),
+		sources:   make(map[netip.Addr]*sourceRate),
+		announceC: make(chan struct{}, 1),
+		closeC:    make(chan struct{}),
+	}
+	l.wg.Add(2)
+	go l.readLoop()
+	go l.announceLoop()
+	return l, nil
+}
+
+// Close stops announcing and leaves the multicast group.
+func (l *LSD) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closeC)
+		err = l.conn.Close()
+		l.wg.Wait()
+	})
+	return err
+}
+
+// Add starts announcing infoHash and calls found with the address of every
+// peer on the local network that announces it too.
+func (l *LSD) Add(infoHash [20]byte, found func(netip.AddrPort)) {
+	l.mu.Lock()
+	l.torrents[infoHash] = found
+	if last, ok := l.announced[infoHash]; ok {
+		// A torrent added again is announced minAnnounceInterval after its
+		// last announce rather than a full interval later.
+		l.announced[infoHash] = last.Add(minAnnounceInterval - announceInterval)
+	}
+	l.mu.Unlock()
+
+	select {
+	case l.announceC <- struct{}{}:
+	default:
+	}
+}
+
+// Remove stops announcing infoHash.
+func (l *LSD) Remove(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, infoHash)
+}
+
+// due returns the torrents whose announce is due and how long until the
+// next one is.
+func (l *LSD) due(now time.Time) ([][20]byte, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var hashes [][20]byte
+	next := announceInterval
+	for infoHash := range l.torrents {
+		last, ok := l.announced[infoHash]
+		if !ok || now.Sub(last) >= announceInterval {
+			hashes = append(hashes, infoHash)
+			l.announced[infoHash] = now
+			continue
+		}
+		next = min(next, announceInterval-now.Sub(last))
+	}
+	for infoHash, last := range l.announced {
+		if _, ok := l.torrents[infoHash]; !ok && now.Sub(last) >= announceInterval {
+			delete(l.announced, infoHash)
+		}
+	}
+	return hashes, next
+}
+
+func (l *LSD) announceLoop() {
+	defer l.wg.Done()
+
+	for {
+		hashes, next := l.due(time.Now())
+		for len(hashes) > 0 {
+			n := min(len(hashes), maxHashesPerMessage)
+			if _, err := l.conn.WriteToUDP(l.message(hashes[:n]), l.group); err != nil {
+				fmt.Printf("LSD announce failed: %v\n", err)
+			}
+			hashes = hashes[n:]
+		}
+
+		timer := time.NewTimer(next)
+		select {
+		case <-timer.C:
+		case <-l.announceC:
+			timer.Stop()
+		case <-l.closeC:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// message returns a BT-SEARCH announce of hashes.
+func (l *LSD) message(hashes [][20]byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", l.group)
+	fmt.Fprintf(&b, "Port: %d\r\n", l.port)
+	for _, h := range hashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", h[:])
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n", l.cookie)
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+type announce struct {
+	port   uint16
+	hashes [][20]byte
+	cookie string
+}
+
+// parseAnnounce decodes a BT-SEARCH message.
+func parseAnnounce(data []byte) (*announce, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != "BT-SEARCH" {
+		return nil, fmt.Errorf("unexpected method %q", req.Method)
+	}
+	port, err := strconv.ParseUint(req.Header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid port %q", req.Header.Get("Port"))
+	}
+
+	a := &announce{port: uint16(port), cookie: req.Header.Get("Cookie")}
+	for _, value := range req.Header.Values("Infohash") {
+		if len(a.hashes) == maxHashesPerMessage {
+			break
+		}
+		var h [20]byte
+		if n, err := hex.Decode(h[:], []byte(strings.TrimSpace(value))); err != nil || n != len(h) {
+			continue
+		}
+		a.hashes = append(a.hashes, h)
+	}
+	if len(a.hashes) == 0 {
+		return nil, fmt.Errorf("no infohash")
+	}
+	return a, nil
+}
+
+// allow reports whether another announce from ip is accepted now.
+func (l *LSD) allow(ip netip.Addr, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for addr, r := range l.sources {
+		if now.Sub(r.start) >= rateWindow {
+			delete(l.sources, addr)
+		}
+	}
+	r := l.sources[ip]
+	if r == nil {
+		r = &sourceRate{start: now}
+		l.sources[ip] = r
+	}
+	r.messages++
+	return r.messages <= maxMessagesPerSource
+}
+
+func (l *LSD) readLoop() {
+	defer l.wg.Done()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := l.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-l.closeC:
+				return
+			default:
+			}
+			fmt.Printf("LSD read error: %v\n", err)
+			continue
+		}
+
+		a, err := parseAnnounce(buf[:n])
+		if err != nil || a.cookie == l.cookie {
+			continue
+		}
+		ip := from.Addr().Unmap()
+		if !l.allow(ip, time.Now()) {
+			continue
+		}
+
+		peer := netip.AddrPortFrom(ip, a.port)
+		for _, h := range a.hashes {
+			l.mu.Lock()
+			found := l.torrents[h]
+			l.mu.Unlock()
+			if found != nil {
+				found(peer)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package lsd
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig returns a config announcing on the loopback interface, on a
+// group port no other test uses.
+func testConfig(t *testing.T, port uint16, groupPort int) Config {
+	t.Helper()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 && ifaces[i].Flags&net.FlagUp != 0 {
+			return Config{
+				Port:      port,
+				Group:     fmt.Sprintf("239.192.152.143:%d", groupPort),
+				Interface: &ifaces[i],
+			}
+		}
+	}
+	t.Skip("no loopback interface")
+	return Config{}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func newTestLSD(t *testing.T, cfg Config) *LSD {
+	t.Helper()
+	l, err := New(cfg)
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestDiscoverLocalPeers(t *testing.T) {
+	groupPort := freePort(t)
+	a := newTestLSD(t, testConfig(t, 6881, groupPort))
+	b := newTestLSD(t, testConfig(t, 6882, groupPort))
+
+	infoHash := [20]byte{1, 2, 3}
+	foundA := make(chan netip.AddrPort, 10)
+	foundB := make(chan netip.AddrPort, 10)
+	a.Add(infoHash, func(p netip.AddrPort) { foundA <- p })
+	// b joins after a's first announce, and a hears of it through b's.
+	time.Sleep(100 * time.Millisecond)
+	b.Add(infoHash, func(p netip.AddrPort) { foundB <- p })
+
+	select {
+	case p := <-foundA:
+		if p.Port() != 6882 {
+			t.Errorf("a found %s, want port 6882", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a found no peer")
+	}
+
+	// Nobody hears its own announces.
+	select {
+	case p := <-foundB:
+		t.Errorf("b found %s before a announced again", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	l := &LSD{group: &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}, port: 51413, cookie: "abc"}
+	hashes := [][20]byte{{1}, {2}}
+
+	msg := string(l.message(hashes))
+	want := "BT-SEARCH * HTTP/1.1\r\n" +
+		"Host: 239.192.152.143:6771\r\n" +
+		"Port: 51413\r\n" +
+		"Infohash: 0100000000000000000000000000000000000000\r\n" +
+		"Infohash: 0200000000000000000000000000000000000000\r\n" +
+		"cookie: abc\r\n" +
+		"\r\n\r\n"
+	if msg != want {
+		t.Errorf("got %q", msg)
+	}
+
+	a, err := parseAnnounce([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.port != 51413 || a.cookie != "abc" || len(a.hashes) != 2 || a.hashes[1] != hashes[1] {
+		t.Errorf("got %+v", a)
+	}
+}
+
+func TestParseAnnounceInvalid(t *testing.T) {
+	for _, msg := range []string{
+		"garbage",
+		"M-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: 0100000000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: 0100000000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 01\r\n\r\n",
+	} {
+		if _, err := parseAnnounce([]byte(msg)); err == nil {
+			t.Errorf("accepted %q", msg)
+		}
+	}
+
+	// Announces with too many infohashes are truncated.
+	msg := "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n" +
+		strings.Repeat("Infohash: 0100000000000000000000000000000000000000\r\n", maxHashesPerMessage+5) + "\r\n"
+	if a, err := parseAnnounce([]byte(msg)); err != nil || len(a.hashes) != maxHashesPerMessage {
+		t.Errorf("got %v, %v", a, err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	l := &LSD{sources: make(map[netip.Addr]*sourceRate)}
+	ip := netip.MustParseAddr("192.168.1.2")
+	now := time.Now()
+
+	for i := 0; i < maxMessagesPerSource; i++ {
+		if !l.allow(ip, now) {
+			t.Fatalf("announce %d rejected", i)
+		}
+	}
+	if l.allow(ip, now) {
+		t.Error("announce over the limit accepted")
+	}
+	if !l.allow(netip.MustParseAddr("192.168.1.3"), now) {
+		t.Error("other source rejected")
+	}
+	if !l.allow(ip, now.Add(rateWindow)) {
+		t.Error("announce rejected after the window")
+	}
+}
+
+func TestAnnounceSchedule(t *testing.T) {
+	l := &LSD{torrents: make(map[[20]byte]func(netip.AddrPort)), announced: make(map[[20]byte]time.Time), announceC: make(chan struct{}, 1)}
+	now := time.Now()
+	infoHash := [20]byte{1}
+
+	l.Add(infoHash, func(netip.AddrPort) {})
+	if hashes, _ := l.due(now); len(hashes) != 1 {
+		t.Fatalf("new torrent not announced")
+	}
+	if hashes, next := l.due(now.Add(time.Second)); len(hashes) != 0 || next != announceInterval-time.Second {
+		t.Fatalf("got %d due, next in %s", len(hashes), next)
+	}
+
+	// Adding the torrent again does not announce it more than once per
+	// minAnnounceInterval.
+	l.Remove(infoHash)
+	l.Add(infoHash, func(netip.AddrPort) {})
+	if hashes, _ := l.due(now.Add(time.Second)); len(hashes) != 0 {
+		t.Error("re-added torrent announced too soon")
+	}
+	if hashes, _ := l.due(now.Add(minAnnounceInterval)); len(hashes) != 1 {
+		t.Error("re-added torrent not announced")
+	}
+}
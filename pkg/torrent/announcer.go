@@ -0,0 +1,248 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	minAnnounceRetry        = 15 * time.Second
+	stoppedAnnounceTimeout  = 10 * time.Second
+)
+
+// Announcer keeps a torrent announced to its trackers for as long as it
+// runs. It re-announces on the interval the tracker asks for, reports the
+// transfer counters of its PeerManager, sends "completed" once the download
+// finishes and "stopped" when stopped, and hands every peer it learns about
+// to the PeerManager. When the session has a DHT the torrent is announced
+// there as well. Start the PeerManager with PeerManager.Start to apply the
+// session's peer settings and to be found over its Listener and LSD.
+type Announcer struct {
+	// AllTiers announces to every tier concurrently instead of stopping at
+	// the first tracker that answers.
+	AllTiers bool
+
+	session     *Session
+	torrent     *Torrent
+	pm          *PeerManager
+	dhtInterval time.Duration
+
+	mu         sync.Mutex
+	retryAfter map[string]time.Time
+	retryNever map[string]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	doneC  chan struct{}
+}
+
+func NewAnnouncer(session *Session, torrent *Torrent, pm *PeerManager) *Announcer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Announcer{
+		session:     session,
+		torrent:     torrent,
+		pm:          pm,
+		dhtInterval: dhtAnnounceInterval,
+
+		retryAfter: make(map[string]time.Time),
+		retryNever: make(map[string]bool),
+
+		ctx:    ctx,
+		cancel: cancel,
+		doneC:  make(chan struct{}),
+	}
+}
+
+func (a *Announcer) Start() {
+	go a.run()
+}
+
+// Stop ends the announce loop, aborting any announce in flight, and sends
+// a final "stopped" announce.
+func (a *Announcer) Stop() {
+	a.cancel()
+	<-a.doneC
+}
+
+func (a *Announcer) request(event string) AnnounceRequest {
+	req := a.session.AnnounceRequest(*a.torrent)
+	req.Event = event
+	req.Uploaded = a.pm.Uploaded()
+	req.Downloaded = a.pm.Downloaded()
+	req.Left = a.pm.Left()
+	return req
+}
+
+func (a *Announcer) announce(ctx context.Context, event string) (*AnnounceResponse, error) {
+	req := a.request(event)
+	fn := func(trackerURL string) (*AnnounceResponse, error) {
+		return a.announceTracker(ctx, trackerURL, req)
+	}
+	if a.AllTiers {
+		return a.torrent.trackerTiers().AnnounceAll(fn)
+	}
+	return a.torrent.trackerTiers().Announce(fn)
+}
+
+// announceTracker announces to a single tracker, skipping trackers that
+// asked us to back off, and prints any warning the tracker sends.
+func (a *Announcer) announceTracker(ctx context.Context, trackerURL string, req AnnounceRequest) (*AnnounceResponse, error) {
+	a.mu.Lock()
+	never := a.retryNever[trackerURL]
+	after := a.retryAfter[trackerURL]
+	a.mu.Unlock()
+
+	// A stopped announce is always sent so the tracker can drop us.
+	if req.Event != "stopped" {
+		if never {
+			return nil, fmt.Errorf("tracker asked not to be retried")
+		}
+		if time.Now().Before(after) {
+			return nil, fmt.Errorf("tracker asked to retry after %s", after.Format(time.TimeOnly))
+		}
+	}
+
+	resp, err := a.session.Announce(ctx, trackerURL, req)
+	if err != nil {
+		var terr *TrackerError
+		if errors.As(err, &terr) {
+			if terr.WarningMessage != "" {
+				fmt.Printf("Tracker %s warning: %s\n", trackerURL, terr.WarningMessage)
+			}
+			a.mu.Lock()
+			if terr.RetryNever {
+				a.retryNever[trackerURL] = true
+			} else if terr.RetryIn > 0 {
+				a.retryAfter[trackerURL] = time.Now().Add(terr.RetryIn)
+			}
+			a.mu.Unlock()
+		}
+		return nil, err
+	}
+
+	if resp.WarningMessage != "" {
+		fmt.Printf("Tracker %s warning: %s\n", trackerURL, resp.WarningMessage)
+	}
+	return resp, nil
+}
+
+// nextRetry returns the delay before the next attempt after a failed
+// announce: the shortest retry-in hint of any tracker still worth trying,
+// or the exponential backoff when no tracker gave a hint.
+func (a *Announcer) nextRetry(backoff time.Duration) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var soonest time.Duration
+	for _, tier := range a.torrent.trackerTiers().Tiers() {
+		for _, trackerURL := range tier {
+			if a.retryNever[trackerURL] {
+				continue
+			}
+			after, ok := a.retryAfter[trackerURL]
+			if !ok {
+				return backoff
+			}
+			if d := time.Until(after); soonest == 0 || d < soonest {
+				soonest = d
+			}
+		}
+	}
+	if soonest <= 0 {
+		return backoff
+	}
+	return soonest
+}
+
+func (a *Announcer) run() {
+	defer close(a.doneC)
+
+	if a.session.DHT != nil {
+		dhtDone := make(chan struct{})
+		go func() {
+			defer close(dhtDone)
+			a.runDHT()
+		}()
+		defer func() { <-dhtDone }()
+	}
+	if !a.torrent.hasTrackers() {
+		// A trackerless torrent is only announced on the DHT.
+		<-a.ctx.Done()
+		return
+	}
+
+	// "started" is resent until a tracker has seen it; a completion in the
+	// meantime is reported right after.
+	event := "started"
+	completed := false
+	completeC := a.pm.Done()
+	if a.pm.IsComplete() {
+		completeC = nil
+	}
+	retry := minAnnounceRetry
+
+	for {
+		var wait time.Duration
+		resp, err := a.announce(a.ctx, event)
+		if a.ctx.Err() != nil {
+			a.sendStopped()
+			return
+		}
+		if err != nil {
+			fmt.Printf("Announce failed: %v\n", err)
+			wait = a.nextRetry(retry)
+			retry = min(retry*2, defaultAnnounceInterval)
+		} else {
+			retry = minAnnounceRetry
+			event = ""
+			wait = announceWait(resp)
+			a.pm.ConnectPeers(resp.Peers, a.session.PeerID[:])
+			if completed {
+				event, completed, wait = "completed", false, 0
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-completeC:
+			timer.Stop()
+			completeC = nil
+			if event == "started" {
+				completed = true
+			} else {
+				event = "completed"
+			}
+		case <-a.ctx.Done():
+			timer.Stop()
+			a.sendStopped()
+			return
+		}
+	}
+}
+
+func (a *Announcer) sendStopped() {
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
+
+	if _, err := a.announce(ctx, "stopped"); err != nil {
+		fmt.Printf("Stopped announce failed: %v\n", err)
+	}
+}
+
+// announceWait returns how long to wait before the next regular announce,
+// honoring both interval and min interval.
+func announceWait(resp *AnnounceResponse) time.Duration {
+	wait := time.Duration(resp.Interval) * time.Second
+	if wait <= 0 {
+		wait = defaultAnnounceInterval
+	}
+	if minWait := time.Duration(resp.MinInterval) * time.Second; wait < minWait {
+		wait = minWait
+	}
+	return wait
+}
@@ -0,0 +1,130 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingTracker struct {
+	mu       sync.Mutex
+	requests []url.Values
+	notify   chan struct{}
+	// failures is the number of announces to fail before answering.
+	failures int
+}
+
+func newRecordingTracker(t *testing.T, body string) (*recordingTracker, *httptest.Server) {
+	rt := &recordingTracker{notify: make(chan struct{}, 16)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.mu.Lock()
+		rt.requests = append(rt.requests, r.URL.Query())
+		fail := rt.failures > 0
+		if fail {
+			rt.failures--
+		}
+		rt.mu.Unlock()
+		rt.notify <- struct{}{}
+		if fail {
+			w.Write([]byte("d14:failure reason4:downe"))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return rt, srv
+}
+
+func (rt *recordingTracker) wait(t *testing.T) url.Values {
+	select {
+	case <-rt.notify:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for announce")
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.requests[len(rt.requests)-1]
+}
+
+func TestAnnouncerReportsStatsAndEvents(t *testing.T) {
+	rt, srv := newRecordingTracker(t, "d8:intervali1800e5:peers0:e")
+
+	torrent := &Torrent{
+		TrackerURL:  srv.URL,
+		PieceLength: 4,
+		Pieces:      make([][]byte, 3),
+		Files: []File{
+			{Length: 5, Path: []string{"a"}},
+			{Length: 5, Path: []string{"b"}},
+		},
+	}
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.markHave(0)
+
+	a := NewAnnouncer(NewSession(), torrent, pm)
+	a.Start()
+
+	started := rt.wait(t)
+	if got := started.Get("event"); got != "started" {
+		t.Errorf("expected started event, got %q", got)
+	}
+	if got := started.Get("left"); got != "6" {
+		t.Errorf("expected left=6, got %s", got)
+	}
+
+	pm.markHave(1)
+	pm.markHave(2)
+	completed := rt.wait(t)
+	if got := completed.Get("event"); got != "completed" || completed.Get("left") != "0" {
+		t.Errorf("expected completed event with left=0, got %v", completed)
+	}
+
+	a.Stop()
+	stopped := rt.wait(t)
+	if got := stopped.Get("event"); got != "stopped" {
+		t.Errorf("expected stopped event, got %q", got)
+	}
+}
+
+func TestAnnouncerResendsStarted(t *testing.T) {
+	rt, srv := newRecordingTracker(t, "d8:intervali1800e5:peers0:e")
+	rt.failures = 1
+
+	torrent := &Torrent{TrackerURL: srv.URL, PieceLength: 4, Length: 8, Pieces: make([][]byte, 2)}
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAnnouncer(NewSession(), torrent, pm)
+	a.Start()
+	defer a.Stop()
+
+	if got := rt.wait(t).Get("event"); got != "started" {
+		t.Errorf("expected started event, got %q", got)
+	}
+
+	// The download completes while the tracker has not seen us start.
+	pm.markHave(0)
+	pm.markHave(1)
+	if got := rt.wait(t); got.Get("event") != "started" || got.Get("left") != "0" {
+		t.Errorf("expected started to be resent, got %v", got)
+	}
+	if got := rt.wait(t).Get("event"); got != "completed" {
+		t.Errorf("expected completed event, got %q", got)
+	}
+}
+
+func TestAnnounceWaitHonorsMinInterval(t *testing.T) {
+	if got := announceWait(&AnnounceResponse{Interval: 60, MinInterval: 120}); got != 2*time.Minute {
+		t.Errorf("expected 2m, got %v", got)
+	}
+	if got := announceWait(&AnnounceResponse{}); got != defaultAnnounceInterval {
+		t.Errorf("expected default interval, got %v", got)
+	}
+}
@@ -0,0 +1,195 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultUploadSlots is the number of peers unchoked for their rates,
+	// besides the optimistic unchoke.
+	defaultUploadSlots = 4
+	chokeInterval      = 10 * time.Second
+	// optimisticRounds is the number of choke rounds an optimistic unchoke
+	// lasts.
+	optimisticRounds = 3
+	// Peers connected within newPeerPeriod are three times as likely to be
+	// picked for the optimistic unchoke, so they get pieces to trade.
+	newPeerPeriod = time.Minute
+)
+
+// PeerStats describes an interested peer to a ChokeAlgorithm.
+type PeerStats struct {
+	Peer *PeerConn
+	// DownloadRate is how fast the peer sent us piece data and
+	// UploadRate how fast we sent it piece data, in bytes per second over
+	// the last choke round.
+	DownloadRate float64
+	UploadRate   float64
+	// LastUnchoked is when we last unchoked the peer; zero if never.
+	LastUnchoked time.Time
+}
+
+// ChokeAlgorithm decides which interested peers get the regular upload
+// slots.
+type ChokeAlgorithm interface {
+	// Rank sorts peers so the most deserving come first. seeding is set
+	// once we have the whole torrent.
+	Rank(peers []PeerStats, seeding bool)
+}
+
+// FastestUpload is tit-for-tat: it unchokes the peers that upload to us
+// fastest and, when seeding, those we upload to fastest.
+type FastestUpload struct{}
+
+func (FastestUpload) Rank(peers []PeerStats, seeding bool) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		if seeding {
+			return peers[i].UploadRate > peers[j].UploadRate
+		}
+		return peers[i].DownloadRate > peers[j].DownloadRate
+	})
+}
+
+// RoundRobin is tit-for-tat while downloading. When seeding it rotates
+// the slots through the interested peers, unchoking those that waited
+// longest.
+type RoundRobin struct{}
+
+func (RoundRobin) Rank(peers []PeerStats, seeding bool) {
+	if !seeding {
+		FastestUpload{}.Rank(peers, seeding)
+		return
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].LastUnchoked.Before(peers[j].LastUnchoked)
+	})
+}
+
+// SetUploadSlots sets the number of peers unchoked for their rates, in
+// addition to the optimistic unchoke. Zero restores the default.
+func (pm *PeerManager) SetUploadSlots(n int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if n <= 0 {
+		n = defaultUploadSlots
+	}
+	pm.uploadSlots = n
+}
+
+// SetChokeAlgorithm sets how peers are picked for upload slots; nil
+// restores FastestUpload.
+func (pm *PeerManager) SetChokeAlgorithm(algorithm ChokeAlgorithm) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if algorithm == nil {
+		algorithm = FastestUpload{}
+	}
+	pm.chokeAlgorithm = algorithm
+}
+
+// runChoker rechokes every chokeInterval until ctx is done.
+func (pm *PeerManager) runChoker(ctx context.Context) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			pm.rechoke(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rechoke unchokes the interested peers ranked best by the choke
+// algorithm plus one optimistic unchoke, rotated every optimisticRounds
+// rounds, and chokes all others.
+func (pm *PeerManager) rechoke(now time.Time) {
+	pm.mu.Lock()
+	peers := append([]*PeerConn(nil), pm.peers...)
+	elapsed := now.Sub(pm.lastRechoke).Seconds()
+	if pm.lastRechoke.IsZero() {
+		elapsed = chokeInterval.Seconds()
+	}
+	pm.lastRechoke = now
+	pm.chokeRounds++
+	rotate := pm.chokeRounds%optimisticRounds == 1
+	optimistic := pm.optimistic
+	slots := pm.uploadSlots
+	algorithm := pm.chokeAlgorithm
+	seeding := pm.haveCount == len(pm.have)
+	pm.mu.Unlock()
+
+	var interested []PeerStats
+	for _, peer := range peers {
+		down, up := peer.downloaded.Load(), peer.uploaded.Load()
+		peer.mu.Lock()
+		stats := PeerStats{
+			Peer:         peer,
+			DownloadRate: float64(down-peer.lastDownloaded) / elapsed,
+			UploadRate:   float64(up-peer.lastUploaded) / elapsed,
+			LastUnchoked: peer.lastUnchoked,
+		}
+		peer.lastDownloaded, peer.lastUploaded = down, up
+		if peer.interested {
+			interested = append(interested, stats)
+		}
+		peer.mu.Unlock()
+	}
+
+	algorithm.Rank(interested, seeding)
+	unchoke := make(map[*PeerConn]bool)
+	for i := 0; i < len(interested) && i < slots; i++ {
+		unchoke[interested[i].Peer] = true
+	}
+
+	// The optimistic unchoke moves on when its time is up or when it is no
+	// longer an interested peer outside the regular slots.
+	keep := false
+	for _, s := range interested[min(slots, len(interested)):] {
+		if s.Peer == optimistic {
+			keep = true
+		}
+	}
+	if rotate || !keep {
+		optimistic = pickOptimistic(interested[min(slots, len(interested)):], now)
+	}
+	if optimistic != nil {
+		unchoke[optimistic] = true
+	}
+	pm.mu.Lock()
+	pm.optimistic = optimistic
+	pm.mu.Unlock()
+
+	for _, peer := range peers {
+		if err := pm.setChoking(peer, !unchoke[peer]); err != nil {
+			fmt.Printf("Failed to update choke state of %s: %v\n", peer.Conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// pickOptimistic picks a random peer for the optimistic unchoke, favoring
+// newly connected ones.
+func pickOptimistic(candidates []PeerStats, now time.Time) *PeerConn {
+	var weighted []*PeerConn
+	for _, s := range candidates {
+		s.Peer.mu.Lock()
+		weight := 1
+		if now.Sub(s.Peer.connectedAt) < newPeerPeriod {
+			weight = 3
+		}
+		s.Peer.mu.Unlock()
+		for i := 0; i < weight; i++ {
+			weighted = append(weighted, s.Peer)
+		}
+	}
+	if len(weighted) == 0 {
+		return nil
+	}
+	return weighted[rand.Intn(len(weighted))]
+}
@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestChokeAlgorithms(t *testing.T) {
+	a, b, c := &PeerConn{}, &PeerConn{}, &PeerConn{}
+	now := time.Now()
+	stats := func() []PeerStats {
+		return []PeerStats{
+			{Peer: a, DownloadRate: 10, UploadRate: 300, LastUnchoked: now},
+			{Peer: b, DownloadRate: 30, UploadRate: 100},
+			{Peer: c, DownloadRate: 20, UploadRate: 200, LastUnchoked: now.Add(-time.Minute)},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		algorithm ChokeAlgorithm
+		seeding   bool
+		want      []*PeerConn
+	}{
+		{"fastest downloading", FastestUpload{}, false, []*PeerConn{b, c, a}},
+		{"fastest seeding", FastestUpload{}, true, []*PeerConn{a, c, b}},
+		{"round robin downloading", RoundRobin{}, false, []*PeerConn{b, c, a}},
+		{"round robin seeding", RoundRobin{}, true, []*PeerConn{b, c, a}},
+	}
+	for _, tt := range tests {
+		peers := stats()
+		tt.algorithm.Rank(peers, tt.seeding)
+		for i := range peers {
+			if peers[i].Peer != tt.want[i] {
+				t.Errorf("%s: peer %d is wrong", tt.name, i)
+			}
+		}
+	}
+}
+
+// newChokePeers connects n interested peers to pm whose messages are
+// discarded.
+func newChokePeers(t *testing.T, pm *PeerManager, n int) []*PeerConn {
+	t.Helper()
+	var peers []*PeerConn
+	for i := 0; i < n; i++ {
+		addr := netip.MustParseAddrPort(fmt.Sprintf("10.0.0.%d:6881", i+1))
+		peer, remote := newPipePeer(t, pm, addr)
+		go io.Copy(io.Discard, remote)
+		peer.mu.Lock()
+		peer.interested = true
+		peer.mu.Unlock()
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func isChoking(peer *PeerConn) bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return peer.amChoking
+}
+
+func TestRechoke(t *testing.T) {
+	pm := newTestPeerManager(t)
+	pm.SetUploadSlots(2)
+	peers := newChokePeers(t, pm, 6)
+	for i, peer := range peers {
+		peer.uploaded.Store(int64(i) * 1000)
+	}
+	peers[0].mu.Lock()
+	peers[0].interested = false
+	peers[0].mu.Unlock()
+	peers[0].uploaded.Store(1 << 20)
+
+	// Seeding, the peers we upload to fastest get the regular slots and
+	// one of the other interested peers the optimistic unchoke.
+	now := time.Now()
+	pm.rechoke(now)
+	if isChoking(peers[5]) || isChoking(peers[4]) {
+		t.Error("fastest peers are choked")
+	}
+	if !isChoking(peers[0]) {
+		t.Error("uninterested peer is unchoked")
+	}
+	optimistic := pm.optimistic
+	if optimistic == nil || optimistic == peers[4] || optimistic == peers[5] || optimistic == peers[0] {
+		t.Fatalf("optimistic unchoke is %v", optimistic)
+	}
+	for _, peer := range peers[1:4] {
+		if isChoking(peer) != (peer != optimistic) {
+			t.Errorf("peer %s: choking = %v", peer.addr, isChoking(peer))
+		}
+	}
+
+	// The optimistic unchoke stays for optimisticRounds rounds.
+	for i := 1; i < optimisticRounds; i++ {
+		now = now.Add(chokeInterval)
+		for j, peer := range peers {
+			peer.uploaded.Add(int64(j) * 1000)
+		}
+		pm.rechoke(now)
+		if pm.optimistic != optimistic || isChoking(optimistic) {
+			t.Fatalf("optimistic unchoke rotated after %d rounds", i)
+		}
+	}
+}
+
+func TestUnchokeWhileSlotsFree(t *testing.T) {
+	pm := newTestPeerManager(t)
+	pm.SetUploadSlots(1)
+	peers := newChokePeers(t, pm, 3)
+
+	// One regular slot plus the optimistic unchoke are filled at once.
+	for _, peer := range peers {
+		pm.handleInterested(peer, true)
+	}
+	if isChoking(peers[0]) || isChoking(peers[1]) {
+		t.Error("peers choked although slots were free")
+	}
+	if !isChoking(peers[2]) {
+		t.Error("peer unchoked beyond the upload slots")
+	}
+}
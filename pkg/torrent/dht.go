@@ -0,0 +1,139 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/dht"
+)
+
+const (
+	dhtAnnounceInterval = 15 * time.Minute
+	dhtRetryInterval    = time.Minute
+	dhtLookupTimeout    = time.Minute
+)
+
+func dhtPeers(addrs []netip.AddrPort) []Peer {
+	peers := make([]Peer, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, Peer{Addr: addr, Source: PeerSourceDHT})
+	}
+	return peers
+}
+
+// getDHTPeers looks up the peers of infoHash on the session's DHT.
+func (s *Session) getDHTPeers(ctx context.Context, infoHash [20]byte) ([]Peer, error) {
+	addrs, err := s.DHT.GetPeers(ctx, dht.ID(infoHash))
+	if err != nil {
+		return nil, fmt.Errorf("DHT lookup failed: %w", err)
+	}
+	return dhtPeers(addrs), nil
+}
+
+// announceDHT announces our listen port for infoHash on the session's DHT,
+// as a seed if seed is set, and returns the peers found by the lookup.
+// Peers may be returned along with an error when no node accepted the
+// announce.
+func (s *Session) announceDHT(ctx context.Context, infoHash [20]byte, seed bool) ([]Peer, error) {
+	addrs, err := s.DHT.Announce(ctx, dht.ID(infoHash), s.Port, seed)
+	if err != nil {
+		err = fmt.Errorf("DHT announce failed: %w", err)
+	}
+	return dhtPeers(addrs), err
+}
+
+// addTorrentNodes pings the DHT nodes a torrent names so they join the
+// session's routing table. Nodes that do not resolve or reply are skipped.
+func (s *Session) addTorrentNodes(ctx context.Context, torrent Torrent) {
+	var wg sync.WaitGroup
+	for _, node := range torrent.Nodes {
+		udpAddr, err := net.ResolveUDPAddr("udp", node)
+		if err != nil {
+			continue
+		}
+		addr := udpAddr.AddrPort()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.DHT.Ping(ctx, netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()))
+		}()
+	}
+	wg.Wait()
+}
+
+// withDHTPeers runs a tracker announce alongside a DHT lookup when the
+// session has a DHT and merges the peers of both. It fails only when both
+// fail. A trackerless torrent is only looked up on the DHT.
+func (s *Session) withDHTPeers(ctx context.Context, torrent Torrent, announce func() (*AnnounceResponse, error)) ([]Peer, error) {
+	if s.DHT == nil {
+		if !torrent.hasTrackers() {
+			return nil, fmt.Errorf("torrent has no trackers and the session has no DHT")
+		}
+		resp, err := announce()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Peers, nil
+	}
+
+	s.addTorrentNodes(ctx, torrent)
+	if !torrent.hasTrackers() {
+		return s.getDHTPeers(ctx, torrent.InfoHash)
+	}
+
+	var (
+		fromDHT []Peer
+		dhtErr  error
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fromDHT, dhtErr = s.getDHTPeers(ctx, torrent.InfoHash)
+	}()
+
+	resp, err := announce()
+	<-done
+
+	if err != nil && dhtErr != nil {
+		return nil, errors.Join(err, dhtErr)
+	}
+	var fromTracker []Peer
+	if err == nil {
+		fromTracker = resp.Peers
+	}
+	return MergePeers(fromTracker, fromDHT), nil
+}
+
+// runDHT keeps the torrent announced on the DHT, handing the peers found
+// by every lookup to the PeerManager.
+func (a *Announcer) runDHT() {
+	a.session.addTorrentNodes(a.ctx, *a.torrent)
+	for {
+		ctx, cancel := context.WithTimeout(a.ctx, dhtLookupTimeout)
+		peers, err := a.session.announceDHT(ctx, a.torrent.InfoHash, a.pm.IsComplete())
+		cancel()
+		if a.ctx.Err() != nil {
+			return
+		}
+
+		wait := a.dhtInterval
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			wait = dhtRetryInterval
+		}
+		a.pm.ConnectPeers(peers, a.session.PeerID[:])
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-a.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
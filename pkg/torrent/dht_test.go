@@ -0,0 +1,190 @@
+package torrent
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/dht"
+)
+
+// newTestDHT starts n DHT nodes on loopback, all bootstrapped from the
+// first one.
+func newTestDHT(t *testing.T, n int) []*dht.DHT {
+	t.Helper()
+
+	var nodes []*dht.DHT
+	for i := 0; i < n; i++ {
+		cfg := dht.Config{Addr: "127.0.0.1:0", QueryTimeout: time.Second}
+		if i > 0 {
+			cfg.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+		node, err := dht.New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+		if i > 0 {
+			if err := node.Bootstrap(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func TestMergePeers(t *testing.T) {
+	a := netip.MustParseAddrPort("10.0.0.1:6881")
+	b := netip.MustParseAddrPort("10.0.0.2:6881")
+
+	merged := MergePeers(
+		[]Peer{{Addr: a, Source: PeerSourceTracker}},
+		[]Peer{{Addr: b, Source: PeerSourceDHT}, {Addr: a, Source: PeerSourceDHT, ID: []byte("id")}},
+	)
+	if len(merged) != 2 {
+		t.Fatalf("got %v", merged)
+	}
+	if merged[0].Source != PeerSourceTracker|PeerSourceDHT || string(merged[0].ID) != "id" {
+		t.Errorf("got %+v", merged[0])
+	}
+	if got := merged[0].Source.String(); got != "tracker,dht" {
+		t.Errorf("got source %q", got)
+	}
+	if merged[1].Addr != b || merged[1].Source != PeerSourceDHT {
+		t.Errorf("got %+v", merged[1])
+	}
+}
+
+func TestDiscoverPeersMergesDHT(t *testing.T) {
+	nodes := newTestDHT(t, 4)
+	infoHash := [20]byte{1, 2, 3}
+	if _, err := nodes[1].Announce(context.Background(), dht.ID(infoHash), 6881, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[2].Announce(context.Background(), dht.ID(infoHash), 7000, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tracker knows 127.0.0.1:6881 too, and 10.0.0.1:6881.
+	srv := newTestTracker(t, "d8:intervali1800e5:peers12:\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x01\x1a\xe1e")
+
+	session := NewSession()
+	session.DHT = nodes[3]
+	torrent := Torrent{TrackerURL: srv.URL, InfoHash: infoHash, Length: 1}
+
+	peers, err := session.DiscoverPeers(context.Background(), torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]PeerSource{
+		"127.0.0.1:6881": PeerSourceTracker | PeerSourceDHT,
+		"10.0.0.1:6881":  PeerSourceTracker,
+		"127.0.0.1:7000": PeerSourceDHT,
+	}
+	if len(peers) != len(want) {
+		t.Fatalf("got peers %v", peers)
+	}
+	for _, p := range peers {
+		if p.Source != want[p.String()] {
+			t.Errorf("peer %s: got source %s, want %s", p, p.Source, want[p.String()])
+		}
+	}
+}
+
+func TestDiscoverPeersDHTOnly(t *testing.T) {
+	nodes := newTestDHT(t, 3)
+	infoHash := [20]byte{4, 5, 6}
+	if _, err := nodes[1].Announce(context.Background(), dht.ID(infoHash), 6881, false); err != nil {
+		t.Fatal(err)
+	}
+
+	session := NewSession()
+	session.DHT = nodes[2]
+	// A trackerless torrent still finds peers on the DHT.
+	peers, err := session.DiscoverPeers(context.Background(), Torrent{InfoHash: infoHash, Length: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:6881" || peers[0].Source != PeerSourceDHT {
+		t.Fatalf("got peers %v", peers)
+	}
+}
+
+func TestDiscoverPeersTorrentNodes(t *testing.T) {
+	nodes := newTestDHT(t, 2)
+	infoHash := [20]byte{4, 5, 7}
+	if _, err := nodes[1].Announce(context.Background(), dht.ID(infoHash), 6881, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A DHT node with no contacts joins through the torrent's nodes.
+	node, err := dht.New(dht.Config{Addr: "127.0.0.1:0", QueryTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+	session := NewSession()
+	session.DHT = node
+	torrent := Torrent{InfoHash: infoHash, Length: 1, Nodes: []string{nodes[0].Addr().String()}}
+	peers, err := session.DiscoverPeers(context.Background(), torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:6881" {
+		t.Fatalf("got peers %v", peers)
+	}
+}
+
+func TestAnnouncerAnnouncesOnDHT(t *testing.T) {
+	nodes := newTestDHT(t, 4)
+	infoHash := [20]byte{7, 8, 9}
+	if _, err := nodes[1].Announce(context.Background(), dht.ID(infoHash), 7000, false); err != nil {
+		t.Fatal(err)
+	}
+
+	rt, srv := newRecordingTracker(t, "d8:intervali1800e5:peers0:e")
+	torrent := &Torrent{
+		TrackerURL:  srv.URL,
+		InfoHash:    infoHash,
+		Length:      4,
+		PieceLength: 4,
+		Pieces:      make([][]byte, 1),
+	}
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := NewSession()
+	session.Port = 51413
+	session.DHT = nodes[3]
+	a := NewAnnouncer(session, torrent, pm)
+	a.Start()
+	rt.wait(t)
+
+	ours := netip.MustParseAddrPort("127.0.0.1:51413")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		peers, err := nodes[2].GetPeers(context.Background(), dht.ID(infoHash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, p := range peers {
+			found = found || p == ours
+		}
+		if found && pm.SourceOf(netip.MustParseAddrPort("127.0.0.1:7000")) == PeerSourceDHT {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("announce not visible on the DHT, peers %v", peers)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	a.Stop()
+	rt.wait(t)
+}
@@ -0,0 +1,282 @@
+package torrent
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
+)
+
+// MsgExtended carries the messages of the extension protocol (BEP 10).
+// The first payload byte selects the extension message.
+const MsgExtended = 20
+
+const (
+	// extHandshakeID is the extended message ID of the extension
+	// handshake.
+	extHandshakeID = 0
+
+	clientVersion = "pebl 0.0.1"
+	// maxQueuedRequests is the number of outstanding requests we accept
+	// from a peer, advertised as reqq.
+	maxQueuedRequests = 250
+)
+
+// Extension is a message type carried over the extension protocol, such as
+// ut_metadata, ut_pex or a private extension. Register extensions with
+// PeerManager.RegisterExtension.
+type Extension interface {
+	// Name is the extension's key in the m dictionary of the extended
+	// handshake.
+	Name() string
+	// PeerSupports is called once per peer when its extended handshake
+	// announces the extension. It must not block.
+	PeerSupports(peer *PeerConn)
+	// HandleMessage is called with the payload of every message the peer
+	// sends for the extension, in order.
+	HandleMessage(peer *PeerConn, payload []byte) error
+}
+
+// HandshakeExtension is implemented by extensions that add fields to our
+// extended handshake, e.g. ut_metadata setting MetadataSize.
+type HandshakeExtension interface {
+	Extension
+	ExtendHandshake(h *ExtendedHandshake)
+}
+
+// ExtendedHandshake is the first message of the extension protocol.
+type ExtendedHandshake struct {
+	// M maps the names of the supported extensions to the message IDs
+	// the sender wants them sent with.
+	M map[string]int
+	// V is the sender's client name and version.
+	V string
+	// YourIP is the receiver's address as the sender sees it.
+	YourIP netip.Addr
+	// Port is the TCP port the sender accepts connections on.
+	Port uint16
+	// Reqq is the number of outstanding requests the sender queues.
+	Reqq int
+	// MetadataSize is the size of the info dictionary (BEP 9).
+	MetadataSize int
+}
+
+func (h *ExtendedHandshake) encode() ([]byte, error) {
+	m := make(map[string]interface{}, len(h.M))
+	for name, id := range h.M {
+		m[name] = id
+	}
+	dict := map[string]interface{}{"m": m}
+	if h.V != "" {
+		dict["v"] = h.V
+	}
+	if h.YourIP.IsValid() {
+		dict["yourip"] = string(h.YourIP.Unmap().AsSlice())
+	}
+	if h.Port != 0 {
+		dict["p"] = int(h.Port)
+	}
+	if h.Reqq != 0 {
+		dict["reqq"] = h.Reqq
+	}
+	if h.MetadataSize != 0 {
+		dict["metadata_size"] = h.MetadataSize
+	}
+	return bencode.Encode(dict)
+}
+
+func decodeExtendedHandshake(data []byte) (*ExtendedHandshake, error) {
+	decoded, err := bencode.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("extended handshake is not a dictionary")
+	}
+
+	h := &ExtendedHandshake{M: make(map[string]int)}
+	m, _ := dict["m"].(map[string]interface{})
+	for name, v := range m {
+		// An ID of zero disables an extension announced earlier.
+		if id, ok := v.(int); ok && id > 0 && id < 256 {
+			h.M[name] = id
+		}
+	}
+	h.V, _ = dict["v"].(string)
+	if ip, ok := dict["yourip"].(string); ok {
+		h.YourIP, _ = netip.AddrFromSlice([]byte(ip))
+	}
+	if p, ok := dict["p"].(int); ok && p > 0 && p <= 65535 {
+		h.Port = uint16(p)
+	}
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		h.Reqq = reqq
+	}
+	if size, ok := dict["metadata_size"].(int); ok && size > 0 {
+		h.MetadataSize = size
+	}
+	return h, nil
+}
+
+// RegisterExtension adds an extension to the extended handshakes sent to
+// peers. Only peers connected afterwards learn about it. ut_pex is
+// registered by NewPeerManager.
+func (pm *PeerManager) RegisterExtension(ext Extension) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, e := range pm.extensions {
+		if e.Name() == ext.Name() {
+			return fmt.Errorf("extension %s already registered", ext.Name())
+		}
+	}
+	if len(pm.extensions) == 255 {
+		return fmt.Errorf("too many extensions")
+	}
+	pm.extensions = append(pm.extensions, ext)
+	return nil
+}
+
+// SetListenPort sets the port reported to peers in extended handshakes.
+func (pm *PeerManager) SetListenPort(port uint16) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.listenPort = port
+}
+
+// extension returns the extension we told peers to send with id.
+func (pm *PeerManager) extension(id byte) Extension {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if id == extHandshakeID || int(id) > len(pm.extensions) {
+		return nil
+	}
+	return pm.extensions[id-1]
+}
+
+// sendExtendedHandshake tells the peer which extensions we support. Each
+// extension is sent to us with its position in pm.extensions plus one.
+func (pm *PeerManager) sendExtendedHandshake(peer *PeerConn) error {
+	pm.mu.Lock()
+	h := &ExtendedHandshake{
+		M:    make(map[string]int, len(pm.extensions)),
+		V:    clientVersion,
+		Port: pm.listenPort,
+		Reqq: maxQueuedRequests,
+	}
+	extensions := pm.extensions
+	pm.mu.Unlock()
+
+	for i, ext := range extensions {
+		h.M[ext.Name()] = i + 1
+		if he, ok := ext.(HandshakeExtension); ok {
+			he.ExtendHandshake(h)
+		}
+	}
+	if remote, err := netip.ParseAddrPort(peer.Conn.RemoteAddr().String()); err == nil {
+		h.YourIP = remote.Addr()
+	}
+
+	payload, err := h.encode()
+	if err != nil {
+		return err
+	}
+	return peer.Send(&Message{ID: MsgExtended, Payload: append([]byte{extHandshakeID}, payload...)})
+}
+
+func (pm *PeerManager) handleExtended(peer *PeerConn, payload []byte) {
+	if len(payload) == 0 {
+		fmt.Println("empty extended message")
+		return
+	}
+
+	if payload[0] == extHandshakeID {
+		pm.handleExtendedHandshake(peer, payload[1:])
+		return
+	}
+	ext := pm.extension(payload[0])
+	if ext == nil {
+		fmt.Printf("Received unknown extended message ID %d\n", payload[0])
+		return
+	}
+	if err := ext.HandleMessage(peer, payload[1:]); err != nil {
+		fmt.Printf("%s message from %s: %v\n", ext.Name(), peer.addr, err)
+	}
+}
+
+func (pm *PeerManager) handleExtendedHandshake(peer *PeerConn, data []byte) {
+	h, err := decodeExtendedHandshake(data)
+	if err != nil {
+		fmt.Printf("invalid extended handshake: %v\n", err)
+		return
+	}
+
+	pm.mu.Lock()
+	extensions := pm.extensions
+	// A peer that connected to us tells us where it accepts connections.
+	if !peer.addr.IsValid() && h.Port != 0 {
+		if remote, err := netip.ParseAddrPort(peer.Conn.RemoteAddr().String()); err == nil {
+			peer.addr = netip.AddrPortFrom(remote.Addr(), h.Port)
+			// Over uTP peers connect from the port they listen on.
+			peer.reachable = remote.Port() == h.Port
+		}
+	}
+	pm.mu.Unlock()
+
+	// Handshakes may be resent to update fields; extensions hear about
+	// each peer once.
+	var supported []Extension
+	peer.mu.Lock()
+	peer.handshake = h
+	if peer.notified == nil {
+		peer.notified = make(map[string]bool)
+	}
+	for _, ext := range extensions {
+		if _, ok := h.M[ext.Name()]; ok && !peer.notified[ext.Name()] {
+			peer.notified[ext.Name()] = true
+			supported = append(supported, ext)
+		}
+	}
+	peer.mu.Unlock()
+
+	for _, ext := range supported {
+		ext.PeerSupports(peer)
+	}
+}
+
+// SupportsExtensions reports whether the peer's handshake advertised the
+// extension protocol.
+func (p *PeerConn) SupportsExtensions() bool {
+	return p.supportsExtensions
+}
+
+// ExtendedHandshake returns the peer's latest extended handshake, or nil
+// before it arrives.
+func (p *PeerConn) ExtendedHandshake() *ExtendedHandshake {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.handshake
+}
+
+// SendExtended sends payload to the peer as a message of the named
+// extension.
+func (p *PeerConn) SendExtended(name string, payload []byte) error {
+	id, ok := p.extensionID(name)
+	if !ok {
+		return fmt.Errorf("peer does not support %s", name)
+	}
+	return p.Send(&Message{ID: MsgExtended, Payload: append([]byte{id}, payload...)})
+}
+
+// extensionID returns the message ID the peer wants the named extension
+// sent with.
+func (p *PeerConn) extensionID(name string) (byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.handshake == nil {
+		return 0, false
+	}
+	id, ok := p.handshake.M[name]
+	return byte(id), ok
+}
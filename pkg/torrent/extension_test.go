@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
+)
+
+// echoExtension sends every message back to the peer.
+type echoExtension struct {
+	supported chan *PeerConn
+}
+
+func (e *echoExtension) Name() string { return "x_echo" }
+
+func (e *echoExtension) PeerSupports(peer *PeerConn) { e.supported <- peer }
+
+func (e *echoExtension) HandleMessage(peer *PeerConn, payload []byte) error {
+	return peer.SendExtended(e.Name(), payload)
+}
+
+func (e *echoExtension) ExtendHandshake(h *ExtendedHandshake) {
+	h.MetadataSize = 1234
+}
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	h := &ExtendedHandshake{
+		M:            map[string]int{"ut_pex": 1, "ut_metadata": 2},
+		V:            clientVersion,
+		YourIP:       netip.MustParseAddr("192.0.2.1"),
+		Port:         51413,
+		Reqq:         250,
+		MetadataSize: 31235,
+	}
+	data, err := h.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeExtendedHandshake(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.M) != 2 || got.M["ut_metadata"] != 2 || got.V != h.V || got.YourIP != h.YourIP ||
+		got.Port != h.Port || got.Reqq != h.Reqq || got.MetadataSize != h.MetadataSize {
+		t.Errorf("got %+v, want %+v", got, h)
+	}
+
+	// Extensions announced with ID zero are disabled.
+	got, err = decodeExtendedHandshake([]byte("d1:md6:ut_pexi0eee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.M["ut_pex"]; ok {
+		t.Error("disabled extension kept")
+	}
+}
+
+func TestRegisteredExtension(t *testing.T) {
+	pm := newTestPeerManager(t)
+	ext := &echoExtension{supported: make(chan *PeerConn, 1)}
+	if err := pm.RegisterExtension(ext); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.RegisterExtension(ext); err == nil {
+		t.Error("duplicate extension registered")
+	}
+	pm.SetListenPort(51413)
+
+	peer, remote := newPipePeer(t, pm, netip.MustParseAddrPort("10.0.0.1:6881"))
+	go pm.sendExtendedHandshake(peer)
+
+	// Our handshake lists ut_pex and the registered extension.
+	id, dict := readExtended(t, remote)
+	h, err := decodeExtendedHandshake(mustEncode(t, dict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != extHandshakeID || h.M["ut_pex"] != 1 || h.M["x_echo"] != 2 || h.Port != 51413 ||
+		h.Reqq != maxQueuedRequests || h.V != clientVersion || h.MetadataSize != 1234 {
+		t.Fatalf("got handshake %+v", h)
+	}
+
+	if _, err := remote.Write(extendedMessage(t, extHandshakeID, map[string]interface{}{
+		"m": map[string]interface{}{"x_echo": 9},
+		"v": "other 1.0",
+	}).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-ext.supported:
+		if p != peer || p.ExtendedHandshake().V != "other 1.0" {
+			t.Errorf("got peer %p with handshake %+v", p, p.ExtendedHandshake())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("extension not told about the peer")
+	}
+
+	// Messages sent with our ID reach the extension, and its replies use
+	// the peer's ID.
+	if _, err := remote.Write(extendedMessage(t, 2, "ping").Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	id, _ = readExtended(t, remote)
+	if id != 9 {
+		t.Errorf("got reply with ID %d, want 9", id)
+	}
+}
+
+func mustEncode(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := bencode.Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,153 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// The reserved bit advertising the Fast Extension (BEP 6).
+const (
+	reservedFastByte = 7
+	reservedFastBit  = 0x04
+)
+
+// allowedFastSetSize is the number of pieces a peer may request from us
+// while we choke it.
+const allowedFastSetSize = 10
+
+// SupportsFast reports whether the handshake advertises the Fast Extension.
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[reservedFastByte]&reservedFastBit != 0
+}
+
+// allowedFastSet returns the k pieces of a torrent with numPieces pieces
+// that the peer at ip may request while choked, as BEP 6 specifies. Only
+// IPv4 peers get a set.
+func allowedFastSet(ip netip.Addr, infoHash [20]byte, numPieces, k int) []uint32 {
+	ip = ip.Unmap()
+	if !ip.Is4() || numPieces == 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+
+	ip4 := ip.As4()
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	var set []uint32
+	seen := make(map[uint32]bool)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces)
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// sendAllowedFast computes the pieces the peer may request while choked
+// and tells it about those we have.
+func (pm *PeerManager) sendAllowedFast(peer *PeerConn) error {
+	remote, err := netip.ParseAddrPort(peer.Conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	set := allowedFastSet(remote.Addr(), pm.torrent.InfoHash, len(pm.torrent.Pieces), allowedFastSetSize)
+
+	allowed := make(map[uint32]bool, len(set))
+	for _, index := range set {
+		allowed[index] = true
+	}
+	peer.mu.Lock()
+	peer.ourAllowedFast = allowed
+	peer.mu.Unlock()
+
+	for _, index := range set {
+		if !pm.HasPiece(index) {
+			continue
+		}
+		if err := peer.Send(&Message{ID: MsgAllowedFast, Payload: binary.BigEndian.AppendUint32(nil, index)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rejectRequest tells a peer using the Fast Extension that we will not
+// serve its request.
+func (pm *PeerManager) rejectRequest(peer *PeerConn, req blockRequest) {
+	if !peer.fast {
+		return
+	}
+	payload := NewRequestMessage(req.index, req.begin, req.length).Payload
+	if err := peer.Send(&Message{ID: MsgRejectRequest, Payload: payload}); err != nil {
+		fmt.Printf("Failed to send reject to %s: %v\n", peer.Conn.RemoteAddr(), err)
+	}
+}
+
+func (pm *PeerManager) handleFastMessage(peer *PeerConn, msg *Message) {
+	if !peer.fast {
+		fmt.Printf("Ignoring Fast Extension message %d from %s\n", msg.ID, peer.Conn.RemoteAddr())
+		return
+	}
+
+	switch msg.ID {
+	case MsgHaveAll, MsgHaveNone:
+		bitfield := make([]byte, (len(pm.torrent.Pieces)+7)/8)
+		if msg.ID == MsgHaveAll {
+			for i := range pm.torrent.Pieces {
+				bitfield[i/8] |= 1 << (7 - i%8)
+			}
+		}
+		pm.setPeerBitfield(peer, bitfield)
+		go pm.fillRequests(peer)
+		return
+	case MsgRejectRequest:
+		req, ok := parseBlockRequest(msg.Payload)
+		if !ok {
+			fmt.Println("invalid reject message payload length")
+			return
+		}
+		pm.handleReject(peer, req)
+		return
+	}
+
+	if len(msg.Payload) != 4 {
+		fmt.Printf("invalid payload length for message %d\n", msg.ID)
+		return
+	}
+	index := binary.BigEndian.Uint32(msg.Payload)
+	if int(index) >= len(pm.torrent.Pieces) {
+		fmt.Printf("invalid piece index %d\n", index)
+		return
+	}
+
+	switch msg.ID {
+	case MsgSuggestPiece:
+		peer.mu.Lock()
+		if len(peer.suggested) < allowedFastSetSize {
+			peer.suggested = append(peer.suggested, index)
+		}
+		peer.mu.Unlock()
+	case MsgAllowedFast:
+		peer.mu.Lock()
+		if peer.allowedFast == nil {
+			peer.allowedFast = make(map[uint32]bool)
+		}
+		peer.allowedFast[index] = true
+		peer.mu.Unlock()
+
+		// Start on the piece right away if the peer still chokes us.
+		if peer.isChoked() {
+			go pm.fillRequests(peer)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// The example from BEP 6.
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+	ip := netip.MustParseAddr("80.4.4.200")
+
+	want := []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}
+	for _, k := range []int{7, 9} {
+		got := allowedFastSet(ip, infoHash, 1313, k)
+		if len(got) != k {
+			t.Fatalf("k=%d: got %v", k, got)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("k=%d: got %v, want %v", k, got, want[:k])
+				break
+			}
+		}
+	}
+
+	if got := allowedFastSet(ip, infoHash, 3, 10); len(got) != 3 {
+		t.Errorf("got %v for a three-piece torrent", got)
+	}
+	if got := allowedFastSet(netip.MustParseAddr("2001:db8::1"), infoHash, 1313, 10); got != nil {
+		t.Errorf("got %v for an IPv6 peer", got)
+	}
+}
+
+// newFastPeer connects a Fast Extension peer to pm over loopback TCP, so
+// it has an IPv4 address, and returns the peer's end.
+func newFastPeer(t *testing.T, pm *PeerManager) (*PeerConn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	remote, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { remote.Close() })
+	local, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := newPeerConn(local, [20]byte{}, netip.AddrPort{})
+	peer.fast = true
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return peer, remote
+}
+
+func readMessage(t *testing.T, conn net.Conn) *Message {
+	t.Helper()
+	for {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != nil {
+			return msg
+		}
+	}
+}
+
+func TestFastSeeding(t *testing.T) {
+	torrent, data := newTestTorrent(t, 40*1024, 1024)
+	pm := newSeeder(t, torrent, data)
+	peer, remote := newFastPeer(t, pm)
+	pm.startPeer(peer)
+
+	if msg := readMessage(t, remote); msg.ID != MsgHaveAll {
+		t.Fatalf("got message %d, want Have All", msg.ID)
+	}
+	set := allowedFastSet(netip.MustParseAddr("127.0.0.1"), torrent.InfoHash, len(torrent.Pieces), allowedFastSetSize)
+	allowed := make(map[uint32]bool)
+	for _, index := range set {
+		msg := readMessage(t, remote)
+		if msg.ID != MsgAllowedFast || binary.BigEndian.Uint32(msg.Payload) != index {
+			t.Fatalf("got message %d %v, want Allowed Fast %d", msg.ID, msg.Payload, index)
+		}
+		allowed[index] = true
+	}
+
+	// A choked peer is rejected, except for allowed fast pieces.
+	var choked uint32
+	for allowed[choked] {
+		choked++
+	}
+	req := NewRequestMessage(choked, 0, 1024)
+	remote.Write(req.Serialize())
+	if msg := readMessage(t, remote); msg.ID != MsgRejectRequest || !bytes.Equal(msg.Payload, req.Payload) {
+		t.Fatalf("got message %d, want reject", msg.ID)
+	}
+
+	remote.Write(NewRequestMessage(set[0], 0, 1024).Serialize())
+	msg := readMessage(t, remote)
+	if msg.ID != MsgPiece || binary.BigEndian.Uint32(msg.Payload) != set[0] {
+		t.Fatalf("got message %d, want piece %d", msg.ID, set[0])
+	}
+	start := int(set[0]) * 1024
+	if !bytes.Equal(msg.Payload[8:], data[start:start+1024]) {
+		t.Error("allowed fast piece has wrong data")
+	}
+}
+
+func TestOpeningMessagesFirst(t *testing.T) {
+	torrent, data := newTestTorrent(t, 40*1024, 1024)
+	pm := newSeeder(t, torrent, data)
+	peer, remote := newFastPeer(t, pm)
+
+	// The peer's interest arrives before we have said anything, but our
+	// Unchoke still follows the Have All and allowed fast set.
+	remote.Write(NewMessage(MsgInterested).Serialize())
+	pm.startPeer(peer)
+
+	if msg := readMessage(t, remote); msg.ID != MsgHaveAll {
+		t.Fatalf("got message %d, want Have All", msg.ID)
+	}
+	for i := 0; i < allowedFastSetSize; i++ {
+		if msg := readMessage(t, remote); msg.ID != MsgAllowedFast {
+			t.Fatalf("got message %d, want Allowed Fast", msg.ID)
+		}
+	}
+	if msg := readMessage(t, remote); msg.ID != MsgUnchoke {
+		t.Fatalf("got message %d, want Unchoke", msg.ID)
+	}
+}
+
+func TestFastLeeching(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 4*1024, 1024)
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, remote := newFastPeer(t, pm)
+	pm.Add(peer)
+	go pm.handlePeer(peer)
+
+	// Without pieces we send Have None.
+	if _, err := pm.sendBitfield(peer); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readMessage(t, remote); msg.ID != MsgHaveNone {
+		t.Fatalf("got message %d, want Have None", msg.ID)
+	}
+
+	// A seed that chokes us still serves its allowed fast pieces.
+	remote.Write(NewMessage(MsgHaveAll).Serialize())
+	remote.Write((&Message{ID: MsgAllowedFast, Payload: binary.BigEndian.AppendUint32(nil, 2)}).Serialize())
+	msg := readMessage(t, remote)
+	if msg.ID != MsgRequest || binary.BigEndian.Uint32(msg.Payload) != 2 {
+		t.Fatalf("got message %d %v, want request for piece 2", msg.ID, msg.Payload)
+	}
+	if !peer.hasPiece(3) {
+		t.Error("Have All not applied")
+	}
+
+	// A rejected block is asked of another peer that unchokes us.
+	other, otherRemote := newPipePeer(t, pm, netip.MustParseAddrPort("10.0.0.1:6881"))
+	pm.setPeerBitfield(other, []byte{0xf0})
+	other.setChoked(false)
+	rejected := NewRequestMessage(2, 0, 1024)
+	remote.Write((&Message{ID: MsgRejectRequest, Payload: rejected.Payload}).Serialize())
+	otherRemote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if msg := readMessage(t, otherRemote); msg.ID != MsgRequest || !bytes.Equal(msg.Payload, rejected.Payload) {
+		t.Errorf("got message %d %v, want the rejected request", msg.ID, msg.Payload)
+	}
+}
+
+func TestFastCancelRejects(t *testing.T) {
+	torrent, data := newTestTorrent(t, 2*1024, 1024)
+	pm := newSeeder(t, torrent, data)
+	peer, remote := newFastPeer(t, pm)
+	peer.amChoking = false
+
+	// Queue without a server so the request stays queued.
+	pm.queueRequest(peer, requestPayload(1, 0, 1024))
+	go pm.cancelRequest(peer, requestPayload(1, 0, 1024))
+	if msg := readMessage(t, remote); msg.ID != MsgRejectRequest || !bytes.Equal(msg.Payload, requestPayload(1, 0, 1024)) {
+		t.Errorf("got message %d, want reject", msg.ID)
+	}
+}
@@ -1,24 +1,41 @@
 package torrent
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"time"
 )
 
 type Handshake struct {
 	PeerID   []byte
 	InfoHash [20]byte
+	// Reserved holds the bits advertising protocol extensions.
+	Reserved [8]byte
+}
+
+// protocolPrefix starts every plaintext handshake.
+var protocolPrefix = []byte("\x13BitTorrent protocol")
+
+// The reserved bit advertising the extension protocol (BEP 10).
+const (
+	reservedExtendedByte = 5
+	reservedExtendedBit  = 0x10
+)
+
+// SupportsExtensions reports whether the handshake advertises the
+// extension protocol.
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[reservedExtendedByte]&reservedExtendedBit != 0
 }
 
 func (h *Handshake) ToBytes() []byte {
 	var b []byte
-	b = append(b, 19)
-	b = append(b, "BitTorrent protocol"...)
-
-	for i := 0; i < 8; i++ {
-		b = append(b, 0)
-	}
+	b = append(b, protocolPrefix...)
 
+	b = append(b, h.Reserved[:]...)
 	b = append(b, h.InfoHash[:]...)
 	b = append(b, h.PeerID...)
 
@@ -37,20 +54,36 @@ func HandshakeFromBytes(b []byte) *Handshake {
 		InfoHash: infoHash,
 		PeerID:   b[48:68],
 	}
+	copy(handshake.Reserved[:], b[20:28])
 
 	return handshake
 }
 
-func PerformHandshakeAndConnect(torrent *Torrent, peerAddr string, ourPeerID []byte) (*PeerConn, error) {
-	conn, err := net.Dial("tcp", peerAddr)
+// PerformHandshakeAndConnect connects to peer over TCP, encrypting the
+// connection as policy asks, and exchanges handshakes for torrent.
+func PerformHandshakeAndConnect(torrent *Torrent, peer Peer, ourPeerID []byte, policy EncryptionPolicy) (*PeerConn, error) {
+	return connectAndHandshake(dialTCP, torrent, peer, ourPeerID, policy)
+}
+
+func dialTCP(addr netip.AddrPort) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr.String(), handshakeTimeout)
+}
+
+// connectAndHandshake connects to peer with dial and exchanges handshakes
+// for torrent.
+func connectAndHandshake(dial func(netip.AddrPort) (net.Conn, error), torrent *Torrent, peer Peer, ourPeerID []byte, policy EncryptionPolicy) (*PeerConn, error) {
+	conn, err := dialPeer(dial, peer, torrent.InfoHash, policy)
 	if err != nil {
-		return nil, fmt.Errorf("error connecting to peer %s: %v", peerAddr, err)
+		return nil, err
 	}
 
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
 	handshake := Handshake{
 		PeerID:   ourPeerID,
 		InfoHash: torrent.InfoHash,
 	}
+	handshake.Reserved[reservedExtendedByte] |= reservedExtendedBit
+	handshake.Reserved[reservedFastByte] |= reservedFastBit
 	_, err = conn.Write(handshake.ToBytes())
 	if err != nil {
 		conn.Close()
@@ -58,7 +91,7 @@ func PerformHandshakeAndConnect(torrent *Torrent, peerAddr string, ourPeerID []b
 	}
 
 	response := make([]byte, 68)
-	_, err = conn.Read(response)
+	_, err = io.ReadFull(conn, response)
 	if err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("error reading handshake response: %w", err)
@@ -69,15 +102,50 @@ func PerformHandshakeAndConnect(torrent *Torrent, peerAddr string, ourPeerID []b
 		conn.Close()
 		return nil, fmt.Errorf("invalid handshake from peer")
 	}
+	if recv.InfoHash != torrent.InfoHash {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s answered with wrong infohash", peer)
+	}
+	if len(peer.ID) == 20 && !bytes.Equal(recv.PeerID, peer.ID) {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s answered with unexpected peer ID", peer)
+	}
+	conn.SetDeadline(time.Time{})
 
 	var peerID [20]byte
 	copy(peerID[:], recv.PeerID)
 
-	return &PeerConn{
-		Conn:     conn,
-		PeerID:   peerID,
-		Bitfield: nil,
-		Choked:   true,
-		UnchokeC: make(chan struct{}, 1),
-	}, nil
+	peerConn := newPeerConn(conn, peerID, peer.Addr)
+	peerConn.supportsExtensions = recv.SupportsExtensions()
+	peerConn.fast = recv.SupportsFast()
+	return peerConn, nil
+}
+
+// dialPeer connects to peer with dial and, unless policy disables
+// encryption, runs the MSE handshake for infoHash. With
+// EncryptionPreferred, a peer that fails the MSE handshake is dialed again
+// in plaintext.
+func dialPeer(dial func(netip.AddrPort) (net.Conn, error), peer Peer, infoHash [20]byte, policy EncryptionPolicy) (net.Conn, error) {
+	conn, err := dial(peer.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to peer %s: %v", peer, err)
+	}
+	if policy == EncryptionDisabled {
+		return conn, nil
+	}
+
+	provide := uint32(cryptoRC4)
+	if policy == EncryptionPreferred {
+		provide |= cryptoPlaintext
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	encrypted, err := mseInitiate(conn, infoHash, provide)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+	if policy == EncryptionRequired {
+		return nil, fmt.Errorf("MSE handshake with %s: %v", peer, err)
+	}
+	return dialPeer(dial, peer, infoHash, EncryptionDisabled)
 }
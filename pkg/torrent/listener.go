@@ -0,0 +1,223 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// Listener accepts connections from peers for the torrents added to it.
+type Listener struct {
+	ln     net.Listener
+	peerID [20]byte
+	// served are further listeners, e.g. a uTP socket, passed to Serve.
+	served []net.Listener
+
+	mu         sync.Mutex
+	torrents   map[[20]byte]*PeerManager
+	encryption EncryptionPolicy
+
+	wg sync.WaitGroup
+}
+
+// Listen accepts peer connections on the TCP address addr, answering
+// handshakes with peerID.
+func Listen(addr string, peerID [20]byte) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		ln:       ln,
+		peerID:   peerID,
+		torrents: make(map[[20]byte]*PeerManager),
+	}
+	l.wg.Add(1)
+	go l.acceptLoop(ln)
+	return l, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Port returns the port we accept connections on.
+func (l *Listener) Port() uint16 {
+	addr, err := netip.ParseAddrPort(l.ln.Addr().String())
+	if err != nil {
+		return 0
+	}
+	return addr.Port()
+}
+
+// Serve also accepts peer connections from ln, such as a uTP socket. Close
+// closes ln.
+func (l *Listener) Serve(ln net.Listener) {
+	l.mu.Lock()
+	l.served = append(l.served, ln)
+	l.mu.Unlock()
+
+	l.wg.Add(1)
+	go l.acceptLoop(ln)
+}
+
+// Close stops accepting connections. Connected peers stay connected.
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+	l.mu.Lock()
+	served := l.served
+	l.mu.Unlock()
+	for _, ln := range served {
+		ln.Close()
+	}
+	l.wg.Wait()
+	return err
+}
+
+// SetEncryption sets which incoming connections are accepted: encrypted
+// ones, plaintext ones or, by default, both.
+func (l *Listener) SetEncryption(policy EncryptionPolicy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.encryption = policy
+}
+
+// Add accepts connections for the torrent of pm and hands them to it.
+func (l *Listener) Add(pm *PeerManager) {
+	pm.SetListenPort(l.Port())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.torrents[pm.torrent.InfoHash] = pm
+}
+
+// Remove stops accepting connections for infoHash.
+func (l *Listener) Remove(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, infoHash)
+}
+
+func (l *Listener) acceptLoop(ln net.Listener) {
+	defer l.wg.Done()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go l.handleConn(conn)
+	}
+}
+
+// handleConn answers the handshake of an incoming connection, after the
+// MSE handshake if the peer starts one, and hands it to the PeerManager of
+// the requested torrent.
+func (l *Listener) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	l.mu.Lock()
+	policy := l.encryption
+	l.mu.Unlock()
+
+	// A plaintext handshake starts with the protocol string; anything else
+	// is taken for an MSE key exchange.
+	r := bufio.NewReader(conn)
+	prefix, err := r.Peek(20)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var peerConn net.Conn = &encryptedConn{Conn: conn, r: r}
+	encrypted := !bytes.Equal(prefix, protocolPrefix)
+	if (encrypted && policy == EncryptionDisabled) || (!encrypted && policy == EncryptionRequired) {
+		conn.Close()
+		return
+	}
+	var skey [20]byte
+	if encrypted {
+		peerConn, skey, err = mseAccept(conn, r, policy, l.skey)
+		if err != nil {
+			fmt.Printf("MSE handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	buf := make([]byte, 68)
+	if _, err := io.ReadFull(peerConn, buf); err != nil {
+		conn.Close()
+		return
+	}
+	recv := HandshakeFromBytes(buf)
+	if recv == nil || !bytes.Equal(buf[:20], protocolPrefix) || (encrypted && recv.InfoHash != skey) {
+		conn.Close()
+		return
+	}
+
+	l.mu.Lock()
+	pm := l.torrents[recv.InfoHash]
+	l.mu.Unlock()
+	if pm == nil || string(recv.PeerID) == string(l.peerID[:]) {
+		conn.Close()
+		return
+	}
+
+	reply := Handshake{PeerID: l.peerID[:], InfoHash: recv.InfoHash}
+	reply.Reserved[reservedExtendedByte] |= reservedExtendedBit
+	reply.Reserved[reservedFastByte] |= reservedFastBit
+	if _, err := peerConn.Write(reply.ToBytes()); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if err := pm.acceptPeer(peerConn, recv); err != nil {
+		fmt.Printf("Rejected peer %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+	}
+}
+
+// skey returns the infohash of the torrent whose HASH('req2', infohash) an
+// MSE handshake sent.
+func (l *Listener) skey(req2 [20]byte) ([20]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for infoHash := range l.torrents {
+		if mseHash([]byte("req2"), infoHash[:]) == req2 {
+			return infoHash, true
+		}
+	}
+	return [20]byte{}, false
+}
+
+// acceptPeer starts talking to a peer that connected to us with the
+// handshake recv. Its listen address is unknown until its extended
+// handshake reports the port.
+func (pm *PeerManager) acceptPeer(conn net.Conn, recv *Handshake) error {
+	pm.mu.Lock()
+	full := len(pm.peers)+len(pm.dialing) >= maxPeerConns
+	pm.mu.Unlock()
+	if full {
+		return fmt.Errorf("too many connections")
+	}
+
+	var peerID [20]byte
+	copy(peerID[:], recv.PeerID)
+	peer := newPeerConn(conn, peerID, netip.AddrPort{})
+	peer.supportsExtensions = recv.SupportsExtensions()
+	peer.fast = recv.SupportsFast()
+	pm.startPeer(peer)
+	return nil
+}
@@ -0,0 +1,15 @@
+package torrent
+
+import "net/netip"
+
+// connectLocalPeer hands a peer found by Local Service Discovery to the
+// PeerManager.
+func (pm *PeerManager) connectLocalPeer(addr netip.AddrPort) {
+	pm.mu.Lock()
+	peerID := pm.peerID
+	if pm.session != nil {
+		peerID = pm.session.PeerID[:]
+	}
+	pm.mu.Unlock()
+	pm.ConnectPeers([]Peer{{Addr: addr, Source: PeerSourceLSD}}, peerID)
+}
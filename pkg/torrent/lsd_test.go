@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/lsd"
+)
+
+// newTestLSD starts LSD on the loopback interface announcing port, in a
+// multicast group on groupPort.
+func newTestLSD(t *testing.T, port uint16, groupPort int) *lsd.LSD {
+	t.Helper()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback == 0 || ifaces[i].Flags&net.FlagUp == 0 {
+			continue
+		}
+		l, err := lsd.New(lsd.Config{
+			Port:      port,
+			Group:     fmt.Sprintf("239.192.152.143:%d", groupPort),
+			Interface: &ifaces[i],
+		})
+		if err != nil {
+			t.Skipf("multicast unavailable: %v", err)
+		}
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+	t.Skip("no loopback interface")
+	return nil
+}
+
+func TestAnnouncerFindsLocalPeers(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupPort := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	infoHash := [20]byte{10, 11, 12}
+	other := newTestLSD(t, 7000, groupPort)
+	found := make(chan netip.AddrPort, 10)
+	other.Add(infoHash, func(p netip.AddrPort) { found <- p })
+
+	rt, srv := newRecordingTracker(t, "d8:intervali1800e5:peers0:e")
+	torrent := &Torrent{
+		TrackerURL:  srv.URL,
+		InfoHash:    infoHash,
+		Length:      4,
+		PieceLength: 4,
+		Pieces:      make([][]byte, 1),
+	}
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := NewSession()
+	session.Port = 51413
+	session.LSD = newTestLSD(t, session.Port, groupPort)
+	pm.Start(session)
+	defer pm.Stop()
+	a := NewAnnouncer(session, torrent, pm)
+	a.Start()
+	rt.wait(t)
+
+	// The other client hears our announce.
+	select {
+	case p := <-found:
+		if p.Port() != 51413 {
+			t.Errorf("got %s, want port 51413", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("announce not heard on the local network")
+	}
+
+	// A client that starts after us is found through its own announce.
+	late := newTestLSD(t, 7001, groupPort)
+	late.Add(infoHash, func(netip.AddrPort) {})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasLocalPeer(pm, 7001) {
+		if time.Now().After(deadline) {
+			t.Fatal("local peer not handed to the PeerManager")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	a.Stop()
+	rt.wait(t)
+}
+
+func hasLocalPeer(pm *PeerManager, port uint16) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for addr, source := range pm.sources {
+		if addr.Port() == port && source == PeerSourceLSD {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,360 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// EncryptionPolicy decides whether peer connections use Message Stream
+// Encryption (MSE/PE), which hides BitTorrent traffic from throttling.
+type EncryptionPolicy int
+
+const (
+	// EncryptionPreferred encrypts connections where the peer supports it
+	// and falls back to plaintext otherwise.
+	EncryptionPreferred EncryptionPolicy = iota
+	// EncryptionDisabled only uses plaintext connections.
+	EncryptionDisabled
+	// EncryptionRequired only uses RC4 encrypted connections.
+	EncryptionRequired
+)
+
+func (p EncryptionPolicy) String() string {
+	switch p {
+	case EncryptionPreferred:
+		return "preferred"
+	case EncryptionDisabled:
+		return "disabled"
+	case EncryptionRequired:
+		return "required"
+	}
+	return fmt.Sprintf("EncryptionPolicy(%d)", int(p))
+}
+
+// SetEncryption sets whether the connections we make to peers are
+// encrypted.
+func (pm *PeerManager) SetEncryption(policy EncryptionPolicy) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.encryption = policy
+}
+
+// The crypto_provide and crypto_select bits.
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+const (
+	mseKeyLength = 96
+	// mseMaxPad is the longest padding either side may send.
+	mseMaxPad = 512
+	// mseMaxIA is the longest initial payload we accept.
+	mseMaxIA = 68
+)
+
+// mseP is the 768-bit prime of the Diffie-Hellman exchange; the generator
+// is 2.
+var mseP, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+var mseG = big.NewInt(2)
+
+// mseVC is the verification constant both sides encrypt to prove they
+// derived the same keys.
+var mseVC [8]byte
+
+func mseHash(parts ...[]byte) [20]byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	var sum [20]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// mseKeyPair returns a random private key and its public key in wire
+// format.
+func mseKeyPair() (*big.Int, []byte, error) {
+	var x [20]byte
+	if _, err := rand.Read(x[:]); err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(x[:])
+	public := new(big.Int).Exp(mseG, private, mseP)
+	return private, public.FillBytes(make([]byte, mseKeyLength)), nil
+}
+
+// mseSecret returns the shared secret S from the peer's public key.
+func mseSecret(private *big.Int, public []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(public)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(mseP) >= 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	return new(big.Int).Exp(y, private, mseP).FillBytes(make([]byte, mseKeyLength)), nil
+}
+
+// mseCipher returns the RC4 stream keyed with name, S and SKEY, with the
+// first 1024 bytes discarded.
+func mseCipher(name string, secret []byte, skey [20]byte) *rc4.Cipher {
+	key := mseHash([]byte(name), secret, skey[:])
+	c, _ := rc4.NewCipher(key[:])
+	var discard [1024]byte
+	c.XORKeyStream(discard[:], discard[:])
+	return c
+}
+
+// msePad returns up to mseMaxPad random bytes.
+func msePad() []byte {
+	var n [2]byte
+	rand.Read(n[:])
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(mseMaxPad+1))
+	rand.Read(pad)
+	return pad
+}
+
+func xorHash(a, b [20]byte) [20]byte {
+	for i := range a {
+		a[i] ^= b[i]
+	}
+	return a
+}
+
+// syncTo reads from r until it has read pattern, giving up after max bytes.
+func syncTo(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, len(pattern))
+	for i := 0; i < max; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if len(window) == len(pattern) {
+			copy(window, window[1:])
+			window = window[:len(pattern)-1]
+		}
+		window = append(window, b)
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("MSE synchronization failed")
+}
+
+// encryptedConn is a connection after the MSE handshake. Its ciphers are
+// nil when plaintext was selected.
+type encryptedConn struct {
+	net.Conn
+	r       *bufio.Reader
+	pending []byte
+	dec     *rc4.Cipher
+
+	wmu sync.Mutex
+	enc *rc4.Cipher
+}
+
+func (c *encryptedConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *encryptedConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	// The keystream must be applied in the order the bytes are sent.
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// mseInitiate runs the MSE handshake as the connecting side for the
+// torrent infoHash, offering the methods in provide.
+func mseInitiate(conn net.Conn, infoHash [20]byte, provide uint32) (net.Conn, error) {
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(public, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	peerPublic := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(r, peerPublic); err != nil {
+		return nil, err
+	}
+	secret, err := mseSecret(private, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := mseCipher("keyA", secret, infoHash)
+	dec := mseCipher("keyB", secret, infoHash)
+
+	req1 := mseHash([]byte("req1"), secret)
+	req2 := mseHash([]byte("req2"), infoHash[:])
+	req3 := mseHash([]byte("req3"), secret)
+	skeyHash := xorHash(req2, req3)
+
+	// VC, crypto_provide, len(PadC) and len(IA); we send no padding and
+	// no initial payload.
+	tail := make([]byte, 16)
+	copy(tail, mseVC[:])
+	binary.BigEndian.PutUint32(tail[8:12], provide)
+	enc.XORKeyStream(tail, tail)
+
+	msg := append(req1[:], skeyHash[:]...)
+	if _, err := conn.Write(append(msg, tail...)); err != nil {
+		return nil, err
+	}
+
+	// The reply starts after the peer's padding with the encrypted VC.
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC[:])
+	if err := syncTo(r, vc, mseMaxPad+len(vc)); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 6)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(reply, reply)
+	selected := binary.BigEndian.Uint32(reply[0:4])
+	if selected&provide == 0 || (selected != cryptoPlaintext && selected != cryptoRC4) {
+		return nil, fmt.Errorf("peer selected unsupported crypto method %d", selected)
+	}
+	padD := make([]byte, binary.BigEndian.Uint16(reply[4:6]))
+	if len(padD) > mseMaxPad {
+		return nil, fmt.Errorf("MSE padding too long")
+	}
+	if _, err := io.ReadFull(r, padD); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	if selected == cryptoPlaintext {
+		return &encryptedConn{Conn: conn, r: r}, nil
+	}
+	return &encryptedConn{Conn: conn, r: r, dec: dec, enc: enc}, nil
+}
+
+// mseAccept runs the MSE handshake as the receiving side. skey returns the
+// infohash whose HASH('req2', infohash) is given, and policy decides which
+// of the offered methods we select. It returns the connection and the
+// infohash the peer asked for.
+func mseAccept(conn net.Conn, r *bufio.Reader, policy EncryptionPolicy, skey func([20]byte) ([20]byte, bool)) (net.Conn, [20]byte, error) {
+	var infoHash [20]byte
+
+	peerPublic := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(r, peerPublic); err != nil {
+		return nil, infoHash, err
+	}
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, infoHash, err
+	}
+	secret, err := mseSecret(private, peerPublic)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	if _, err := conn.Write(append(public, msePad()...)); err != nil {
+		return nil, infoHash, err
+	}
+
+	req1 := mseHash([]byte("req1"), secret)
+	if err := syncTo(r, req1[:], mseMaxPad+len(req1)); err != nil {
+		return nil, infoHash, err
+	}
+	var skeyHash [20]byte
+	if _, err := io.ReadFull(r, skeyHash[:]); err != nil {
+		return nil, infoHash, err
+	}
+	infoHash, ok := skey(xorHash(skeyHash, mseHash([]byte("req3"), secret)))
+	if !ok {
+		return nil, infoHash, fmt.Errorf("unknown torrent")
+	}
+
+	enc := mseCipher("keyB", secret, infoHash)
+	dec := mseCipher("keyA", secret, infoHash)
+
+	head := make([]byte, 14)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, infoHash, err
+	}
+	dec.XORKeyStream(head, head)
+	if !bytes.Equal(head[:8], mseVC[:]) {
+		return nil, infoHash, fmt.Errorf("invalid MSE verification constant")
+	}
+	provide := binary.BigEndian.Uint32(head[8:12])
+	padC := make([]byte, binary.BigEndian.Uint16(head[12:14]))
+	if len(padC) > mseMaxPad {
+		return nil, infoHash, fmt.Errorf("MSE padding too long")
+	}
+	if _, err := io.ReadFull(r, padC); err != nil {
+		return nil, infoHash, err
+	}
+	dec.XORKeyStream(padC, padC)
+
+	var iaLen [2]byte
+	if _, err := io.ReadFull(r, iaLen[:]); err != nil {
+		return nil, infoHash, err
+	}
+	dec.XORKeyStream(iaLen[:], iaLen[:])
+	ia := make([]byte, binary.BigEndian.Uint16(iaLen[:]))
+	if len(ia) > mseMaxIA {
+		return nil, infoHash, fmt.Errorf("MSE initial payload too long")
+	}
+	if _, err := io.ReadFull(r, ia); err != nil {
+		return nil, infoHash, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy != EncryptionRequired:
+		selected = cryptoPlaintext
+	default:
+		return nil, infoHash, fmt.Errorf("no acceptable crypto method in %d", provide)
+	}
+
+	reply := make([]byte, 14)
+	copy(reply, mseVC[:])
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, infoHash, err
+	}
+
+	c := &encryptedConn{Conn: conn, r: r, pending: ia}
+	if selected == cryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, infoHash, nil
+}
@@ -0,0 +1,148 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mseHandshake runs both sides of the MSE handshake over loopback TCP.
+func mseHandshake(t *testing.T, infoHash, served [20]byte, provide uint32, policy EncryptionPolicy) (initiator, acceptor net.Conn, initErr, acceptErr error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptErr = err
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		skey := func(req2 [20]byte) ([20]byte, bool) {
+			return served, mseHash([]byte("req2"), served[:]) == req2
+		}
+		acceptor, _, acceptErr = mseAccept(conn, bufio.NewReader(conn), policy, skey)
+		if acceptErr != nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	initiator, initErr = mseInitiate(conn, infoHash, provide)
+	<-done
+	return initiator, acceptor, initErr, acceptErr
+}
+
+func TestMSEHandshake(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+
+	tests := []struct {
+		name     string
+		provide  uint32
+		policy   EncryptionPolicy
+		selected uint32
+	}{
+		{"rc4", cryptoRC4 | cryptoPlaintext, EncryptionPreferred, cryptoRC4},
+		{"rc4 required", cryptoRC4, EncryptionRequired, cryptoRC4},
+		{"plaintext", cryptoPlaintext, EncryptionPreferred, cryptoPlaintext},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, err1, err2 := mseHandshake(t, infoHash, infoHash, tt.provide, tt.policy)
+			if err1 != nil || err2 != nil {
+				t.Fatalf("handshake failed: %v, %v", err1, err2)
+			}
+			if encrypted := a.(*encryptedConn).enc != nil; encrypted != (tt.selected == cryptoRC4) {
+				t.Errorf("initiator encrypted = %v", encrypted)
+			}
+			if encrypted := b.(*encryptedConn).enc != nil; encrypted != (tt.selected == cryptoRC4) {
+				t.Errorf("acceptor encrypted = %v", encrypted)
+			}
+
+			// Both directions carry the stream unchanged.
+			for _, pair := range [][2]net.Conn{{a, b}, {b, a}} {
+				msg := bytes.Repeat([]byte("pebl"), 1000)
+				go pair[0].Write(msg)
+				got := make([]byte, len(msg))
+				if _, err := io.ReadFull(pair[1], got); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, msg) {
+					t.Fatal("stream corrupted")
+				}
+			}
+		})
+	}
+}
+
+func TestMSEHandshakeFailures(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+
+	_, _, _, err := mseHandshake(t, infoHash, infoHash, cryptoPlaintext, EncryptionRequired)
+	if err == nil {
+		t.Error("plaintext selected although encryption is required")
+	}
+	_, _, _, err = mseHandshake(t, infoHash, [20]byte{4, 5, 6}, cryptoRC4, EncryptionPreferred)
+	if err == nil {
+		t.Error("handshake succeeded for an unknown torrent")
+	}
+}
+
+func TestEncryptedSeedToLeecher(t *testing.T) {
+	torrent, data := newTestTorrent(t, 3*blockSize, blockSize)
+	seeder := newSeeder(t, torrent, data)
+
+	l, err := Listen("127.0.0.1:0", GeneratePeerID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetEncryption(EncryptionRequired)
+	l.Add(seeder)
+	addr := netip.MustParseAddrPort(l.Addr().String())
+
+	// The listener refuses plaintext peers.
+	peerID := GeneratePeerID()
+	if _, err := PerformHandshakeAndConnect(torrent, Peer{Addr: addr}, peerID[:], EncryptionDisabled); err == nil {
+		t.Error("plaintext connection accepted")
+	}
+
+	dir := t.TempDir()
+	leecher, err := NewPeerManager(torrent, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leecher.SetEncryption(EncryptionRequired)
+	leecher.ConnectPeers([]Peer{{Addr: addr}}, peerID[:])
+
+	select {
+	case <-leecher.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not complete")
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data differs")
+	}
+}
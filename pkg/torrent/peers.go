@@ -2,20 +2,21 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
-	"net/http"
-	"net/url"
+	"net/netip"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/torbenconto/pebl/pkg/bencode"
+	"github.com/torbenconto/pebl/pkg/utp"
 )
 
 const (
@@ -29,7 +30,18 @@ const (
 	MsgPiece         = 7
 	MsgCancel        = 8
 
+	// Fast Extension messages (BEP 6).
+	MsgSuggestPiece  = 13
+	MsgHaveAll       = 14
+	MsgHaveNone      = 15
+	MsgRejectRequest = 16
+	MsgAllowedFast   = 17
+
 	blockSize = 16384 // 16KiB blocks
+
+	maxPeerConns = 50
+	// maxCandidates bounds the peers kept waiting for a connection slot.
+	maxCandidates = 500
 )
 
 type Message struct {
@@ -46,7 +58,17 @@ func (m *Message) Serialize() []byte {
 	return buf
 }
 
+// maxMessageLength is the longest message accepted by ReadMessage: a
+// piece message carrying the largest block we allow.
+const maxMessageLength = maxRequestLength + 13
+
 func ReadMessage(conn net.Conn) (*Message, error) {
+	return readMessageLimit(conn, maxMessageLength)
+}
+
+// readMessageLimit reads a message, rejecting a length above maxLength
+// before allocating for it.
+func readMessageLimit(conn net.Conn, maxLength uint32) (*Message, error) {
 	lengthBuf := make([]byte, 4)
 	_, err := io.ReadFull(conn, lengthBuf)
 	if err != nil {
@@ -57,6 +79,9 @@ func ReadMessage(conn net.Conn) (*Message, error) {
 	if length == 0 {
 		return nil, nil // keep-alive
 	}
+	if length > maxLength {
+		return nil, fmt.Errorf("message length %d exceeds %d", length, maxLength)
+	}
 
 	msgBuf := make([]byte, length)
 	_, err = io.ReadFull(conn, msgBuf)
@@ -86,14 +111,153 @@ func NewRequestMessage(index, begin, length uint32) *Message {
 	}
 }
 
+// NewCancelMessage cancels a request made with NewRequestMessage.
+func NewCancelMessage(index, begin, length uint32) *Message {
+	msg := NewRequestMessage(index, begin, length)
+	msg.ID = MsgCancel
+	return msg
+}
+
+// PeerSource records where we learned about a peer. A peer reported by
+// several sources carries all of their bits.
+type PeerSource uint8
+
+const (
+	PeerSourceTracker PeerSource = 1 << iota
+	PeerSourceDHT
+	PeerSourceLSD
+	PeerSourcePEX
+)
+
+func (s PeerSource) String() string {
+	var names []string
+	if s&PeerSourceTracker != 0 {
+		names = append(names, "tracker")
+	}
+	if s&PeerSourceDHT != 0 {
+		names = append(names, "dht")
+	}
+	if s&PeerSourceLSD != 0 {
+		names = append(names, "lsd")
+	}
+	if s&PeerSourcePEX != 0 {
+		names = append(names, "pex")
+	}
+	if len(names) == 0 {
+		return "unknown"
+	}
+	return strings.Join(names, ",")
+}
+
+// Peer is a peer address as reported by a tracker, the DHT, LSD or PEX,
+// optionally with the peer ID it is known by.
+type Peer struct {
+	Addr   netip.AddrPort
+	ID     []byte
+	Source PeerSource
+}
+
+func (p Peer) String() string {
+	return p.Addr.String()
+}
+
+// MergePeers combines peer lists, keeping each address once with the
+// sources of all lists it appears in.
+func MergePeers(lists ...[]Peer) []Peer {
+	var merged []Peer
+	index := make(map[netip.AddrPort]int)
+	for _, list := range lists {
+		for _, p := range list {
+			if i, ok := index[p.Addr]; ok {
+				merged[i].Source |= p.Source
+				if merged[i].ID == nil {
+					merged[i].ID = p.ID
+				}
+				continue
+			}
+			index[p.Addr] = len(merged)
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
 type PeerConn struct {
 	Conn     net.Conn
 	PeerID   [20]byte
+	Source   PeerSource
 	Bitfield []byte
 	Choked   bool
 	UnchokeC chan struct{}
 	mu       sync.Mutex
 	unchoked bool
+
+	// addr is the address the peer accepts connections on. reachable is
+	// set when we know it does: we dialed it, or it connected from there.
+	addr      netip.AddrPort
+	reachable bool
+	// closeC is closed when the peer is removed.
+	closeC chan struct{}
+
+	supportsExtensions bool
+	// fast is set when both sides support the Fast Extension.
+	fast      bool
+	handshake *ExtendedHandshake
+	// notified holds the extensions told that the peer supports them.
+	notified map[string]bool
+	pex      pexState
+
+	// amChoking and interested are our choke state towards the peer and
+	// whether it wants to download from us.
+	amChoking  bool
+	interested bool
+	// requests are the blocks the peer asked for that we have yet to
+	// send; requestC is signaled when one is queued.
+	requests []blockRequest
+	requestC chan struct{}
+
+	// allowedFast are the pieces the peer lets us request while it chokes
+	// us, ourAllowedFast those we let it request, and suggested the pieces
+	// it suggested we download first.
+	allowedFast    map[uint32]bool
+	ourAllowedFast map[uint32]bool
+	suggested      []uint32
+
+	// downloaded and uploaded count the piece data exchanged with the
+	// peer. The choker keeps their values at its last round to compute
+	// rates.
+	downloaded     atomic.Int64
+	uploaded       atomic.Int64
+	lastDownloaded int64
+	lastUploaded   int64
+	connectedAt    time.Time
+	lastUnchoked   time.Time
+
+	// outstanding are the blocks we requested from the peer and when;
+	// window is how many we keep outstanding. failed are blocks that timed
+	// out or were rejected and when, which the peer is not asked for again
+	// until failedRetryDelay passed.
+	outstanding   map[blockRequest]time.Time
+	window        int
+	failed        map[blockRequest]time.Time
+	lastRateCheck time.Time
+	lastRateBytes int64
+}
+
+func newPeerConn(conn net.Conn, peerID [20]byte, addr netip.AddrPort) *PeerConn {
+	return &PeerConn{
+		Conn:     conn,
+		PeerID:   peerID,
+		Choked:   true,
+		UnchokeC: make(chan struct{}, 1),
+		addr:     addr,
+		closeC:   make(chan struct{}),
+
+		amChoking:   true,
+		requestC:    make(chan struct{}, 1),
+		connectedAt: time.Now(),
+		window:      initialRequestWindow,
+	}
 }
 
 func (p *PeerConn) Send(msg *Message) error {
@@ -120,6 +284,24 @@ func (p *PeerConn) IsUnchoked() bool {
 	return p.unchoked
 }
 
+func (p *PeerConn) setChoked(choked bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Choked = choked
+}
+
+func (p *PeerConn) isChoked() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Choked
+}
+
+func (p *PeerConn) hasPiece(index uint32) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return hasPiece(p.Bitfield, index)
+}
+
 type PieceBuffer struct {
 	data   []byte
 	bitmap []bool
@@ -159,6 +341,48 @@ type PeerManager struct {
 	torrent      *Torrent
 	pieceBuffers map[uint32]*PieceBuffer
 
+	have      []bool
+	haveCount int
+	left      int64
+	done      chan struct{}
+	dialing   map[netip.AddrPort]bool
+	sources   map[netip.AddrPort]PeerSource
+	// candidates are known peers waiting for a free connection slot.
+	candidates []Peer
+	peerID     []byte
+
+	extensions []Extension
+	listenPort uint16
+	encryption EncryptionPolicy
+	utp        *utp.Socket
+
+	// session is the session passed to Start, and stopChoker and
+	// chokerDone stop the choker it started.
+	session    *Session
+	stopChoker context.CancelFunc
+	chokerDone chan struct{}
+
+	// uploadSlots and chokeAlgorithm configure the choker; optimistic is
+	// the peer it unchoked optimistically.
+	uploadSlots    int
+	chokeAlgorithm ChokeAlgorithm
+	optimistic     *PeerConn
+	lastRechoke    time.Time
+	chokeRounds    int
+
+	// pending maps each block requested from a peer to that peer.
+	// released are blocks taken back from peers, requested again first.
+	pending        map[blockRequest]*PeerConn
+	released       []blockRequest
+	requestTimeout time.Duration
+	// availability counts the connected peers that have each piece, and
+	// buckets groups the pieces we miss by it.
+	availability []int
+	buckets      *pieceBuckets
+
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+
 	files   []FileEntry
 	rootDir string
 
@@ -171,7 +395,20 @@ func NewPeerManager(torrent *Torrent, rootDir string) (*PeerManager, error) {
 		torrent:      torrent,
 		pieceBuffers: make(map[uint32]*PieceBuffer),
 		rootDir:      rootDir,
+		have:         make([]bool, len(torrent.Pieces)),
+		left:         torrent.TotalLength(),
+		done:         make(chan struct{}),
+		dialing:      make(map[netip.AddrPort]bool),
+		sources:      make(map[netip.AddrPort]PeerSource),
+
+		uploadSlots:    defaultUploadSlots,
+		chokeAlgorithm: FastestUpload{},
+		pending:        make(map[blockRequest]*PeerConn),
+		requestTimeout: defaultRequestTimeout,
+		availability:   make([]int, len(torrent.Pieces)),
+		buckets:        newPieceBuckets(len(torrent.Pieces)),
 	}
+	pm.extensions = []Extension{&pexExtension{pm: pm}}
 
 	if err := os.MkdirAll(rootDir, 0755); err != nil {
 		return nil, err
@@ -192,7 +429,7 @@ func NewPeerManager(torrent *Torrent, rootDir string) (*PeerManager, error) {
 			return nil, err
 		}
 
-		f, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY, 0644)
+		f, err := os.OpenFile(fullPath, os.O_CREATE|os.O_RDWR, 0644)
 		if err != nil {
 			return nil, err
 		}
@@ -207,16 +444,60 @@ func NewPeerManager(torrent *Torrent, rootDir string) (*PeerManager, error) {
 	return pm, nil
 }
 
+// Start applies the session's peer settings, registers the torrent with
+// the session's Listener and LSD and starts choking and unchoking peers,
+// until Stop.
+func (pm *PeerManager) Start(s *Session) {
+	pm.SetEncryption(s.Encryption)
+	pm.SetUTP(s.UTP)
+	pm.SetUploadSlots(s.UploadSlots)
+	pm.SetChokeAlgorithm(s.ChokeAlgorithm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	pm.mu.Lock()
+	pm.session, pm.stopChoker, pm.chokerDone = s, cancel, done
+	pm.mu.Unlock()
+	go func() {
+		defer close(done)
+		pm.runChoker(ctx)
+	}()
+
+	if s.Listener != nil {
+		s.Listener.Add(pm)
+	}
+	if s.LSD != nil {
+		s.LSD.Add(pm.torrent.InfoHash, pm.connectLocalPeer)
+	}
+}
+
+// Stop undoes Start.
+func (pm *PeerManager) Stop() {
+	pm.mu.Lock()
+	s, cancel, done := pm.session, pm.stopChoker, pm.chokerDone
+	pm.session, pm.stopChoker, pm.chokerDone = nil, nil, nil
+	pm.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	if s.Listener != nil {
+		s.Listener.Remove(pm.torrent.InfoHash)
+	}
+	if s.LSD != nil {
+		s.LSD.Remove(pm.torrent.InfoHash)
+	}
+	cancel()
+	<-done
+}
+
 func (pm *PeerManager) getOrCreatePieceBuffer(index uint32) *PieceBuffer {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
 	pb, ok := pm.pieceBuffers[index]
 	if !ok {
-		size := pm.torrent.PieceLength
-		if int(index) == len(pm.torrent.Pieces)-1 {
-			size = pm.torrent.Length - int(index)*pm.torrent.PieceLength
-		}
+		size := pm.torrent.PieceSize(index)
 		pb = &PieceBuffer{
 			data:   make([]byte, size),
 			bitmap: make([]bool, (size+blockSize-1)/blockSize),
@@ -227,6 +508,15 @@ func (pm *PeerManager) getOrCreatePieceBuffer(index uint32) *PieceBuffer {
 }
 
 func (pm *PeerManager) handlePieceMessage(index, begin uint32, block []byte, peer *PeerConn) {
+	if !pm.validBlock(blockRequest{index: index, begin: begin, length: uint32(len(block))}) {
+		return
+	}
+	pm.downloaded.Add(int64(len(block)))
+	peer.downloaded.Add(int64(len(block)))
+	if pm.HasPiece(index) {
+		return
+	}
+
 	pb := pm.getOrCreatePieceBuffer(index)
 	pb.mu.Lock()
 	copy(pb.data[begin:], block)
@@ -258,6 +548,7 @@ func (pm *PeerManager) handlePieceMessage(index, begin uint32, block []byte, pee
 		pm.mu.Lock()
 		delete(pm.pieceBuffers, index)
 		pm.mu.Unlock()
+		pm.markHave(index)
 
 		payload := make([]byte, 4)
 		binary.BigEndian.PutUint32(payload, index)
@@ -265,6 +556,57 @@ func (pm *PeerManager) handlePieceMessage(index, begin uint32, block []byte, pee
 	}
 }
 
+func (pm *PeerManager) markHave(index uint32) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.have[index] {
+		return
+	}
+	pm.have[index] = true
+	pm.haveCount++
+	pm.buckets.remove(index, pm.availability[index])
+	pm.left -= int64(pm.torrent.PieceSize(index))
+	if pm.haveCount == len(pm.have) {
+		close(pm.done)
+	}
+}
+
+func (pm *PeerManager) HasPiece(index uint32) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return int(index) < len(pm.have) && pm.have[index]
+}
+
+// Done is closed once every piece has been verified and written.
+func (pm *PeerManager) Done() <-chan struct{} {
+	return pm.done
+}
+
+func (pm *PeerManager) IsComplete() bool {
+	select {
+	case <-pm.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pm *PeerManager) Uploaded() int64 {
+	return pm.uploaded.Load()
+}
+
+func (pm *PeerManager) Downloaded() int64 {
+	return pm.downloaded.Load()
+}
+
+// Left returns the number of bytes still missing from verified pieces.
+func (pm *PeerManager) Left() int64 {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.left
+}
+
 func (pm *PeerManager) writePieceDataToFiles(offset int64, data []byte) error {
 	remaining := len(data)
 	dataOffset := 0
@@ -324,21 +666,202 @@ func (pm *PeerManager) Add(peer *PeerConn) {
 
 func (pm *PeerManager) Remove(peer *PeerConn) {
 	pm.mu.Lock()
-	defer pm.mu.Unlock()
+	removed := false
 	for i, p := range pm.peers {
 		if p == peer {
 			p.Conn.Close()
+			close(p.closeC)
 			pm.peers = append(pm.peers[:i], pm.peers[i+1:]...)
+			p.mu.Lock()
+			pm.countPiecesLocked(p.Bitfield, -1)
+			p.mu.Unlock()
+			removed = true
 			break
 		}
 	}
+	pm.mu.Unlock()
+
+	if removed {
+		peer.mu.Lock()
+		var reqs []blockRequest
+		for req := range peer.outstanding {
+			reqs = append(reqs, req)
+		}
+		peer.mu.Unlock()
+		pm.releaseRequests(peer, reqs, false)
+	}
+	pm.dialCandidates()
+}
+
+func (pm *PeerManager) isConnected(addr netip.AddrPort) bool {
+	for _, p := range pm.peers {
+		if remote, err := netip.ParseAddrPort(p.Conn.RemoteAddr().String()); err == nil && remote == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceOf returns every source that has reported the peer at addr.
+func (pm *PeerManager) SourceOf(addr netip.AddrPort) PeerSource {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.sources[addr]
+}
+
+// ConnectPeers records where the given peers came from and dials them in
+// the background, up to maxPeerConns connections. Peers beyond that wait in
+// the candidate pool until a connection slot frees up.
+func (pm *PeerManager) ConnectPeers(peers []Peer, ourPeerID []byte) {
+	pm.mu.Lock()
+	pm.peerID = ourPeerID
+	pm.mu.Unlock()
+
+	pm.addCandidates(peers)
+}
+
+// addCandidates records where the given peers came from and adds those we
+// are not connected to or dialing to the candidate pool.
+func (pm *PeerManager) addCandidates(peers []Peer) {
+	pm.mu.Lock()
+	for _, peer := range peers {
+		pm.sources[peer.Addr] |= peer.Source
+		if len(pm.candidates) >= maxCandidates || pm.dialing[peer.Addr] ||
+			pm.isConnected(peer.Addr) || pm.isCandidate(peer.Addr) {
+			continue
+		}
+		pm.candidates = append(pm.candidates, peer)
+	}
+	pm.mu.Unlock()
+
+	pm.dialCandidates()
+}
+
+// dropCandidates removes the given peers from the candidate pool unless a
+// source other than source reported them too.
+func (pm *PeerManager) dropCandidates(addrs []netip.AddrPort, source PeerSource) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, addr := range addrs {
+		if pm.sources[addr] != source {
+			continue
+		}
+		for i, p := range pm.candidates {
+			if p.Addr == addr {
+				pm.candidates = append(pm.candidates[:i], pm.candidates[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (pm *PeerManager) isCandidate(addr netip.AddrPort) bool {
+	for _, p := range pm.candidates {
+		if p.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// dialCandidates dials candidates while connection slots are free, unless
+// the download is complete.
+func (pm *PeerManager) dialCandidates() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for len(pm.candidates) > 0 && pm.haveCount != len(pm.have) &&
+		len(pm.peers)+len(pm.dialing) < maxPeerConns {
+		peer := pm.candidates[0]
+		pm.candidates = pm.candidates[1:]
+		if pm.dialing[peer.Addr] || pm.isConnected(peer.Addr) {
+			continue
+		}
+		pm.dialing[peer.Addr] = true
+		go pm.connectPeer(peer, pm.peerID)
+	}
+}
+
+func (pm *PeerManager) connectPeer(peer Peer, ourPeerID []byte) {
+	defer func() {
+		pm.mu.Lock()
+		delete(pm.dialing, peer.Addr)
+		pm.mu.Unlock()
+		pm.dialCandidates()
+	}()
+
+	pm.mu.Lock()
+	policy := pm.encryption
+	pm.mu.Unlock()
+
+	peerConn, err := connectAndHandshake(pm.dial, pm.torrent, peer, ourPeerID, policy)
+	if err != nil {
+		fmt.Printf("Handshake failed with %s: %v\n", peer, err)
+		return
+	}
+
+	peerConn.Source = pm.SourceOf(peer.Addr)
+	peerConn.reachable = true
+	pm.startPeer(peerConn)
+}
+
+// startPeer sends a peer whose handshake succeeded our bitfield, allowed
+// fast set and extended handshake, then adds it, starts reading its
+// messages and serving its requests, and sends it our interest. The
+// opening messages go out before anything the peer sends is handled, so
+// they directly follow the handshake.
+func (pm *PeerManager) startPeer(peer *PeerConn) {
+	sent, err := pm.sendBitfield(peer)
+	if err != nil {
+		fmt.Printf("Failed to send bitfield to %s: %v\n", peer.Conn.RemoteAddr(), err)
+		peer.Conn.Close()
+		return
+	}
+	if peer.fast {
+		if err := pm.sendAllowedFast(peer); err != nil {
+			fmt.Printf("Failed to send allowed fast set to %s: %v\n", peer.Conn.RemoteAddr(), err)
+		}
+	}
+	if peer.supportsExtensions {
+		if err := pm.sendExtendedHandshake(peer); err != nil {
+			fmt.Printf("Failed to send extended handshake to %s: %v\n", peer.Conn.RemoteAddr(), err)
+		}
+	}
+
+	// Pieces completed since the bitfield was sent are announced as Have
+	// messages, as they missed the broadcast.
+	pm.mu.Lock()
+	pm.peers = append(pm.peers, peer)
+	for i, have := range pm.have {
+		if have && !hasPiece(sent, uint32(i)) {
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, uint32(i))
+			peer.Send(&Message{ID: MsgHave, Payload: payload})
+		}
+	}
+	pm.mu.Unlock()
+
+	go pm.handlePeer(peer)
+	go pm.serveRequests(peer)
+	go pm.runRequests(peer)
+
+	if pm.IsComplete() {
+		return
+	}
+	if err := peer.Send(NewMessage(MsgInterested)); err != nil {
+		fmt.Printf("Failed to send Interested message to %s: %v\n", peer.Conn.RemoteAddr(), err)
+	}
 }
 
 func (pm *PeerManager) handlePeer(peer *PeerConn) {
 	defer pm.Remove(peer)
 
+	// A bitfield of a torrent with many pieces may be longer than any
+	// piece message.
+	maxLength := uint32(max(maxMessageLength, 1+(len(pm.torrent.Pieces)+7)/8))
 	for {
-		msg, err := ReadMessage(peer.Conn)
+		msg, err := readMessageLimit(peer.Conn, maxLength)
 		if err != nil {
 			fmt.Println("error reading message:", err)
 			return
@@ -349,16 +872,30 @@ func (pm *PeerManager) handlePeer(peer *PeerConn) {
 
 		switch msg.ID {
 		case MsgChoke:
-			peer.Choked = true
+			peer.setChoked(true)
+			pm.handleChoke(peer)
 		case MsgUnchoke:
-			peer.Choked = false
+			peer.setChoked(false)
 			peer.SetUnchoked()
-			go pm.requestPiecesFromPeer(peer)
+			go pm.fillRequests(peer)
+		case MsgInterested:
+			pm.handleInterested(peer, true)
+		case MsgNotInterested:
+			pm.handleInterested(peer, false)
+		case MsgRequest:
+			pm.queueRequest(peer, msg.Payload)
+		case MsgCancel:
+			pm.cancelRequest(peer, msg.Payload)
 		case MsgBitfield:
-			peer.Bitfield = msg.Payload
+			pm.setPeerBitfield(peer, msg.Payload)
+			go pm.fillRequests(peer)
 		case MsgHave:
-			index := binary.BigEndian.Uint32(msg.Payload)
-			fmt.Printf("Peer has piece %d\n", index)
+			if len(msg.Payload) < 4 {
+				fmt.Println("invalid have message payload length")
+				continue
+			}
+			pm.peerHasPiece(peer, binary.BigEndian.Uint32(msg.Payload))
+			go pm.fillRequests(peer)
 		case MsgPiece:
 			if len(msg.Payload) < 8 {
 				fmt.Println("invalid piece message payload length")
@@ -367,48 +904,30 @@ func (pm *PeerManager) handlePeer(peer *PeerConn) {
 			index := binary.BigEndian.Uint32(msg.Payload[0:4])
 			begin := binary.BigEndian.Uint32(msg.Payload[4:8])
 			block := msg.Payload[8:]
+			req := blockRequest{index: index, begin: begin, length: uint32(len(block))}
 
-			if int(index) >= len(pm.torrent.Pieces) {
-				fmt.Printf("invalid piece index %d\n", index)
+			if !pm.validBlock(req) {
+				fmt.Printf("invalid block %d/%d+%d\n", index, begin, len(block))
+				continue
+			}
+			if !pm.requested(peer, req) {
+				fmt.Printf("Ignoring unrequested block %d/%d from %s\n", index, begin, peer.Conn.RemoteAddr())
 				continue
 			}
 
 			pm.handlePieceMessage(index, begin, block, peer)
-
+			pm.blockArrived(peer, req)
+			go pm.fillRequests(peer)
+		case MsgExtended:
+			pm.handleExtended(peer, msg.Payload)
+		case MsgSuggestPiece, MsgHaveAll, MsgHaveNone, MsgRejectRequest, MsgAllowedFast:
+			pm.handleFastMessage(peer, msg)
 		default:
 			fmt.Printf("Received message ID %d\n", msg.ID)
 		}
 	}
 }
 
-func (pm *PeerManager) requestPiecesFromPeer(peer *PeerConn) {
-	for index := uint32(0); index < uint32(len(pm.torrent.Pieces)); index++ {
-		if peer.Choked {
-			return
-		}
-		if !hasPiece(peer.Bitfield, index) {
-			continue
-		}
-
-		pieceLength := pm.torrent.PieceLength
-		if int(index) == len(pm.torrent.Pieces)-1 {
-			pieceLength = pm.torrent.Length - int(index)*pm.torrent.PieceLength
-		}
-
-		for begin := uint32(0); begin < uint32(pieceLength); begin += blockSize {
-			reqLen := blockSize
-			if begin+uint32(reqLen) > uint32(pieceLength) {
-				reqLen = pieceLength - int(begin)
-			}
-			req := NewRequestMessage(index, begin, uint32(reqLen))
-			if err := peer.Send(req); err != nil {
-				fmt.Println("Failed to send request:", err)
-				return
-			}
-		}
-	}
-}
-
 func hasPiece(bitfield []byte, index uint32) bool {
 	byteIndex := index / 8
 	bitIndex := index % 8
@@ -417,67 +936,3 @@ func hasPiece(bitfield []byte, index uint32) bool {
 	}
 	return bitfield[byteIndex]&(1<<(7-bitIndex)) != 0
 }
-
-func DiscoverPeers(torrent Torrent, peerID []byte) ([]string, error) {
-	base, err := url.Parse(torrent.TrackerURL)
-	if err != nil {
-		return nil, fmt.Errorf("invalid tracker URL: %v", err)
-	}
-
-	params := url.Values{
-		"peer_id":    {string(peerID)},
-		"port":       {"6881"},
-		"uploaded":   {"0"},
-		"downloaded": {"0"},
-		"left":       {strconv.Itoa(torrent.Length)},
-		"compact":    {"1"},
-		"event":      {"started"},
-	}
-
-	escapedInfoHash := ""
-	for _, b := range torrent.InfoHash {
-		escapedInfoHash += fmt.Sprintf("%%%02X", b)
-	}
-
-	query := "info_hash=" + escapedInfoHash + "&" + params.Encode()
-	finalURL := base.Scheme + "://" + base.Host + base.Path + "?" + query
-
-	resp, err := http.Get(finalURL)
-	if err != nil {
-		return nil, fmt.Errorf("tracker request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	decoded, err := bencode.Decode(body)
-	if err != nil {
-		return nil, err
-	}
-
-	dict, ok := decoded.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("tracker response invalid format")
-	}
-	peersData, ok := dict["peers"]
-	if !ok {
-		return nil, fmt.Errorf("tracker response missing peers")
-	}
-
-	peersBinary, ok := peersData.(string)
-	if !ok {
-		return nil, fmt.Errorf("tracker peers not a string")
-	}
-
-	var peers []string
-	peerBytes := []byte(peersBinary)
-
-	for i := 0; i+6 <= len(peerBytes); i += 6 {
-		ip := net.IP(peerBytes[i : i+4])
-		port := binary.BigEndian.Uint16(peerBytes[i+4 : i+6])
-		peers = append(peers, fmt.Sprintf("%s:%d", ip.String(), port))
-	}
-
-	return peers, nil
-
-}
@@ -0,0 +1,257 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
+)
+
+const (
+	// pexInterval is how often we send PEX messages, the most BEP 11
+	// allows. Messages arriving at less than half of it are ignored.
+	pexInterval = time.Minute
+	// maxPEXPeers bounds the added and dropped lists of every PEX
+	// message, both those we send and those we accept.
+	maxPEXPeers       = 50
+	maxPEXMessageSize = 8192
+
+	pexFlagSeed      = 0x02
+	pexFlagReachable = 0x10
+)
+
+type pexState struct {
+	// sent is the set of peers the peer has been told about.
+	sent map[netip.AddrPort]bool
+	// received is when the peer's last PEX message was accepted.
+	received time.Time
+}
+
+type pexPeer struct {
+	addr  netip.AddrPort
+	flags byte
+}
+
+// encodePEX returns the bencoded body of a ut_pex message.
+func encodePEX(added []pexPeer, dropped []netip.AddrPort) ([]byte, error) {
+	var added4, flags4, added6, flags6, dropped4, dropped6 []byte
+	for _, p := range added {
+		if p.addr.Addr().Is4() {
+			added4 = appendCompactAddr(added4, p.addr)
+			flags4 = append(flags4, p.flags)
+		} else {
+			added6 = appendCompactAddr(added6, p.addr)
+			flags6 = append(flags6, p.flags)
+		}
+	}
+	for _, addr := range dropped {
+		if addr.Addr().Is4() {
+			dropped4 = appendCompactAddr(dropped4, addr)
+		} else {
+			dropped6 = appendCompactAddr(dropped6, addr)
+		}
+	}
+	return bencode.Encode(map[string]interface{}{
+		"added":    string(added4),
+		"added.f":  string(flags4),
+		"dropped":  string(dropped4),
+		"added6":   string(added6),
+		"added6.f": string(flags6),
+		"dropped6": string(dropped6),
+	})
+}
+
+func appendCompactAddr(b []byte, addr netip.AddrPort) []byte {
+	b = append(b, addr.Addr().AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+// decodePEX parses a ut_pex message, keeping at most maxPEXPeers added and
+// dropped peers.
+func decodePEX(data []byte) ([]pexPeer, []netip.AddrPort, error) {
+	decoded, err := bencode.Decode(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("PEX message is not a dictionary")
+	}
+	field := func(key string) []byte {
+		s, _ := dict[key].(string)
+		return []byte(s)
+	}
+
+	var added []pexPeer
+	addPeers := func(peers []Peer, flags []byte) {
+		for i, p := range peers {
+			if len(added) == maxPEXPeers {
+				return
+			}
+			pp := pexPeer{addr: p.Addr}
+			if i < len(flags) {
+				pp.flags = flags[i]
+			}
+			added = append(added, pp)
+		}
+	}
+	addPeers(parseCompactPeers(field("added")), field("added.f"))
+	addPeers(parseCompactPeers6(field("added6")), field("added6.f"))
+
+	var dropped []netip.AddrPort
+	for _, p := range append(parseCompactPeers(field("dropped")), parseCompactPeers6(field("dropped6"))...) {
+		if len(dropped) == maxPEXPeers {
+			break
+		}
+		dropped = append(dropped, p.Addr)
+	}
+	return added, dropped, nil
+}
+
+// pexExtension implements ut_pex (BEP 11).
+type pexExtension struct {
+	pm *PeerManager
+}
+
+func (e *pexExtension) Name() string {
+	return "ut_pex"
+}
+
+func (e *pexExtension) PeerSupports(peer *PeerConn) {
+	go e.pm.runPEX(peer)
+}
+
+func (e *pexExtension) HandleMessage(peer *PeerConn, payload []byte) error {
+	return e.pm.handlePEX(peer, payload)
+}
+
+// runPEX sends the peer the changes to our peer list every pexInterval
+// until it is removed.
+func (pm *PeerManager) runPEX(peer *PeerConn) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := pm.sendPEX(peer); err != nil {
+			fmt.Printf("Failed to send PEX message to %s: %v\n", peer.Conn.RemoteAddr(), err)
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-peer.closeC:
+			return
+		}
+	}
+}
+
+// sendPEX tells the peer about the peers we connected to and dropped since
+// the last message, if any.
+func (pm *PeerManager) sendPEX(peer *PeerConn) error {
+	if _, ok := peer.extensionID("ut_pex"); !ok {
+		return nil
+	}
+
+	current := pm.pexPeers(peer)
+	var (
+		added   []pexPeer
+		dropped []netip.AddrPort
+	)
+	for addr, flags := range current {
+		if !peer.pex.sent[addr] && len(added) < maxPEXPeers {
+			added = append(added, pexPeer{addr: addr, flags: flags})
+		}
+	}
+	for addr := range peer.pex.sent {
+		if _, ok := current[addr]; !ok && len(dropped) < maxPEXPeers {
+			dropped = append(dropped, addr)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	payload, err := encodePEX(added, dropped)
+	if err != nil {
+		return err
+	}
+	if err := peer.SendExtended("ut_pex", payload); err != nil {
+		return err
+	}
+
+	if peer.pex.sent == nil {
+		peer.pex.sent = make(map[netip.AddrPort]bool)
+	}
+	for _, p := range added {
+		peer.pex.sent[p.addr] = true
+	}
+	for _, addr := range dropped {
+		delete(peer.pex.sent, addr)
+	}
+	return nil
+}
+
+// pexPeers returns the connected peers worth sharing with exclude, with
+// their PEX flags.
+func (pm *PeerManager) pexPeers(exclude *PeerConn) map[netip.AddrPort]byte {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	peers := make(map[netip.AddrPort]byte)
+	for _, p := range pm.peers {
+		if p == exclude || !p.addr.IsValid() {
+			continue
+		}
+		var flags byte
+		if p.reachable {
+			flags |= pexFlagReachable
+		}
+		p.mu.Lock()
+		if pm.isSeedLocked(p) {
+			flags |= pexFlagSeed
+		}
+		p.mu.Unlock()
+		peers[p.addr] = flags
+	}
+	return peers
+}
+
+// isSeedLocked reports whether the peer has every piece. pm.mu and p.mu
+// must be held.
+func (pm *PeerManager) isSeedLocked(p *PeerConn) bool {
+	for index := range pm.torrent.Pieces {
+		if !hasPiece(p.Bitfield, uint32(index)) {
+			return false
+		}
+	}
+	return true
+}
+
+// handlePEX adds the peers of a ut_pex message to the candidate pool and
+// forgets the dropped ones we learned only through PEX.
+func (pm *PeerManager) handlePEX(peer *PeerConn, data []byte) error {
+	if len(data) > maxPEXMessageSize {
+		return fmt.Errorf("message of %d bytes too big", len(data))
+	}
+	now := time.Now()
+	if !peer.pex.received.IsZero() && now.Sub(peer.pex.received) < pexInterval/2 {
+		return fmt.Errorf("message sent too soon")
+	}
+	added, dropped, err := decodePEX(data)
+	if err != nil {
+		return err
+	}
+	peer.pex.received = now
+
+	var peers []Peer
+	for _, p := range added {
+		if p.addr.Port() == 0 || !p.addr.Addr().IsValid() || p.addr.Addr().IsUnspecified() {
+			continue
+		}
+		peers = append(peers, Peer{Addr: p.addr, Source: PeerSourcePEX})
+	}
+	pm.dropCandidates(dropped, PeerSourcePEX)
+	pm.addCandidates(peers)
+	return nil
+}
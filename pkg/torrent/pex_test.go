@@ -0,0 +1,214 @@
+package torrent
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
+)
+
+// newTestPeerManager returns a PeerManager for a one-piece torrent that
+// has the piece already, so candidates are kept instead of dialed.
+func newTestPeerManager(t *testing.T) *PeerManager {
+	t.Helper()
+	torrent := &Torrent{Length: 4, PieceLength: 4, Pieces: make([][]byte, 1)}
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.markHave(0)
+	return pm
+}
+
+// newPipePeer connects a peer at addr to pm over an in-memory pipe and
+// returns the peer's end of it.
+func newPipePeer(t *testing.T, pm *PeerManager, addr netip.AddrPort) (*PeerConn, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+
+	peer := newPeerConn(local, [20]byte{}, addr)
+	peer.supportsExtensions = true
+	pm.Add(peer)
+	go pm.handlePeer(peer)
+	return peer, remote
+}
+
+func readExtended(t *testing.T, conn net.Conn) (byte, map[string]interface{}) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil || msg.ID != MsgExtended {
+			continue
+		}
+		decoded, err := bencode.Decode(msg.Payload[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		dict, _ := decoded.(map[string]interface{})
+		return msg.Payload[0], dict
+	}
+}
+
+func extendedMessage(t *testing.T, id byte, v interface{}) *Message {
+	t.Helper()
+	payload, err := bencode.Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Message{ID: MsgExtended, Payload: append([]byte{id}, payload...)}
+}
+
+func TestHandshakeReservedBits(t *testing.T) {
+	h := Handshake{PeerID: make([]byte, 20), InfoHash: [20]byte{1}}
+	h.Reserved[reservedExtendedByte] |= reservedExtendedBit
+
+	got := HandshakeFromBytes(h.ToBytes())
+	if got == nil || !got.SupportsExtensions() || got.InfoHash != h.InfoHash {
+		t.Fatalf("got %+v", got)
+	}
+	if plain := (&Handshake{PeerID: make([]byte, 20)}).ToBytes(); HandshakeFromBytes(plain).SupportsExtensions() {
+		t.Error("extensions advertised without the reserved bit")
+	}
+}
+
+func TestPEXRoundTrip(t *testing.T) {
+	added := []pexPeer{
+		{addr: netip.MustParseAddrPort("10.0.0.1:6881"), flags: pexFlagReachable},
+		{addr: netip.MustParseAddrPort("[2001:db8::1]:51413"), flags: pexFlagSeed},
+	}
+	dropped := []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.2:6881"),
+		netip.MustParseAddrPort("[2001:db8::2]:6881"),
+	}
+
+	data, err := encodePEX(added, dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotAdded, gotDropped, err := decodePEX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotAdded) != 2 || gotAdded[0] != added[0] || gotAdded[1] != added[1] {
+		t.Errorf("got added %v", gotAdded)
+	}
+	if len(gotDropped) != 2 || gotDropped[0] != dropped[0] || gotDropped[1] != dropped[1] {
+		t.Errorf("got dropped %v", gotDropped)
+	}
+}
+
+func TestPEXFlags(t *testing.T) {
+	pm := newTestPeerManager(t)
+	dialed, _ := newPipePeer(t, pm, netip.MustParseAddrPort("10.0.0.1:6881"))
+	incoming, _ := newPipePeer(t, pm, netip.MustParseAddrPort("10.0.0.2:6881"))
+	seed, _ := newPipePeer(t, pm, netip.MustParseAddrPort("10.0.0.3:6881"))
+	pm.mu.Lock()
+	dialed.reachable = true
+	pm.mu.Unlock()
+	pm.setPeerBitfield(seed, []byte{0x80})
+
+	peers := pm.pexPeers(nil)
+	if got := peers[dialed.addr]; got != pexFlagReachable {
+		t.Errorf("dialed peer has flags %#x, want reachable", got)
+	}
+	if got := peers[incoming.addr]; got != 0 {
+		t.Errorf("incoming peer has flags %#x, want none", got)
+	}
+	if got := peers[seed.addr]; got != pexFlagSeed {
+		t.Errorf("seed has flags %#x, want seed", got)
+	}
+}
+
+func TestPEXExchange(t *testing.T) {
+	pm := newTestPeerManager(t)
+	other := netip.MustParseAddrPort("10.0.0.5:6881")
+	otherPeer, _ := newPipePeer(t, pm, other)
+	pm.mu.Lock()
+	otherPeer.reachable = true
+	pm.mu.Unlock()
+	_, remote := newPipePeer(t, pm, netip.MustParseAddrPort("10.0.0.6:6881"))
+
+	if _, err := remote.Write(extendedMessage(t, extHandshakeID, map[string]interface{}{
+		"m": map[string]interface{}{"ut_pex": 7},
+	}).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	// We tell the peer about the other connected peer, using its ID.
+	id, dict := readExtended(t, remote)
+	if id != 7 {
+		t.Fatalf("got extended message ID %d, want 7", id)
+	}
+	added, _ := dict["added"].(string)
+	flags, _ := dict["added.f"].(string)
+	if peers := parseCompactPeers([]byte(added)); len(peers) != 1 || peers[0].Addr != other || flags != string([]byte{pexFlagReachable}) {
+		t.Errorf("got added %v flags %q", peers, flags)
+	}
+
+	// The peers it tells us about become candidates. ut_pex is the first
+	// registered extension, so it is sent to us with ID 1.
+	learned := netip.MustParseAddrPort("10.0.0.9:6881")
+	data, err := encodePEX([]pexPeer{{addr: learned}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Write((&Message{ID: MsgExtended, Payload: append([]byte{1}, data...)}).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pm.SourceOf(learned) != PeerSourcePEX {
+		if time.Now().After(deadline) {
+			t.Fatal("PEX peer not added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPEXLimits(t *testing.T) {
+	pm := newTestPeerManager(t)
+	peer := newPeerConn(nil, [20]byte{}, netip.MustParseAddrPort("10.0.0.1:6881"))
+
+	var added []pexPeer
+	for i := 0; i < maxPEXPeers+10; i++ {
+		added = append(added, pexPeer{addr: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 1, 0, byte(i)}), 6881)})
+	}
+	data, err := encodePEX(added, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.handlePEX(peer, data)
+	if len(pm.candidates) != maxPEXPeers {
+		t.Errorf("got %d candidates, want %d", len(pm.candidates), maxPEXPeers)
+	}
+
+	// A second message within the interval is ignored.
+	extra := netip.MustParseAddrPort("10.2.0.1:6881")
+	data, err = encodePEX([]pexPeer{{addr: extra}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.handlePEX(peer, data)
+	if pm.SourceOf(extra) != 0 {
+		t.Error("PEX message accepted too soon")
+	}
+
+	// Dropped peers learned only through PEX leave the pool; those a
+	// tracker reported too stay.
+	pm.ConnectPeers([]Peer{{Addr: added[1].addr, Source: PeerSourceTracker}}, nil)
+	peer.pex.received = time.Now().Add(-pexInterval)
+	data, err = encodePEX(nil, []netip.AddrPort{added[0].addr, added[1].addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.handlePEX(peer, data)
+	if pm.isCandidate(added[0].addr) || !pm.isCandidate(added[1].addr) {
+		t.Error("dropped peers not handled")
+	}
+}
@@ -0,0 +1,161 @@
+package torrent
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// randomFirstPieces is the number of pieces picked at random before
+// switching to rarest first, so a new peer quickly has something to trade.
+const randomFirstPieces = 4
+
+// pieceBuckets groups the pieces we miss by availability, so the rarest
+// are found without sorting. Pieces move between buckets as peers come,
+// go and announce pieces.
+type pieceBuckets struct {
+	buckets [][]uint32
+	// pos is each piece's position in its bucket; -1 once we have it.
+	pos []int
+}
+
+func newPieceBuckets(n int) *pieceBuckets {
+	b := &pieceBuckets{buckets: [][]uint32{make([]uint32, n)}, pos: make([]int, n)}
+	for i := range b.pos {
+		b.buckets[0][i] = uint32(i)
+		b.pos[i] = i
+	}
+	return b
+}
+
+// move moves a piece from the bucket from to the bucket to.
+func (b *pieceBuckets) move(index uint32, from, to int) {
+	if b.pos[index] < 0 {
+		return
+	}
+	b.remove(index, from)
+	for len(b.buckets) <= to {
+		b.buckets = append(b.buckets, nil)
+	}
+	b.pos[index] = len(b.buckets[to])
+	b.buckets[to] = append(b.buckets[to], index)
+}
+
+// remove takes a piece out of the bucket from.
+func (b *pieceBuckets) remove(index uint32, from int) {
+	i := b.pos[index]
+	if i < 0 {
+		return
+	}
+	bucket := b.buckets[from]
+	last := bucket[len(bucket)-1]
+	bucket[i] = last
+	b.pos[last] = i
+	b.buckets[from] = bucket[:len(bucket)-1]
+	b.pos[index] = -1
+}
+
+// setPeerBitfield replaces the pieces the peer has and updates the swarm
+// availability to match.
+func (pm *PeerManager) setPeerBitfield(peer *PeerConn, bitfield []byte) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	pm.countPiecesLocked(peer.Bitfield, -1)
+	peer.Bitfield = bitfield
+	pm.countPiecesLocked(bitfield, 1)
+}
+
+// peerHasPiece records a Have message from the peer.
+func (pm *PeerManager) peerHasPiece(peer *PeerConn, index uint32) {
+	if int(index) >= len(pm.torrent.Pieces) {
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if hasPiece(peer.Bitfield, index) {
+		return
+	}
+	if size := (len(pm.torrent.Pieces) + 7) / 8; len(peer.Bitfield) < size {
+		peer.Bitfield = append(peer.Bitfield, make([]byte, size-len(peer.Bitfield))...)
+	}
+	peer.Bitfield[index/8] |= 1 << (7 - index%8)
+	pm.addAvailabilityLocked(index, 1)
+}
+
+// countPiecesLocked adds delta to the availability of every piece in the
+// bitfield. pm.mu must be held.
+func (pm *PeerManager) countPiecesLocked(bitfield []byte, delta int) {
+	for index := range pm.availability {
+		if hasPiece(bitfield, uint32(index)) {
+			pm.addAvailabilityLocked(uint32(index), delta)
+		}
+	}
+}
+
+// addAvailabilityLocked adds delta to the availability of a piece. pm.mu
+// must be held.
+func (pm *PeerManager) addAvailabilityLocked(index uint32, delta int) {
+	from := pm.availability[index]
+	pm.availability[index] += delta
+	pm.buckets.move(index, from, pm.availability[index])
+}
+
+// visitPiecesLocked calls visit with the pieces we miss in the order they
+// are requested, until visit returns false: started pieces first so they
+// complete, then random pieces until we have randomFirstPieces, then the
+// rarest pieces. The walk through equally rare pieces starts at a random
+// one so peers do not all pick the same. pm.mu must be held.
+func (pm *PeerManager) visitPiecesLocked(visit func(index uint32) bool) {
+	started := make(map[uint32]bool)
+	for index := range pm.pieceBuffers {
+		started[index] = true
+	}
+	for req := range pm.pending {
+		started[req.index] = true
+	}
+	first := make([]uint32, 0, len(started))
+	for index := range started {
+		if !pm.have[index] {
+			first = append(first, index)
+		}
+	}
+	sort.Slice(first, func(i, j int) bool {
+		return pm.availability[first[i]] < pm.availability[first[j]]
+	})
+	for _, index := range first {
+		if !visit(index) {
+			return
+		}
+	}
+
+	// walk visits the first n pieces of at from a random start, wrapping
+	// around, skipping those we have or already started.
+	walk := func(n int, at func(i int) uint32) bool {
+		if n == 0 {
+			return true
+		}
+		start := rand.Intn(n)
+		for i := 0; i < n; i++ {
+			index := at((start + i) % n)
+			if !pm.have[index] && !started[index] && !visit(index) {
+				return false
+			}
+		}
+		return true
+	}
+	if pm.haveCount < randomFirstPieces {
+		walk(len(pm.have), func(i int) uint32 { return uint32(i) })
+		return
+	}
+	for _, bucket := range pm.buckets.buckets {
+		if !walk(len(bucket), func(i int) uint32 { return bucket[i] }) {
+			return
+		}
+	}
+}
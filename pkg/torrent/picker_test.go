@@ -0,0 +1,148 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func availability(pm *PeerManager) []int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return append([]int(nil), pm.availability...)
+}
+
+func waitAvailability(t *testing.T, pm *PeerManager, want []int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := availability(pm)
+		equal := len(got) == len(want)
+		for i := range want {
+			equal = equal && got[i] == want[i]
+		}
+		if equal {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("availability %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 4*blockSize, blockSize)
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, remoteA := newPipePeer(t, pm, netip.MustParseAddrPort("10.0.0.1:6881"))
+	_, remoteB := newPipePeer(t, pm, netip.MustParseAddrPort("10.0.0.2:6881"))
+	go messages(remoteA)
+	go messages(remoteB)
+
+	remoteA.Write((&Message{ID: MsgBitfield, Payload: []byte{0xc0}}).Serialize())
+	remoteB.Write((&Message{ID: MsgBitfield, Payload: []byte{0x60}}).Serialize())
+	waitAvailability(t, pm, []int{1, 2, 1, 0})
+
+	have := make([]byte, 4)
+	binary.BigEndian.PutUint32(have, 3)
+	remoteA.Write((&Message{ID: MsgHave, Payload: have}).Serialize())
+	// A repeated Have does not count twice.
+	remoteA.Write((&Message{ID: MsgHave, Payload: have}).Serialize())
+	waitAvailability(t, pm, []int{1, 2, 1, 1})
+
+	pm.Remove(a)
+	waitAvailability(t, pm, []int{0, 1, 1, 0})
+}
+
+func pieceOrder(pm *PeerManager) []uint32 {
+	var order []uint32
+	pm.visitPiecesLocked(func(index uint32) bool {
+		order = append(order, index)
+		return true
+	})
+	return order
+}
+
+func TestPieceOrder(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 10*blockSize, blockSize)
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, n := range []int{1, 5, 3, 2, 4, 2, 9, 9, 9, 9} {
+		pm.addAvailabilityLocked(uint32(index), n)
+	}
+	pm.pieceBuffers[4] = &PieceBuffer{}
+
+	// Until randomFirstPieces are complete the order is random, but pieces
+	// already started come first.
+	rarestFirst := 0
+	for i := 0; i < 20; i++ {
+		order := pieceOrder(pm)
+		if len(order) != 10 || order[0] != 4 {
+			t.Fatalf("order %v, want all pieces starting with 4", order)
+		}
+		if order[1] == 0 {
+			rarestFirst++
+		}
+	}
+	if rarestFirst == 20 {
+		t.Error("first pieces not picked at random")
+	}
+
+	for _, index := range []uint32{6, 7, 8, 9} {
+		pm.markHave(index)
+	}
+	pm.pending[blockRequest{index: 2, length: blockSize}] = &PeerConn{}
+	order := pieceOrder(pm)
+	if len(order) != 6 || order[0] != 2 || order[1] != 4 || order[2] != 0 ||
+		order[3]+order[4] != 8 || order[5] != 1 {
+		t.Errorf("order %v, want started pieces 2 and 4, then 0, 3 and 5, then 1", order)
+	}
+
+	// The walk stops once the visitor has enough.
+	visited := 0
+	pm.visitPiecesLocked(func(index uint32) bool {
+		visited++
+		return visited < 3
+	})
+	if visited != 3 {
+		t.Errorf("visited %d pieces after asking to stop at 3", visited)
+	}
+}
+
+func TestPieceBuckets(t *testing.T) {
+	b := newPieceBuckets(4)
+	b.move(1, 0, 2)
+	b.move(3, 0, 1)
+	b.move(1, 2, 1)
+	b.remove(0, 0)
+	if len(b.buckets[0]) != 1 || b.buckets[0][0] != 2 ||
+		len(b.buckets[1]) != 2 || len(b.buckets[2]) != 0 {
+		t.Fatalf("buckets %v", b.buckets)
+	}
+	for index, pos := range b.pos {
+		if index == 0 {
+			if pos != -1 {
+				t.Errorf("removed piece at %d", pos)
+			}
+			continue
+		}
+		found := false
+		for _, bucket := range b.buckets {
+			found = found || pos < len(bucket) && bucket[pos] == uint32(index)
+		}
+		if !found {
+			t.Errorf("piece %d not at its position %d", index, pos)
+		}
+	}
+	// Pieces we have stay out of the buckets.
+	b.move(0, 0, 1)
+	if len(b.buckets[1]) != 2 {
+		t.Errorf("removed piece moved into bucket %v", b.buckets[1])
+	}
+}
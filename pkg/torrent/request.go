@@ -0,0 +1,301 @@
+package torrent
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// A peer's request window starts at initialRequestWindow and is then
+	// sized to hold requestQueueTime worth of its measured throughput,
+	// within minRequestWindow and the peer's reqq.
+	initialRequestWindow = 4
+	minRequestWindow     = 2
+	requestQueueTime     = 3 * time.Second
+	// defaultPeerReqq is the reqq assumed for peers that do not send one.
+	defaultPeerReqq = 250
+
+	defaultRequestTimeout = 30 * time.Second
+	requestTickInterval   = time.Second
+	// failedRetryDelay is how long a peer is not asked again for a block
+	// it rejected or let time out, so other peers get it first but it is
+	// still retried when no one else has it.
+	failedRetryDelay = 10 * time.Second
+)
+
+// fillRequests requests blocks from the peer until its window is full.
+func (pm *PeerManager) fillRequests(peer *PeerConn) {
+	if pm.IsComplete() {
+		return
+	}
+
+	pm.mu.Lock()
+	peer.mu.Lock()
+	reqs := pm.pickBlocksLocked(peer, time.Now())
+	peer.mu.Unlock()
+	pm.mu.Unlock()
+
+	for _, req := range reqs {
+		if err := peer.Send(NewRequestMessage(req.index, req.begin, req.length)); err != nil {
+			fmt.Printf("Failed to send request to %s: %v\n", peer.Conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// fillOthers lets every peer but except request blocks, e.g. after blocks
+// were taken back from except.
+func (pm *PeerManager) fillOthers(except *PeerConn) {
+	pm.mu.Lock()
+	peers := append([]*PeerConn(nil), pm.peers...)
+	pm.mu.Unlock()
+
+	for _, p := range peers {
+		if p != except {
+			go pm.fillRequests(p)
+		}
+	}
+}
+
+// pickBlocksLocked assigns blocks to the peer for its free window slots:
+// released blocks first, then the pieces it suggested, then the others in
+// the picker's order. A choked peer is only asked for its allowed fast pieces.
+// pm.mu and peer.mu must be held.
+func (pm *PeerManager) pickBlocksLocked(peer *PeerConn, now time.Time) []blockRequest {
+	free := peer.window - len(peer.outstanding)
+	if free <= 0 {
+		return nil
+	}
+	if peer.outstanding == nil {
+		peer.outstanding = make(map[blockRequest]time.Time)
+	}
+
+	canRequest := func(index uint32) bool {
+		return int(index) < len(pm.have) && !pm.have[index] && hasPiece(peer.Bitfield, index) &&
+			(!peer.Choked || peer.allowedFast[index])
+	}
+	var reqs []blockRequest
+	take := func(req blockRequest) bool {
+		if failedAt, ok := peer.failed[req]; ok {
+			if now.Sub(failedAt) < failedRetryDelay {
+				return false
+			}
+			delete(peer.failed, req)
+		}
+		if pm.pending[req] != nil || pm.blockReceivedLocked(req) {
+			return false
+		}
+		pm.pending[req] = peer
+		peer.outstanding[req] = now
+		reqs = append(reqs, req)
+		free--
+		return true
+	}
+
+	released := pm.released[:0]
+	for _, req := range pm.released {
+		if free > 0 && canRequest(req.index) && take(req) {
+			continue
+		}
+		if pm.pending[req] == nil && !pm.have[req.index] {
+			released = append(released, req)
+		}
+	}
+	pm.released = released
+
+	takePiece := func(index uint32) bool {
+		if canRequest(index) {
+			size := uint32(pm.torrent.PieceSize(index))
+			for begin := uint32(0); begin < size && free > 0; begin += blockSize {
+				take(blockRequest{index: index, begin: begin, length: min(blockSize, size-begin)})
+			}
+		}
+		return free > 0
+	}
+	for _, index := range peer.suggested {
+		if !takePiece(index) {
+			return reqs
+		}
+	}
+	if free > 0 {
+		pm.visitPiecesLocked(takePiece)
+	}
+	return reqs
+}
+
+// validBlock reports whether req lies within one of the torrent's pieces.
+func (pm *PeerManager) validBlock(req blockRequest) bool {
+	return int(req.index) < len(pm.torrent.Pieces) && req.length > 0 &&
+		int64(req.begin)+int64(req.length) <= int64(pm.torrent.PieceSize(req.index))
+}
+
+// requested reports whether the block was asked of the peer, or of any
+// peer after being taken back from it.
+func (pm *PeerManager) requested(peer *PeerConn, req blockRequest) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	_, ok := peer.outstanding[req]
+	return ok || pm.pending[req] != nil
+}
+
+// blockReceivedLocked reports whether the block is already in its piece
+// buffer. pm.mu must be held.
+func (pm *PeerManager) blockReceivedLocked(req blockRequest) bool {
+	pb := pm.pieceBuffers[req.index]
+	if pb == nil {
+		return false
+	}
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	return pb.bitmap[req.begin/blockSize]
+}
+
+// blockArrived records that the peer sent a block. A block another peer
+// was asked for since is cancelled there.
+func (pm *PeerManager) blockArrived(peer *PeerConn, req blockRequest) {
+	pm.mu.Lock()
+	other := pm.pending[req]
+	delete(pm.pending, req)
+	pm.mu.Unlock()
+
+	peer.mu.Lock()
+	delete(peer.outstanding, req)
+	peer.mu.Unlock()
+
+	if other != nil && other != peer {
+		other.mu.Lock()
+		delete(other.outstanding, req)
+		other.mu.Unlock()
+		other.Send(NewCancelMessage(req.index, req.begin, req.length))
+	}
+}
+
+// releaseRequests takes blocks back from the peer so other peers are asked
+// for them, cancelling them at the peer if cancel is set.
+func (pm *PeerManager) releaseRequests(peer *PeerConn, reqs []blockRequest, cancel bool) {
+	if len(reqs) == 0 {
+		return
+	}
+
+	pm.mu.Lock()
+	peer.mu.Lock()
+	for _, req := range reqs {
+		delete(peer.outstanding, req)
+		if pm.pending[req] == peer {
+			delete(pm.pending, req)
+			pm.released = append(pm.released, req)
+		}
+	}
+	peer.mu.Unlock()
+	pm.mu.Unlock()
+
+	if cancel {
+		for _, req := range reqs {
+			if err := peer.Send(NewCancelMessage(req.index, req.begin, req.length)); err != nil {
+				break
+			}
+		}
+	}
+	pm.fillOthers(peer)
+}
+
+// handleChoke takes back the requests the peer dropped by choking us.
+// Peers using the Fast Extension keep requests queued until they reject
+// them, so those are cancelled, except for allowed fast pieces.
+func (pm *PeerManager) handleChoke(peer *PeerConn) {
+	peer.mu.Lock()
+	var dropped []blockRequest
+	for req := range peer.outstanding {
+		if !peer.fast || !peer.allowedFast[req.index] {
+			dropped = append(dropped, req)
+		}
+	}
+	peer.mu.Unlock()
+
+	pm.releaseRequests(peer, dropped, peer.fast)
+}
+
+// handleReject asks other peers for a block the peer rejected.
+func (pm *PeerManager) handleReject(from *PeerConn, req blockRequest) {
+	from.mu.Lock()
+	if _, ok := from.outstanding[req]; !ok {
+		from.mu.Unlock()
+		return
+	}
+	if from.failed == nil {
+		from.failed = make(map[blockRequest]time.Time)
+	}
+	from.failed[req] = time.Now()
+	from.mu.Unlock()
+
+	pm.releaseRequests(from, []blockRequest{req}, false)
+}
+
+// runRequests adapts the peer's request window to its throughput, re-issues
+// requests that time out to other peers and tops up its requests, until
+// the peer is removed.
+func (pm *PeerManager) runRequests(peer *PeerConn) {
+	ticker := time.NewTicker(requestTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			pm.checkRequests(peer, now)
+			pm.fillRequests(peer)
+		case <-peer.closeC:
+			return
+		}
+	}
+}
+
+func (pm *PeerManager) checkRequests(peer *PeerConn, now time.Time) {
+	pm.mu.Lock()
+	timeout := pm.requestTimeout
+	pm.mu.Unlock()
+
+	downloaded := peer.downloaded.Load()
+	peer.mu.Lock()
+	limit := defaultPeerReqq
+	if peer.handshake != nil && peer.handshake.Reqq > 0 {
+		limit = peer.handshake.Reqq
+	}
+	limit = min(limit, maxQueuedRequests)
+	if !peer.lastRateCheck.IsZero() && (len(peer.outstanding) > 0 || downloaded > peer.lastRateBytes) {
+		rate := float64(downloaded-peer.lastRateBytes) / now.Sub(peer.lastRateCheck).Seconds()
+		peer.window = int(rate * requestQueueTime.Seconds() / blockSize)
+	}
+	peer.window = min(max(peer.window, minRequestWindow), limit)
+	peer.lastRateCheck, peer.lastRateBytes = now, downloaded
+
+	var expired []blockRequest
+	for req, sent := range peer.outstanding {
+		if now.Sub(sent) >= timeout {
+			expired = append(expired, req)
+		}
+	}
+	if len(expired) > 0 {
+		// A peer that stalls gets the smallest window until it delivers
+		// again.
+		peer.window = minRequestWindow
+		if peer.failed == nil {
+			peer.failed = make(map[blockRequest]time.Time)
+		}
+		for _, req := range expired {
+			peer.failed[req] = now
+		}
+	}
+	for req, failedAt := range peer.failed {
+		if now.Sub(failedAt) >= failedRetryDelay {
+			delete(peer.failed, req)
+		}
+	}
+	peer.mu.Unlock()
+
+	if len(expired) > 0 {
+		fmt.Printf("%d requests to %s timed out\n", len(expired), peer.Conn.RemoteAddr())
+		pm.releaseRequests(peer, expired, true)
+	}
+}
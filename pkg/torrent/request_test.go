@@ -0,0 +1,262 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// messages reads the messages arriving on conn into a channel.
+func messages(conn net.Conn) <-chan *Message {
+	c := make(chan *Message, 1000)
+	go func() {
+		defer close(c)
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg != nil {
+				c <- msg
+			}
+		}
+	}()
+	return c
+}
+
+func nextMessage(t *testing.T, c <-chan *Message, id uint8) *Message {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c:
+			if !ok {
+				t.Fatal("connection closed")
+			}
+			if msg.ID == id {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no message %d", id)
+		}
+	}
+}
+
+// newSeedingPeer connects a peer that has every piece and unchokes us.
+func newSeedingPeer(t *testing.T, pm *PeerManager, n int) (*PeerConn, <-chan *Message) {
+	t.Helper()
+	addr := netip.MustParseAddrPort(fmt.Sprintf("10.0.0.%d:6881", n))
+	peer, remote := newPipePeer(t, pm, addr)
+	msgs := messages(remote)
+	bitfield := make([]byte, (len(pm.torrent.Pieces)+7)/8)
+	for i := range bitfield {
+		bitfield[i] = 0xff
+	}
+	pm.setPeerBitfield(peer, bitfield)
+	peer.setChoked(false)
+	return peer, msgs
+}
+
+func outstanding(peer *PeerConn) int {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return len(peer.outstanding)
+}
+
+func TestRequestWindow(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 8*blockSize, blockSize)
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, msgs := newSeedingPeer(t, pm, 1)
+
+	pm.fillRequests(peer)
+	seen := make(map[blockRequest]bool)
+	for i := 0; i < initialRequestWindow; i++ {
+		req, _ := parseBlockRequest(nextMessage(t, msgs, MsgRequest).Payload)
+		if seen[req] || req.begin != 0 || req.length != blockSize {
+			t.Errorf("request %d: got %v", i, req)
+		}
+		seen[req] = true
+	}
+	pm.fillRequests(peer)
+	if n := outstanding(peer); n != initialRequestWindow {
+		t.Errorf("%d requests outstanding, want %d", n, initialRequestWindow)
+	}
+
+	// The window follows the throughput, up to the peer's reqq.
+	now := time.Now()
+	peer.mu.Lock()
+	peer.lastRateCheck = now.Add(-time.Second)
+	peer.mu.Unlock()
+	peer.downloaded.Add(10 * blockSize)
+	pm.checkRequests(peer, now)
+	peer.mu.Lock()
+	if want := int(10 * requestQueueTime.Seconds()); peer.window != want {
+		t.Errorf("window %d, want %d", peer.window, want)
+	}
+	peer.handshake = &ExtendedHandshake{Reqq: 5}
+	peer.mu.Unlock()
+
+	peer.downloaded.Add(10 * blockSize)
+	pm.checkRequests(peer, now.Add(time.Second))
+	peer.mu.Lock()
+	if peer.window != 5 {
+		t.Errorf("window %d, want the peer's reqq of 5", peer.window)
+	}
+	peer.mu.Unlock()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 8*blockSize, blockSize)
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, slowMsgs := newSeedingPeer(t, pm, 1)
+	pm.fillRequests(slow)
+	sent := make(map[string]bool)
+	for i := 0; i < initialRequestWindow; i++ {
+		sent[string(nextMessage(t, slowMsgs, MsgRequest).Payload)] = true
+	}
+
+	// The second peer joins once the slow one holds the first blocks.
+	_, otherMsgs := newSeedingPeer(t, pm, 2)
+	pm.checkRequests(slow, time.Now().Add(pm.requestTimeout))
+
+	for i := 0; i < initialRequestWindow; i++ {
+		if msg := nextMessage(t, slowMsgs, MsgCancel); !sent[string(msg.Payload)] {
+			t.Errorf("cancelled %v, which was not requested", msg.Payload)
+		}
+		if msg := nextMessage(t, otherMsgs, MsgRequest); !sent[string(msg.Payload)] {
+			t.Errorf("other peer got %v, want a timed out block", msg.Payload)
+		}
+	}
+	if n := outstanding(slow); n != 0 {
+		t.Errorf("%d requests still outstanding at the slow peer", n)
+	}
+
+	// The slow peer is not asked for the blocks again.
+	pm.fillRequests(slow)
+	slow.mu.Lock()
+	defer slow.mu.Unlock()
+	for req := range slow.outstanding {
+		if sent[string(requestPayload(req.index, req.begin, req.length))] {
+			t.Errorf("block %v asked of the slow peer again", req)
+		}
+	}
+}
+
+func TestChokeReleasesRequests(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 8*blockSize, blockSize)
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, _ := newSeedingPeer(t, pm, 1)
+	pm.fillRequests(peer)
+
+	peer.setChoked(true)
+	pm.handleChoke(peer)
+	if n := outstanding(peer); n != 0 {
+		t.Errorf("%d requests outstanding after choke", n)
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if len(pm.pending) != 0 || len(pm.released) != initialRequestWindow {
+		t.Errorf("%d pending and %d released blocks", len(pm.pending), len(pm.released))
+	}
+}
+
+func TestFastChokeCancelsRequests(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 8*blockSize, blockSize)
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, msgs := newSeedingPeer(t, pm, 1)
+	peer.fast = true
+	pm.fillRequests(peer)
+	var allowed uint32
+	peer.mu.Lock()
+	for req := range peer.outstanding {
+		allowed = req.index
+	}
+	peer.allowedFast = map[uint32]bool{allowed: true}
+	peer.mu.Unlock()
+
+	// Requests for allowed fast pieces survive the choke; the others are
+	// cancelled.
+	peer.setChoked(true)
+	pm.handleChoke(peer)
+	for i := 0; i < initialRequestWindow-1; i++ {
+		msg := nextMessage(t, msgs, MsgCancel)
+		if req, _ := parseBlockRequest(msg.Payload); req.index == allowed {
+			t.Error("allowed fast request cancelled")
+		}
+	}
+	if n := outstanding(peer); n != 1 {
+		t.Errorf("%d requests outstanding after choke, want 1", n)
+	}
+}
+
+func TestInvalidBlocks(t *testing.T) {
+	torrent, data := newTestTorrent(t, 2*blockSize+100, blockSize)
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddrPort("10.0.0.1:6881")
+	peer, remote := newPipePeer(t, pm, addr)
+	go messages(remote)
+
+	piece := func(index, begin uint32, block []byte) {
+		payload := requestPayload(index, begin, 0)[:8]
+		remote.Write((&Message{ID: MsgPiece, Payload: append(payload, block...)}).Serialize())
+	}
+	piece(2, 100, data[:blockSize])       // past the end of the last piece
+	piece(3, 0, data[:blockSize])         // no such piece
+	piece(0, 0, data[:blockSize])         // never requested
+	piece(1, blockSize, data[:blockSize]) // past the end of a piece
+	// A keep-alive is only read once the blocks have been handled.
+	remote.Write(make([]byte, 4))
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if len(pm.pieceBuffers) != 0 || pm.downloaded.Load() != 0 || peer.downloaded.Load() != 0 {
+		t.Errorf("invalid blocks accepted: %d piece buffers, %d bytes downloaded",
+			len(pm.pieceBuffers), pm.downloaded.Load())
+	}
+}
+
+func TestRejectedBlockRetried(t *testing.T) {
+	torrent, _ := newTestTorrent(t, blockSize, blockSize)
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, msgs := newSeedingPeer(t, pm, 1)
+	pm.fillRequests(peer)
+	nextMessage(t, msgs, MsgRequest)
+
+	// The only seed rejects the block, say because its queue is full.
+	req := blockRequest{index: 0, begin: 0, length: blockSize}
+	pm.handleReject(peer, req)
+	now := time.Now()
+	pick := func(now time.Time) []blockRequest {
+		pm.mu.Lock()
+		defer pm.mu.Unlock()
+		peer.mu.Lock()
+		defer peer.mu.Unlock()
+		return pm.pickBlocksLocked(peer, now)
+	}
+	if reqs := pick(now); len(reqs) != 0 {
+		t.Errorf("rejected block asked for again at once: %v", reqs)
+	}
+	if reqs := pick(now.Add(failedRetryDelay)); len(reqs) != 1 || reqs[0] != req {
+		t.Errorf("got %v, want the rejected block retried after the delay", reqs)
+	}
+}
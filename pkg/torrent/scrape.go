@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// Scrape asks a tracker for swarm statistics using DefaultTrackerClient.
+func Scrape(trackerURL string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	return DefaultTrackerClient.Scrape(context.Background(), trackerURL, infoHashes)
+}
+
+// ScrapeURL derives the scrape URL from an HTTP announce URL by replacing
+// the "announce" at the start of its last path component with "scrape".
+func ScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid tracker URL: %v", err)
+	}
+	if err := scrapePath(u); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func scrapePath(u *url.URL) error {
+	slash := strings.LastIndex(u.Path, "/")
+	last := u.Path[slash+1:]
+	if !strings.HasPrefix(last, "announce") {
+		return fmt.Errorf("tracker %s does not support scrape", u.Host)
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(last, "announce")
+	u.RawPath = ""
+	return nil
+}
+
+func (c *TrackerClient) scrapeHTTP(ctx context.Context, announceURL *url.URL, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	u := *announceURL
+	if err := scrapePath(&u); err != nil {
+		return nil, err
+	}
+
+	var query []string
+	if u.RawQuery != "" {
+		query = append(query, u.RawQuery)
+	}
+	for _, h := range infoHashes {
+		query = append(query, "info_hash="+escapeInfoHash(h))
+	}
+	u.RawQuery = strings.Join(query, "&")
+
+	resp, err := c.get(ctx, announceURL, u.String())
+	if err != nil {
+		return nil, fmt.Errorf("scrape request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	dict, err := readTrackerResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	files, ok := dict["files"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("scrape response missing files")
+	}
+
+	results := make(map[[20]byte]ScrapeResult, len(files))
+	for key, raw := range files {
+		if len(key) != 20 {
+			continue
+		}
+		stats, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("scrape entry not a dictionary")
+		}
+
+		var r ScrapeResult
+		r.Seeders, _ = stats["complete"].(int)
+		r.Completed, _ = stats["downloaded"].(int)
+		r.Leechers, _ = stats["incomplete"].(int)
+		results[[20]byte([]byte(key))] = r
+	}
+
+	return results, nil
+}
+
+func escapeInfoHash(infoHash [20]byte) string {
+	escaped := ""
+	for _, b := range infoHash {
+		escaped += fmt.Sprintf("%%%02X", b)
+	}
+	return escaped
+}
@@ -0,0 +1,65 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		scrape   string
+		ok       bool
+	}{
+		{"http://example.com/announce", "http://example.com/scrape", true},
+		{"http://example.com/x/announce", "http://example.com/x/scrape", true},
+		{"http://example.com/announce.php", "http://example.com/scrape.php", true},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644", true},
+		{"http://example.com/a", "", false},
+		{"http://example.com/announce?x=2/4", "http://example.com/scrape?x=2/4", true},
+		{"http://example.com/x%064announce", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := ScrapeURL(tt.announce)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected error state %v", tt.announce, err)
+			continue
+		}
+		if got != tt.scrape {
+			t.Errorf("%s: expected %s, got %s", tt.announce, tt.scrape, got)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	first := [20]byte{'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'}
+	second := [20]byte{'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b', 'b'}
+
+	var gotHashes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		gotHashes = r.URL.Query()["info_hash"]
+		w.Write([]byte("d5:filesd20:" + string(first[:]) + "d8:completei5e10:downloadedi50e10:incompletei10ee" +
+			"20:" + string(second[:]) + "d8:completei1e10:downloadedi2e10:incompletei3eeee"))
+	}))
+	defer srv.Close()
+
+	results, err := Scrape(srv.URL+"/announce", [][20]byte{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotHashes) != 2 {
+		t.Errorf("expected 2 info_hash parameters, got %d", len(gotHashes))
+	}
+	if r := results[first]; r.Seeders != 5 || r.Completed != 50 || r.Leechers != 10 {
+		t.Errorf("unexpected result for first: %+v", r)
+	}
+	if r := results[second]; r.Seeders != 1 || r.Completed != 2 || r.Leechers != 3 {
+		t.Errorf("unexpected result for second: %+v", r)
+	}
+}
@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+
+	"github.com/torbenconto/pebl/pkg/dht"
+	"github.com/torbenconto/pebl/pkg/lsd"
+	"github.com/torbenconto/pebl/pkg/utp"
+)
+
+const (
+	peerIDPrefix = "-PB0001-"
+	defaultPort  = 6881
+)
+
+// Session holds the client-wide settings sent with every announce: our
+// peer ID, listen port and key, plus the tracker IDs handed out by
+// trackers, which are echoed back on later announces. Its peer settings,
+// Listener and LSD apply to the PeerManagers started with it.
+type Session struct {
+	PeerID [20]byte
+	// Port is the port we accept peer connections on.
+	Port uint16
+	// Key is a random value that stays the same for the whole session so a
+	// tracker can recognize us after our IP address changes.
+	Key uint32
+	// NumWant is the number of peers to ask for; zero leaves the choice to
+	// the tracker.
+	NumWant int
+	// IP is reported to trackers as our address when set.
+	IP netip.Addr
+	// IPv4 and IPv6, when set, tell trackers our address in each family,
+	// so peers reach us over both when we announce over one.
+	IPv4 netip.Addr
+	IPv6 netip.Addr
+	// NoPeerID asks HTTP trackers to omit peer IDs from non-compact peer
+	// lists.
+	NoPeerID bool
+	// Tracker sends the announces; replace it to use a custom HTTP client.
+	Tracker *TrackerClient
+	// DHT, when set, is searched for peers alongside the trackers and kept
+	// informed of the torrents we download.
+	DHT *dht.DHT
+	// LSD, when set, announces the torrents we download on the local
+	// network and finds peers there. It should announce Port.
+	LSD *lsd.LSD
+	// Listener, when set, accepts connections from peers for the torrents
+	// we download and seed. Port should be its port.
+	Listener *Listener
+	// UTP, when set, is tried before TCP for connections to peers. Pass it
+	// to Listener.Serve to accept uTP connections too.
+	UTP *utp.Socket
+	// UploadSlots is the number of peers we upload to for their rates,
+	// besides one optimistic unchoke; zero uses the default of 4.
+	UploadSlots int
+	// ChokeAlgorithm picks the peers for the upload slots; nil uses
+	// FastestUpload.
+	ChokeAlgorithm ChokeAlgorithm
+	// Encryption decides whether the connections we make to peers use
+	// MSE. Set the policy for incoming connections on the Listener.
+	Encryption EncryptionPolicy
+
+	mu         sync.Mutex
+	trackerIDs map[string]string
+}
+
+func NewSession() *Session {
+	return &Session{
+		PeerID:     GeneratePeerID(),
+		Port:       defaultPort,
+		Tracker:    DefaultTrackerClient,
+		Key:        randomKey(),
+		trackerIDs: make(map[string]string),
+	}
+}
+
+func randomKey() uint32 {
+	var key [4]byte
+	rand.Read(key[:])
+	return binary.BigEndian.Uint32(key[:])
+}
+
+// GeneratePeerID returns an Azureus-style peer ID with random trailing
+// characters.
+func GeneratePeerID() [20]byte {
+	const chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	var id [20]byte
+	copy(id[:], peerIDPrefix)
+	rand.Read(id[len(peerIDPrefix):])
+	for i := len(peerIDPrefix); i < len(id); i++ {
+		id[i] = chars[int(id[i])%len(chars)]
+	}
+	return id
+}
+
+// AnnounceRequest returns an announce for torrent carrying the session's
+// settings.
+func (s *Session) AnnounceRequest(torrent Torrent) AnnounceRequest {
+	return AnnounceRequest{
+		InfoHash: torrent.InfoHash,
+		PeerID:   s.PeerID,
+		Port:     s.Port,
+		Left:     torrent.TotalLength(),
+		Event:    "started",
+		Key:      s.Key,
+		NumWant:  s.NumWant,
+		IP:       s.IP,
+		IPv4:     s.IPv4,
+		IPv6:     s.IPv6,
+		NoPeerID: s.NoPeerID,
+	}
+}
+
+// Announce sends req to a tracker, filling in the tracker ID the tracker
+// gave us earlier and remembering any new one it returns.
+func (s *Session) Announce(ctx context.Context, trackerURL string, req AnnounceRequest) (*AnnounceResponse, error) {
+	s.mu.Lock()
+	req.TrackerID = s.trackerIDs[trackerURL]
+	s.mu.Unlock()
+
+	resp, err := s.Tracker.Announce(ctx, trackerURL, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.TrackerID != "" {
+		s.mu.Lock()
+		s.trackerIDs[trackerURL] = resp.TrackerID
+		s.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// DiscoverPeers announces to the torrent's trackers tier by tier and
+// returns the peers of the first tracker that answers, merged with the
+// peers found on the DHT.
+func (s *Session) DiscoverPeers(ctx context.Context, torrent Torrent) ([]Peer, error) {
+	req := s.AnnounceRequest(torrent)
+	return s.withDHTPeers(ctx, torrent, func() (*AnnounceResponse, error) {
+		return torrent.trackerTiers().Announce(func(trackerURL string) (*AnnounceResponse, error) {
+			return s.Announce(ctx, trackerURL, req)
+		})
+	})
+}
+
+// DiscoverPeersAllTiers announces to all tiers concurrently and returns the
+// union of the peers they and the DHT report.
+func (s *Session) DiscoverPeersAllTiers(ctx context.Context, torrent Torrent) ([]Peer, error) {
+	req := s.AnnounceRequest(torrent)
+	return s.withDHTPeers(ctx, torrent, func() (*AnnounceResponse, error) {
+		return torrent.trackerTiers().AnnounceAll(func(trackerURL string) (*AnnounceResponse, error) {
+			return s.Announce(ctx, trackerURL, req)
+		})
+	})
+}
+
+// defaultKey is the key sent by the package-level announce functions, so
+// trackers see the same key across calls as they would from one Session.
+var defaultKey = randomKey()
+
+func sessionWithPeerID(peerID []byte) *Session {
+	s := NewSession()
+	copy(s.PeerID[:], peerID)
+	s.Key = defaultKey
+	return s
+}
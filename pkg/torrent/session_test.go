@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestGeneratePeerID(t *testing.T) {
+	id := GeneratePeerID()
+	if !strings.HasPrefix(string(id[:]), peerIDPrefix) {
+		t.Errorf("peer ID %q missing client prefix", id)
+	}
+	if other := GeneratePeerID(); other == id {
+		t.Errorf("expected random peer IDs, got %q twice", id)
+	}
+}
+
+func TestSessionAnnounceParameters(t *testing.T) {
+	rt, srv := newRecordingTracker(t, "d10:tracker id3:abc5:peers0:e")
+
+	s := NewSession()
+	s.Port = 51413
+	s.NumWant = 30
+	s.NoPeerID = true
+	s.IPv4 = netip.MustParseAddr("192.0.2.1")
+	s.IPv6 = netip.MustParseAddr("2001:db8::1")
+	torrent := Torrent{TrackerURL: srv.URL, Length: 1}
+
+	if _, err := s.DiscoverPeers(context.Background(), torrent); err != nil {
+		t.Fatal(err)
+	}
+	first := rt.wait(t)
+	if first.Get("port") != "51413" || first.Get("numwant") != "30" || first.Get("no_peer_id") != "1" {
+		t.Errorf("unexpected announce parameters %v", first)
+	}
+	if first.Get("ipv4") != "192.0.2.1" || first.Get("ipv6") != "2001:db8::1" {
+		t.Errorf("expected our addresses, got ipv4=%q ipv6=%q", first.Get("ipv4"), first.Get("ipv6"))
+	}
+	if first.Get("key") != fmt.Sprintf("%08X", s.Key) {
+		t.Errorf("expected key %08X, got %s", s.Key, first.Get("key"))
+	}
+	if first.Get("trackerid") != "" {
+		t.Errorf("first announce should not carry a tracker id")
+	}
+
+	if _, err := s.DiscoverPeers(context.Background(), torrent); err != nil {
+		t.Fatal(err)
+	}
+	second := rt.wait(t)
+	if second.Get("trackerid") != "abc" {
+		t.Errorf("expected tracker id to be echoed, got %q", second.Get("trackerid"))
+	}
+	if second.Get("key") != first.Get("key") {
+		t.Errorf("key changed between announces")
+	}
+}
+
+func TestSessionWithPeerIDKeepsKey(t *testing.T) {
+	a := sessionWithPeerID([]byte("-PB0001-aaaaaaaaaaaa"))
+	b := sessionWithPeerID([]byte("-PB0001-bbbbbbbbbbbb"))
+	if a.Key != b.Key {
+		t.Errorf("keys %08X and %08X differ between calls", a.Key, b.Key)
+	}
+	if a.PeerID == b.PeerID {
+		t.Error("peer ID not taken from the caller")
+	}
+}
+
+func TestPeerManagerStart(t *testing.T) {
+	torrent, _ := newTestTorrent(t, blockSize, blockSize)
+	pm, err := NewPeerManager(torrent, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen("127.0.0.1:0", GeneratePeerID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewSession()
+	s.Listener = l
+	s.UploadSlots = 2
+	s.ChokeAlgorithm = RoundRobin{}
+	s.Encryption = EncryptionRequired
+	pm.Start(s)
+
+	pm.mu.Lock()
+	if pm.uploadSlots != 2 || pm.chokeAlgorithm != (RoundRobin{}) ||
+		pm.encryption != EncryptionRequired || pm.listenPort != l.Port() {
+		t.Errorf("session settings not applied: %d slots, %T, %v, port %d",
+			pm.uploadSlots, pm.chokeAlgorithm, pm.encryption, pm.listenPort)
+	}
+	pm.mu.Unlock()
+	l.mu.Lock()
+	if l.torrents[torrent.InfoHash] != pm {
+		t.Error("torrent not registered with the listener")
+	}
+	l.mu.Unlock()
+
+	pm.Stop()
+	pm.Stop()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.torrents[torrent.InfoHash] != nil {
+		t.Error("torrent still registered after Stop")
+	}
+}
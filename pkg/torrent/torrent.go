@@ -2,7 +2,9 @@ package torrent
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 
 	"github.com/torbenconto/pebl/pkg/bencode"
 )
@@ -13,7 +15,11 @@ type File struct {
 }
 
 type Torrent struct {
-	TrackerURL  string
+	TrackerURL string
+	Trackers   *TrackerTiers
+	// Nodes are the DHT nodes a trackerless torrent names, as host:port,
+	// used to join the DHT when the session's routing table is empty.
+	Nodes       []string
 	Length      int
 	InfoHash    [20]byte
 	PieceLength int
@@ -28,32 +34,78 @@ func (t *Torrent) GetFiles() []File {
 	return []File{{Length: t.Length, Path: []string{"file"}}}
 }
 
-func extractTrackerURLs(dict map[string]interface{}) ([]string, error) {
-	var trackers []string
+// TotalLength returns the number of bytes in the torrent, summing the files
+// of a multi-file torrent.
+func (t *Torrent) TotalLength() int64 {
+	if len(t.Files) == 0 {
+		return int64(t.Length)
+	}
+	var total int64
+	for _, f := range t.Files {
+		total += int64(f.Length)
+	}
+	return total
+}
+
+// PieceSize returns the length of the piece at index; only the last piece
+// may be shorter than PieceLength.
+func (t *Torrent) PieceSize(index uint32) int {
+	if int(index) == len(t.Pieces)-1 {
+		return int(t.TotalLength() - int64(index)*int64(t.PieceLength))
+	}
+	return t.PieceLength
+}
+
+// extractTrackerTiers returns the trackers of the metainfo dict, none for
+// a trackerless torrent.
+func extractTrackerTiers(dict map[string]interface{}) [][]string {
+	var tiers [][]string
 
 	if al, ok := dict["announce-list"]; ok {
-		if tiers, ok := al.([]interface{}); ok {
-			for _, tier := range tiers {
+		if rawTiers, ok := al.([]interface{}); ok {
+			for _, tier := range rawTiers {
 				if tierList, ok := tier.([]interface{}); ok {
+					var urls []string
 					for _, urlRaw := range tierList {
-						if urlStr, ok := urlRaw.(string); ok {
-							trackers = append(trackers, urlStr)
+						if urlStr, ok := urlRaw.(string); ok && urlStr != "" {
+							urls = append(urls, urlStr)
 						}
 					}
+					if len(urls) > 0 {
+						tiers = append(tiers, urls)
+					}
 				}
 			}
 		}
 	}
 
-	if len(trackers) == 0 {
-		if announce, ok := dict["announce"].(string); ok {
-			trackers = append(trackers, announce)
-		} else {
-			return nil, fmt.Errorf("no announce or announce-list found")
+	if len(tiers) == 0 {
+		if announce, ok := dict["announce"].(string); ok && announce != "" {
+			tiers = append(tiers, []string{announce})
 		}
 	}
 
-	return trackers, nil
+	return tiers
+}
+
+// extractNodes returns the DHT nodes of the metainfo dict, a list of
+// [host, port] pairs.
+func extractNodes(dict map[string]interface{}) []string {
+	rawNodes, _ := dict["nodes"].([]interface{})
+	var nodes []string
+	for _, n := range rawNodes {
+		pair, ok := n.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		host, ok := pair[0].(string)
+		port, ok2 := pair[1].(int)
+		if !ok || !ok2 || host == "" || port <= 0 || port > 65535 {
+			continue
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return nodes
 }
 
 func ReadMetaInfoFile(path string) (Torrent, error) {
@@ -92,18 +144,20 @@ func ReadMetaInfoFile(path string) (Torrent, error) {
 		pieces = append(pieces, pieceBytes[i:end])
 	}
 
-	trackers, err := extractTrackerURLs(dict)
-	if err != nil {
-		return Torrent{}, err
-	}
+	trackers := NewTrackerTiers(extractTrackerTiers(dict))
 
 	torrent := Torrent{
-		TrackerURL:  trackers[0],
+		Trackers:    trackers,
+		Nodes:       extractNodes(dict),
 		InfoHash:    hash,
 		PieceLength: info["piece length"].(int),
 		Pieces:      pieces,
 	}
 
+	if tiers := trackers.Tiers(); len(tiers) > 0 {
+		torrent.TrackerURL = tiers[0][0]
+	}
+
 	if filesRaw, ok := info["files"]; ok {
 		filesList, ok := filesRaw.([]interface{})
 		if !ok {
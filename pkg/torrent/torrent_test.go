@@ -2,10 +2,48 @@ package torrent
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
 )
 
+func TestReadTrackerlessMetaInfoFile(t *testing.T) {
+	data, err := bencode.Encode(map[string]interface{}{
+		"nodes": []interface{}{
+			[]interface{}{"127.0.0.1", 6881},
+			[]interface{}{"router.example.com", 6882},
+			[]interface{}{"bad"},
+		},
+		"info": map[string]interface{}{
+			"name":         "file",
+			"length":       4,
+			"piece length": 4,
+			"pieces":       string(make([]byte, 20)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "trackerless.torrent")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := ReadMetaInfoFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.hasTrackers() || torrent.TrackerURL != "" {
+		t.Errorf("trackerless torrent has trackers %v", torrent.Trackers.Tiers())
+	}
+	if len(torrent.Nodes) != 2 || torrent.Nodes[0] != "127.0.0.1:6881" || torrent.Nodes[1] != "router.example.com:6882" {
+		t.Errorf("nodes %v", torrent.Nodes)
+	}
+}
+
 func TestReadMetaInfoFile(t *testing.T) {
 	torrent, err := ReadMetaInfoFile("sample.torrent")
 	if err != nil {
@@ -20,7 +58,7 @@ func TestReadMetaInfoFile(t *testing.T) {
 	peerManager, _ := NewPeerManager(&torrent, "test")
 
 	for _, peerAddr := range peers {
-		peerConn, err := PerformHandshakeAndConnect(&torrent, peerAddr, peerID)
+		peerConn, err := PerformHandshakeAndConnect(&torrent, peerAddr, peerID, EncryptionPreferred)
 		if err != nil {
 			fmt.Printf("Handshake failed with %s: %v\n", peerAddr, err)
 			continue
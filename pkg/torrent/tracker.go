@@ -0,0 +1,351 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// TrackerTiers holds the announce-list of a torrent as described in BEP 12.
+// Trackers within a tier are shuffled once on creation, and a tracker that
+// answers successfully is moved to the front of its tier.
+type TrackerTiers struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+func NewTrackerTiers(tiers [][]string) *TrackerTiers {
+	t := &TrackerTiers{}
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		shuffled := make([]string, len(tier))
+		copy(shuffled, tier)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		t.tiers = append(t.tiers, shuffled)
+	}
+	return t
+}
+
+// Tiers returns a copy of the current tracker order.
+func (t *TrackerTiers) Tiers() [][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tiers := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	return tiers
+}
+
+// Promote moves trackerURL to the front of the given tier.
+func (t *TrackerTiers) Promote(tier int, trackerURL string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tier < 0 || tier >= len(t.tiers) {
+		return
+	}
+	urls := t.tiers[tier]
+	for i, u := range urls {
+		if u == trackerURL {
+			copy(urls[1:i+1], urls[:i])
+			urls[0] = trackerURL
+			return
+		}
+	}
+}
+
+// Announce tries each tracker in order, falling through to the next tier
+// only when every tracker in the current tier has failed. It returns the
+// response of the first tracker that answers.
+func (t *TrackerTiers) Announce(announce func(trackerURL string) (*AnnounceResponse, error)) (*AnnounceResponse, error) {
+	var errs []error
+	for i, tier := range t.Tiers() {
+		resp, err := t.announceTier(i, tier, announce)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no trackers")
+	}
+	return nil, fmt.Errorf("all trackers failed: %w", errors.Join(errs...))
+}
+
+// AnnounceAll announces to every tier concurrently, walking each tier in
+// order, and merges the responses of all of them. The merged response
+// carries the union of peers, the shortest interval and the largest swarm
+// counts reported.
+func (t *TrackerTiers) AnnounceAll(announce func(trackerURL string) (*AnnounceResponse, error)) (*AnnounceResponse, error) {
+	tiers := t.Tiers()
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("no trackers")
+	}
+
+	type tierResult struct {
+		resp *AnnounceResponse
+		err  error
+	}
+	results := make([]tierResult, len(tiers))
+
+	var wg sync.WaitGroup
+	for i, tier := range tiers {
+		wg.Add(1)
+		go func(i int, tier []string) {
+			defer wg.Done()
+			resp, err := t.announceTier(i, tier, announce)
+			results[i] = tierResult{resp: resp, err: err}
+		}(i, tier)
+	}
+	wg.Wait()
+
+	merged := &AnnounceResponse{}
+	var errs []error
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		if merged.Interval == 0 || (r.resp.Interval > 0 && r.resp.Interval < merged.Interval) {
+			merged.Interval = r.resp.Interval
+		}
+		merged.MinInterval = max(merged.MinInterval, r.resp.MinInterval)
+		merged.Seeders = max(merged.Seeders, r.resp.Seeders)
+		merged.Leechers = max(merged.Leechers, r.resp.Leechers)
+		merged.Peers = MergePeers(merged.Peers, r.resp.Peers)
+	}
+
+	if len(errs) == len(tiers) {
+		return nil, fmt.Errorf("all trackers failed: %w", errors.Join(errs...))
+	}
+	return merged, nil
+}
+
+func (t *TrackerTiers) announceTier(index int, tier []string, announce func(trackerURL string) (*AnnounceResponse, error)) (*AnnounceResponse, error) {
+	var errs []error
+	for _, trackerURL := range tier {
+		resp, err := announce(trackerURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", trackerURL, err))
+			continue
+		}
+		t.Promote(index, trackerURL)
+		return resp, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (t *Torrent) trackerTiers() *TrackerTiers {
+	if t.Trackers != nil {
+		return t.Trackers
+	}
+	return NewTrackerTiers([][]string{{t.TrackerURL}})
+}
+
+// hasTrackers reports whether the torrent has any tracker to announce to.
+func (t *Torrent) hasTrackers() bool {
+	if t.Trackers != nil {
+		return len(t.Trackers.Tiers()) > 0
+	}
+	return t.TrackerURL != ""
+}
+
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+	IPv4       netip.Addr
+	IPv6       netip.Addr
+	IP         netip.Addr
+	Key        uint32
+	NumWant    int
+	TrackerID  string
+	NoPeerID   bool
+}
+
+type AnnounceResponse struct {
+	Interval       int
+	MinInterval    int
+	Seeders        int
+	Leechers       int
+	Peers          []Peer
+	WarningMessage string
+	TrackerID      string
+}
+
+// Announce sends req to a single tracker using DefaultTrackerClient.
+func Announce(trackerURL string, req AnnounceRequest) (*AnnounceResponse, error) {
+	return DefaultTrackerClient.Announce(context.Background(), trackerURL, req)
+}
+
+// DiscoverPeers announces to the torrent's trackers tier by tier and returns
+// the peers of the first tracker that answers.
+func DiscoverPeers(torrent Torrent, peerID []byte) ([]Peer, error) {
+	return sessionWithPeerID(peerID).DiscoverPeers(context.Background(), torrent)
+}
+
+// DiscoverPeersAllTiers announces to all tiers concurrently and returns the
+// union of the peers they report.
+func DiscoverPeersAllTiers(torrent Torrent, peerID []byte) ([]Peer, error) {
+	return sessionWithPeerID(peerID).DiscoverPeersAllTiers(context.Background(), torrent)
+}
+
+func (c *TrackerClient) announceHTTP(ctx context.Context, base *url.URL, req AnnounceRequest) (*AnnounceResponse, error) {
+	params := url.Values{
+		"peer_id":    {string(req.PeerID[:])},
+		"port":       {strconv.Itoa(int(req.Port))},
+		"uploaded":   {strconv.FormatInt(req.Uploaded, 10)},
+		"downloaded": {strconv.FormatInt(req.Downloaded, 10)},
+		"left":       {strconv.FormatInt(req.Left, 10)},
+		"compact":    {"1"},
+	}
+	if req.Event != "" {
+		params.Set("event", req.Event)
+	}
+	if req.IP.IsValid() {
+		params.Set("ip", req.IP.String())
+	}
+	if req.Key != 0 {
+		params.Set("key", fmt.Sprintf("%08X", req.Key))
+	}
+	if req.NumWant > 0 {
+		params.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.TrackerID != "" {
+		params.Set("trackerid", req.TrackerID)
+	}
+	if req.NoPeerID {
+		params.Set("no_peer_id", "1")
+	}
+	if req.IPv4.Is4() {
+		params.Set("ipv4", req.IPv4.String())
+	}
+	if req.IPv6.Is6() && !req.IPv6.Is4In6() {
+		params.Set("ipv6", req.IPv6.String())
+	}
+
+	query := "info_hash=" + escapeInfoHash(req.InfoHash) + "&" + params.Encode()
+	if base.RawQuery != "" {
+		query = base.RawQuery + "&" + query
+	}
+	finalURL := base.Scheme + "://" + base.Host + base.Path + "?" + query
+
+	resp, err := c.get(ctx, base, finalURL)
+	if err != nil {
+		return nil, fmt.Errorf("tracker request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	dict, err := readTrackerResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	_, hasPeers := dict["peers"]
+	_, hasPeers6 := dict["peers6"]
+	if !hasPeers && !hasPeers6 {
+		return nil, fmt.Errorf("tracker response missing peers")
+	}
+
+	peers, err := parsePeerList(dict["peers"])
+	if err != nil {
+		return nil, err
+	}
+	if peers6, ok := dict["peers6"].(string); ok {
+		peers = append(peers, parseCompactPeers6([]byte(peers6))...)
+	}
+
+	result := &AnnounceResponse{Peers: peers}
+	result.WarningMessage, _ = dict["warning message"].(string)
+	result.TrackerID, _ = dict["tracker id"].(string)
+	if interval, ok := dict["interval"].(int); ok {
+		result.Interval = interval
+	}
+	if minInterval, ok := dict["min interval"].(int); ok {
+		result.MinInterval = minInterval
+	}
+	if complete, ok := dict["complete"].(int); ok {
+		result.Seeders = complete
+	}
+	if incomplete, ok := dict["incomplete"].(int); ok {
+		result.Leechers = incomplete
+	}
+
+	return result, nil
+}
+
+// parsePeerList decodes the "peers" key of an announce response, which is
+// either a compact string of 6-byte IPv4 entries or a list of dictionaries.
+func parsePeerList(raw interface{}) ([]Peer, error) {
+	switch peersData := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return parseCompactPeers([]byte(peersData)), nil
+	case []interface{}:
+		var peers []Peer
+		for _, entry := range peersData {
+			peerDict, ok := entry.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("tracker peer entry not a dictionary")
+			}
+			ipStr, ok := peerDict["ip"].(string)
+			if !ok {
+				return nil, fmt.Errorf("tracker peer entry missing ip")
+			}
+			port, ok := peerDict["port"].(int)
+			if !ok || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("tracker peer entry has invalid port")
+			}
+			ip, err := netip.ParseAddr(ipStr)
+			if err != nil {
+				// Peers may be listed by DNS name; those are not supported.
+				continue
+			}
+			peer := Peer{Addr: netip.AddrPortFrom(ip.Unmap(), uint16(port)), Source: PeerSourceTracker}
+			if id, ok := peerDict["peer id"].(string); ok && len(id) == 20 {
+				peer.ID = []byte(id)
+			}
+			peers = append(peers, peer)
+		}
+		return peers, nil
+	default:
+		return nil, fmt.Errorf("tracker peers has invalid type %T", raw)
+	}
+}
+
+func parseCompactPeers(peerBytes []byte) []Peer {
+	var peers []Peer
+	for i := 0; i+6 <= len(peerBytes); i += 6 {
+		ip := netip.AddrFrom4([4]byte(peerBytes[i : i+4]))
+		port := binary.BigEndian.Uint16(peerBytes[i+4 : i+6])
+		peers = append(peers, Peer{Addr: netip.AddrPortFrom(ip, port), Source: PeerSourceTracker})
+	}
+	return peers
+}
+
+func parseCompactPeers6(peerBytes []byte) []Peer {
+	var peers []Peer
+	for i := 0; i+18 <= len(peerBytes); i += 18 {
+		ip := netip.AddrFrom16([16]byte(peerBytes[i : i+16]))
+		port := binary.BigEndian.Uint16(peerBytes[i+16 : i+18])
+		peers = append(peers, Peer{Addr: netip.AddrPortFrom(ip, port), Source: PeerSourceTracker})
+	}
+	return peers
+}
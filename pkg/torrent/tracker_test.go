@@ -0,0 +1,165 @@
+package torrent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTracker(t *testing.T, body string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTrackerTiersShuffleKeepsTiers(t *testing.T) {
+	tiers := NewTrackerTiers([][]string{{"a", "b", "c"}, {"d"}, {}})
+
+	got := tiers.Tiers()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 tiers, got %d", len(got))
+	}
+
+	first := append([]string(nil), got[0]...)
+	sort.Strings(first)
+	if len(first) != 3 || first[0] != "a" || first[1] != "b" || first[2] != "c" {
+		t.Errorf("first tier lost trackers: %v", got[0])
+	}
+	if len(got[1]) != 1 || got[1][0] != "d" {
+		t.Errorf("second tier changed: %v", got[1])
+	}
+}
+
+func TestTrackerTiersPromote(t *testing.T) {
+	tiers := &TrackerTiers{tiers: [][]string{{"a", "b", "c"}}}
+
+	tiers.Promote(0, "c")
+
+	got := tiers.Tiers()[0]
+	if got[0] != "c" || got[1] != "a" || got[2] != "b" {
+		t.Errorf("expected [c a b], got %v", got)
+	}
+}
+
+func TestDiscoverPeersFallsThroughTiers(t *testing.T) {
+	failing := newTestTracker(t, "d14:failure reason4:nopee")
+	working := newTestTracker(t, "d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e")
+
+	trackers := &TrackerTiers{tiers: [][]string{
+		{failing.URL + "/announce"},
+		{failing.URL + "/announce", working.URL + "/announce"},
+	}}
+	torrent := Torrent{Trackers: trackers, Length: 1}
+
+	peers, err := DiscoverPeers(torrent, []byte("-PB0001-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:6881" {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+
+	if got := trackers.Tiers()[1][0]; got != working.URL+"/announce" {
+		t.Errorf("working tracker was not promoted, tier is %v", trackers.Tiers()[1])
+	}
+}
+
+func TestDiscoverPeersAllTiers(t *testing.T) {
+	first := newTestTracker(t, "d5:peers6:\x7f\x00\x00\x01\x1a\xe1e")
+	second := newTestTracker(t, "d5:peers12:\x7f\x00\x00\x01\x1a\xe1\x7f\x00\x00\x02\x1a\xe1e")
+
+	torrent := Torrent{
+		Trackers: NewTrackerTiers([][]string{{first.URL}, {second.URL}}),
+		Length:   1,
+	}
+
+	peers, err := DiscoverPeersAllTiers(torrent, []byte("-PB0001-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, p := range peers {
+		addrs = append(addrs, p.String())
+	}
+	sort.Strings(addrs)
+	if len(addrs) != 2 || addrs[0] != "127.0.0.1:6881" || addrs[1] != "127.0.0.2:6881" {
+		t.Fatalf("unexpected peers %v", addrs)
+	}
+}
+
+func TestDiscoverPeersDictAndIPv6(t *testing.T) {
+	body := "d5:peersld2:ip9:127.0.0.17:peer id20:-XX0001-0000000000004:porti6881eed2:ip11:example.org4:porti6881eed2:ip3:::14:porti51413eee" +
+		"6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e"
+	srv := newTestTracker(t, body)
+
+	torrent := Torrent{TrackerURL: srv.URL, Length: 1}
+	peers, err := DiscoverPeers(torrent, []byte("-PB0001-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 3 {
+		t.Fatalf("expected 3 peers, got %v", peers)
+	}
+	if peers[0].String() != "127.0.0.1:6881" || string(peers[0].ID) != "-XX0001-000000000000" {
+		t.Errorf("unexpected dict peer %v (id %q)", peers[0], peers[0].ID)
+	}
+	if peers[1].String() != "[::1]:51413" || peers[1].ID != nil {
+		t.Errorf("unexpected dict IPv6 peer %v", peers[1])
+	}
+	if peers[2].String() != "[2001:db8::1]:6881" {
+		t.Errorf("unexpected peers6 entry %v", peers[2])
+	}
+}
+
+func TestAnnounceTrackerError(t *testing.T) {
+	srv := newTestTracker(t, "d14:failure reason12:unregistered8:retry ini30e15:warning message4:slowe")
+
+	_, err := Announce(srv.URL, AnnounceRequest{})
+	var terr *TrackerError
+	if !errors.As(err, &terr) {
+		t.Fatalf("expected TrackerError, got %v", err)
+	}
+	if terr.FailureReason != "unregistered" || terr.RetryIn != 30*time.Minute || terr.WarningMessage != "slow" {
+		t.Errorf("unexpected tracker error %+v", terr)
+	}
+
+	never := newTestTracker(t, "d14:failure reason6:banned8:retry in5:nevere")
+	_, err = Announce(never.URL, AnnounceRequest{})
+	if !errors.As(err, &terr) || !terr.RetryNever {
+		t.Errorf("expected retry never, got %v", err)
+	}
+}
+
+func TestAnnounceHTTPStatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	_, err := Announce(srv.URL, AnnounceRequest{})
+	var terr *TrackerError
+	if !errors.As(err, &terr) {
+		t.Fatalf("expected TrackerError, got %v", err)
+	}
+	if terr.HTTPStatus != http.StatusServiceUnavailable || terr.FailureReason != "Service Unavailable: overloaded" {
+		t.Errorf("unexpected tracker error %+v", terr)
+	}
+}
+
+func TestStatusReason(t *testing.T) {
+	page := "<html>\n<body>" + strings.Repeat("x", 200) + "</body>\n</html>"
+	got := statusReason(http.StatusBadGateway, []byte(page))
+	want := "Bad Gateway: <html> <body>" + strings.Repeat("x", 100-len("<html> <body>")) + "..."
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := statusReason(http.StatusNotFound, nil); got != "Not Found" {
+		t.Errorf("got %q for an empty body", got)
+	}
+}
@@ -0,0 +1,196 @@
+package torrent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUserAgent      = "pebl/0.1"
+	defaultTrackerTimeout = 30 * time.Second
+)
+
+// DefaultTrackerClient is used by the package-level Announce and Scrape
+// functions.
+var DefaultTrackerClient = NewTrackerClient(nil)
+
+// TrackerClient sends announce and scrape requests to HTTP and UDP
+// trackers. Basic auth credentials and cookies can be registered per
+// tracker host.
+type TrackerClient struct {
+	HTTPClient *http.Client
+	UDP        *UDPTrackerClient
+	UserAgent  string
+
+	mu      sync.Mutex
+	auth    map[string]*url.Userinfo
+	cookies map[string][]*http.Cookie
+}
+
+// NewTrackerClient returns a client using httpClient for HTTP trackers. A
+// nil httpClient gets a client with a default timeout.
+func NewTrackerClient(httpClient *http.Client) *TrackerClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultTrackerTimeout}
+	}
+	return &TrackerClient{
+		HTTPClient: httpClient,
+		UDP:        NewUDPTrackerClient(),
+		UserAgent:  defaultUserAgent,
+		auth:       make(map[string]*url.Userinfo),
+		cookies:    make(map[string][]*http.Cookie),
+	}
+}
+
+type TrackerHTTPConfig struct {
+	// Timeout bounds each tracker request; zero uses a default.
+	Timeout time.Duration
+	// Proxy is the URL of an HTTP or SOCKS5 proxy. When empty the proxy is
+	// taken from the environment.
+	Proxy string
+	// CAFile is a PEM bundle of additional root certificates trusted for
+	// HTTPS trackers.
+	CAFile string
+}
+
+// NewTrackerHTTPClient builds an *http.Client for talking to trackers from
+// cfg.
+func NewTrackerHTTPClient(cfg TrackerHTTPConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTrackerTimeout
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// SetBasicAuth registers HTTP basic auth credentials for a tracker host.
+// Credentials embedded in a tracker URL are used as well.
+func (c *TrackerClient) SetBasicAuth(host, username, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.auth[host] = url.UserPassword(username, password)
+}
+
+// SetCookies registers cookies sent with every request to a tracker host.
+func (c *TrackerClient) SetCookies(host string, cookies []*http.Cookie) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cookies[host] = cookies
+}
+
+// Announce sends req to a single tracker, choosing the protocol from the
+// URL scheme.
+func (c *TrackerClient) Announce(ctx context.Context, trackerURL string, req AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %v", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return c.announceHTTP(ctx, u, req)
+	case "udp":
+		urlData := u.EscapedPath()
+		if u.RawQuery != "" {
+			urlData += "?" + u.RawQuery
+		}
+		return c.UDP.announce(ctx, u.Host, urlData, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// Scrape asks a tracker for swarm statistics of one or more torrents. HTTP
+// trackers are scraped through the URL derived from their announce URL
+// (BEP 48); UDP trackers use the scrape action of BEP 15. Infohashes the
+// tracker does not know are missing from the result.
+func (c *TrackerClient) Scrape(ctx context.Context, trackerURL string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %v", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return c.scrapeHTTP(ctx, u, infoHashes)
+	case "udp":
+		results, err := c.UDP.Scrape(ctx, u.Host, infoHashes)
+		if err != nil {
+			return nil, err
+		}
+		byHash := make(map[[20]byte]ScrapeResult, len(results))
+		for i, r := range results {
+			byHash[infoHashes[i]] = r
+		}
+		return byHash, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// get performs a GET against a tracker with our User-Agent, any registered
+// credentials and cookies for its host.
+func (c *TrackerClient) get(ctx context.Context, trackerURL *url.URL, rawURL string) (*http.Response, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("User-Agent", c.UserAgent)
+
+	c.mu.Lock()
+	auth := c.auth[trackerURL.Host]
+	if auth == nil {
+		auth = c.auth[trackerURL.Hostname()]
+	}
+	cookies := c.cookies[trackerURL.Host]
+	if cookies == nil {
+		cookies = c.cookies[trackerURL.Hostname()]
+	}
+	c.mu.Unlock()
+
+	if trackerURL.User != nil {
+		auth = trackerURL.User
+	}
+	if auth != nil {
+		password, _ := auth.Password()
+		httpReq.SetBasicAuth(auth.Username(), password)
+	}
+	for _, cookie := range cookies {
+		httpReq.AddCookie(cookie)
+	}
+
+	return c.HTTPClient.Do(httpReq)
+}
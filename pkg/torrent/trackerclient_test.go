@@ -0,0 +1,90 @@
+package torrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTrackerClientHeaders(t *testing.T) {
+	var gotAgent, gotUser, gotPass, gotCookie string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAgent = r.UserAgent()
+		gotUser, gotPass, _ = r.BasicAuth()
+		if c, err := r.Cookie("session"); err == nil {
+			gotCookie = c.Value
+		}
+		w.Write([]byte("d5:peers0:e"))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	client := NewTrackerClient(srv.Client())
+	client.SetBasicAuth(u.Host, "alice", "hunter2")
+	client.SetCookies(u.Hostname(), []*http.Cookie{{Name: "session", Value: "xyz"}})
+
+	if _, err := client.Announce(context.Background(), srv.URL+"/announce", AnnounceRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if gotAgent != defaultUserAgent {
+		t.Errorf("expected User-Agent %q, got %q", defaultUserAgent, gotAgent)
+	}
+	if gotUser != "alice" || gotPass != "hunter2" {
+		t.Errorf("expected basic auth alice:hunter2, got %s:%s", gotUser, gotPass)
+	}
+	if gotCookie != "xyz" {
+		t.Errorf("expected session cookie, got %q", gotCookie)
+	}
+}
+
+func TestTrackerClientGzipResponse(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("d5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	gz.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer srv.Close()
+
+	// Asking for gzip explicitly keeps the transport from decoding it.
+	client := NewTrackerClient(&http.Client{Transport: &http.Transport{DisableCompression: true}})
+	resp, err := client.Announce(context.Background(), srv.URL, AnnounceRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 {
+		t.Errorf("unexpected peers %v", resp.Peers)
+	}
+}
+
+func TestTrackerClientContextCancel(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := NewTrackerClient(nil).Announce(ctx, srv.URL, AnnounceRequest{}); err == nil {
+		t.Fatal("expected cancelled announce to fail")
+	}
+}
+
+func TestNewTrackerHTTPClientRejectsBadCA(t *testing.T) {
+	if _, err := NewTrackerHTTPClient(TrackerHTTPConfig{CAFile: "tracker.go"}); err == nil {
+		t.Error("expected error for a file without certificates")
+	}
+	if _, err := NewTrackerHTTPClient(TrackerHTTPConfig{Proxy: "socks5://127.0.0.1:1080"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
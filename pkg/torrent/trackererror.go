@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
+)
+
+// TrackerError is returned when a tracker rejects a request, either with a
+// "failure reason" or with a non-200 HTTP status.
+type TrackerError struct {
+	FailureReason  string
+	WarningMessage string
+	// RetryIn is the delay before the tracker may be contacted again
+	// (BEP 31); zero when the tracker gave no hint.
+	RetryIn time.Duration
+	// RetryNever is set when the tracker asked not to be retried at all.
+	RetryNever bool
+	// HTTPStatus is the HTTP status code, or zero for UDP trackers.
+	HTTPStatus int
+}
+
+func (e *TrackerError) Error() string {
+	var msg string
+	switch {
+	case e.FailureReason != "":
+		msg = "tracker error: " + e.FailureReason
+	case e.HTTPStatus != 0:
+		msg = fmt.Sprintf("tracker error: HTTP status %d", e.HTTPStatus)
+	default:
+		msg = "tracker error"
+	}
+	if e.RetryNever {
+		msg += " (retry never)"
+	} else if e.RetryIn > 0 {
+		msg += fmt.Sprintf(" (retry in %s)", e.RetryIn)
+	}
+	return msg
+}
+
+// maxReasonSnippet is how much of a non-bencoded error body is kept.
+const maxReasonSnippet = 100
+
+// statusReason describes a failed HTTP response whose body is not a
+// tracker response, such as an HTML error page: the status text followed
+// by the start of the body.
+func statusReason(code int, body []byte) string {
+	reason := http.StatusText(code)
+	snippet := strings.Join(strings.Fields(string(body)), " ")
+	if len(snippet) > maxReasonSnippet {
+		snippet = strings.ToValidUTF8(snippet[:maxReasonSnippet], "") + "..."
+	}
+	switch {
+	case reason == "":
+		return snippet
+	case snippet == "":
+		return reason
+	default:
+		return reason + ": " + snippet
+	}
+}
+
+// readTrackerResponse decodes a bencoded HTTP tracker response and turns
+// failures into a *TrackerError.
+func readTrackerResponse(resp *http.Response) (map[string]interface{}, error) {
+	var reader io.Reader = resp.Body
+	// The transport only decompresses bodies it asked to be compressed.
+	if resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading tracker response: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tracker response: %w", err)
+	}
+
+	decoded, decodeErr := bencode.Decode(body)
+	dict, ok := decoded.(map[string]interface{})
+	if decodeErr != nil || !ok {
+		if resp.StatusCode != http.StatusOK {
+			return nil, &TrackerError{
+				FailureReason: statusReason(resp.StatusCode, body),
+				HTTPStatus:    resp.StatusCode,
+			}
+		}
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		return nil, fmt.Errorf("tracker response invalid format")
+	}
+
+	reason, failed := dict["failure reason"].(string)
+	if !failed && resp.StatusCode == http.StatusOK {
+		return dict, nil
+	}
+
+	terr := &TrackerError{FailureReason: reason}
+	if resp.StatusCode != http.StatusOK {
+		terr.HTTPStatus = resp.StatusCode
+	}
+	terr.WarningMessage, _ = dict["warning message"].(string)
+	switch retry := dict["retry in"].(type) {
+	case int:
+		terr.RetryIn = time.Duration(retry) * time.Minute
+	case string:
+		terr.RetryNever = retry == "never"
+	}
+	return nil, terr
+}
@@ -0,0 +1,340 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// BEP 41 options appended to an announce.
+	udpOptionEnd     = 0
+	udpOptionURLData = 2
+
+	udpConnectionIDTTL = time.Minute
+	udpMaxScrapeHashes = 74
+	// udpMaxPacketSize is the largest UDP payload, so responses listing
+	// many peers are read whole.
+	udpMaxPacketSize   = 65507
+	udpDefaultTimeout  = 15 * time.Second
+	udpDefaultMaxRetry = 8
+)
+
+var errUDPTimeout = errors.New("udp tracker timed out")
+
+type udpConnectionID struct {
+	id       uint64
+	obtained time.Time
+}
+
+// UDPTrackerClient speaks the UDP tracker protocol (BEP 15). Connection IDs
+// are cached per tracker address so repeated announces skip the connect
+// round trip while the ID is still valid.
+type UDPTrackerClient struct {
+	// BaseTimeout is the first retransmission timeout; attempt n waits
+	// BaseTimeout * 2^n.
+	BaseTimeout time.Duration
+	// MaxRetries is the highest n used for retransmission.
+	MaxRetries int
+
+	mu      sync.Mutex
+	connIDs map[string]udpConnectionID
+}
+
+func NewUDPTrackerClient() *UDPTrackerClient {
+	return &UDPTrackerClient{
+		BaseTimeout: udpDefaultTimeout,
+		MaxRetries:  udpDefaultMaxRetry,
+		connIDs:     make(map[string]udpConnectionID),
+	}
+}
+
+func (c *UDPTrackerClient) Announce(ctx context.Context, addr string, req AnnounceRequest) (*AnnounceResponse, error) {
+	return c.announce(ctx, addr, "", req)
+}
+
+// announce announces to the tracker at addr, sending urlData, the path and
+// query of the tracker URL, as BEP 41 URL data so trackers that identify
+// users by path see it.
+func (c *UDPTrackerClient) announce(ctx context.Context, addr, urlData string, req AnnounceRequest) (*AnnounceResponse, error) {
+	payload := make([]byte, 82)
+	copy(payload[0:20], req.InfoHash[:])
+	copy(payload[20:40], req.PeerID[:])
+	binary.BigEndian.PutUint64(payload[40:48], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(payload[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint64(payload[56:64], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(payload[64:68], udpEvent(req.Event))
+	if req.IP.Is4() {
+		copy(payload[68:72], req.IP.AsSlice())
+	}
+	binary.BigEndian.PutUint32(payload[72:76], req.Key)
+	numWant := int32(-1)
+	if req.NumWant > 0 {
+		numWant = int32(req.NumWant)
+	}
+	binary.BigEndian.PutUint32(payload[76:80], uint32(numWant))
+	binary.BigEndian.PutUint16(payload[80:82], req.Port)
+	payload = appendURLData(payload, urlData)
+
+	conn, err := dialUDPTracker(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := c.roundTrip(ctx, conn, addr, udpActionAnnounce, payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("udp announce response too short")
+	}
+
+	result := &AnnounceResponse{
+		Interval: int(binary.BigEndian.Uint32(resp[0:4])),
+		Leechers: int(binary.BigEndian.Uint32(resp[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[8:12])),
+	}
+	// Trackers reached over IPv6 answer with 18-byte IPv6 peer entries.
+	if remote, ok := conn.RemoteAddr().(*net.UDPAddr); ok && remote.IP.To4() == nil {
+		result.Peers = parseCompactPeers6(resp[12:])
+	} else {
+		result.Peers = parseCompactPeers(resp[12:])
+	}
+	return result, nil
+}
+
+// Scrape requests swarm statistics for the given infohashes. Results are
+// returned in the same order as the infohashes.
+func (c *UDPTrackerClient) Scrape(ctx context.Context, addr string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	conn, err := dialUDPTracker(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var results []ScrapeResult
+	for start := 0; start < len(infoHashes); start += udpMaxScrapeHashes {
+		end := start + udpMaxScrapeHashes
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		payload := make([]byte, 0, 20*(end-start))
+		for _, h := range infoHashes[start:end] {
+			payload = append(payload, h[:]...)
+		}
+
+		resp, err := c.roundTrip(ctx, conn, addr, udpActionScrape, payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) < 12*(end-start) {
+			return nil, fmt.Errorf("udp scrape response too short")
+		}
+
+		for i := 0; i < end-start; i++ {
+			entry := resp[i*12 : i*12+12]
+			results = append(results, ScrapeResult{
+				Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+				Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+				Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+			})
+		}
+	}
+	return results, nil
+}
+
+func (c *UDPTrackerClient) timeout(n int) time.Duration {
+	return c.BaseTimeout * time.Duration(1<<n)
+}
+
+func (c *UDPTrackerClient) cachedConnectionID(addr string) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cid, ok := c.connIDs[addr]
+	if !ok || time.Since(cid.obtained) > udpConnectionIDTTL {
+		delete(c.connIDs, addr)
+		return 0, false
+	}
+	return cid.id, true
+}
+
+func (c *UDPTrackerClient) storeConnectionID(addr string, id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connIDs[addr] = udpConnectionID{id: id, obtained: time.Now()}
+}
+
+func (c *UDPTrackerClient) dropConnectionID(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.connIDs, addr)
+}
+
+func dialUDPTracker(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to udp tracker %s: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// roundTrip sends an action to the tracker, connecting first when no valid
+// connection ID is cached, and retransmits with exponential backoff until a
+// response arrives, MaxRetries is exceeded or ctx is done. An error
+// response to a cached connection ID is retried once with a new one, as
+// the tracker may have forgotten it. It returns the response body
+// following the action and transaction ID.
+func (c *UDPTrackerClient) roundTrip(ctx context.Context, conn net.Conn, addr string, action uint32, payload []byte) ([]byte, error) {
+	// Unblock a pending read as soon as the context is cancelled.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	reconnected := false
+	for n := 0; n <= c.MaxRetries; n++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		connID, cached := c.cachedConnectionID(addr)
+		if !cached {
+			packet := make([]byte, 16)
+			binary.BigEndian.PutUint64(packet[0:8], udpProtocolID)
+			binary.BigEndian.PutUint32(packet[8:12], udpActionConnect)
+
+			resp, err := udpExchange(ctx, conn, packet, udpActionConnect, c.timeout(n))
+			if errors.Is(err, errUDPTimeout) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(resp) < 8 {
+				return nil, fmt.Errorf("udp connect response too short")
+			}
+			connID = binary.BigEndian.Uint64(resp[0:8])
+			c.storeConnectionID(addr, connID)
+		}
+
+		packet := make([]byte, 16+len(payload))
+		binary.BigEndian.PutUint64(packet[0:8], connID)
+		binary.BigEndian.PutUint32(packet[8:12], action)
+		copy(packet[16:], payload)
+
+		resp, err := udpExchange(ctx, conn, packet, action, c.timeout(n))
+		if errors.Is(err, errUDPTimeout) {
+			continue
+		}
+		var terr *TrackerError
+		if cached && !reconnected && errors.As(err, &terr) {
+			c.dropConnectionID(addr)
+			reconnected = true
+			n--
+			continue
+		}
+		return resp, err
+	}
+
+	return nil, errUDPTimeout
+}
+
+// udpExchange writes packet with a fresh transaction ID and waits up to
+// timeout for the matching response, ignoring stray packets.
+func udpExchange(ctx context.Context, conn net.Conn, packet []byte, action uint32, timeout time.Duration) ([]byte, error) {
+	var txBuf [4]byte
+	if _, err := rand.Read(txBuf[:]); err != nil {
+		return nil, err
+	}
+	copy(packet[12:16], txBuf[:])
+	txID := binary.BigEndian.Uint32(txBuf[:])
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("error writing udp tracker request: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	ctxDeadline, hasCtxDeadline := ctx.Deadline()
+	if hasCtxDeadline && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return nil, ctxErr
+				}
+				if hasCtxDeadline && !time.Now().Before(ctxDeadline) {
+					return nil, context.DeadlineExceeded
+				}
+				return nil, errUDPTimeout
+			}
+			return nil, fmt.Errorf("error reading udp tracker response: %w", err)
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != txID {
+			continue
+		}
+
+		respAction := binary.BigEndian.Uint32(buf[0:4])
+		body := append([]byte(nil), buf[8:n]...)
+		switch respAction {
+		case action:
+			return body, nil
+		case udpActionError:
+			return nil, &TrackerError{FailureReason: string(body)}
+		default:
+			return nil, fmt.Errorf("unexpected udp tracker action %d", respAction)
+		}
+	}
+}
+
+// appendURLData appends urlData to an announce payload as BEP 41 URL data
+// options of up to 255 bytes each.
+func appendURLData(payload []byte, urlData string) []byte {
+	if urlData == "" {
+		return payload
+	}
+	for len(urlData) > 0 {
+		n := min(len(urlData), 255)
+		payload = append(payload, udpOptionURLData, byte(n))
+		payload = append(payload, urlData[:n]...)
+		urlData = urlData[n:]
+	}
+	return append(payload, udpOptionEnd)
+}
+
+func udpEvent(event string) uint32 {
+	switch event {
+	case "completed":
+		return 1
+	case "started":
+		return 2
+	case "stopped":
+		return 3
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,257 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testUDPTracker struct {
+	conn     *net.UDPConn
+	connects atomic.Int32
+	dropNext atomic.Int32
+	// morePeers is the number of peers listed after the first two.
+	morePeers atomic.Int32
+	failWith  string
+}
+
+func newTestUDPTracker(t *testing.T, failWith string) *testUDPTracker {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &testUDPTracker{conn: conn, failWith: failWith}
+	t.Cleanup(func() { conn.Close() })
+	go tr.serve()
+	return tr
+}
+
+func (tr *testUDPTracker) addr() string {
+	return tr.conn.LocalAddr().String()
+}
+
+func (tr *testUDPTracker) serve() {
+	const connID = 0x1122334455667788
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := tr.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if tr.dropNext.Load() > 0 {
+			tr.dropNext.Add(-1)
+			continue
+		}
+		if n < 16 {
+			continue
+		}
+
+		action := binary.BigEndian.Uint32(buf[8:12])
+		txID := buf[12:16]
+		resp := make([]byte, 8)
+		binary.BigEndian.PutUint32(resp[0:4], action)
+		copy(resp[4:8], txID)
+
+		switch {
+		case action == udpActionConnect:
+			if binary.BigEndian.Uint64(buf[0:8]) != udpProtocolID {
+				continue
+			}
+			tr.connects.Add(1)
+			resp = binary.BigEndian.AppendUint64(resp, connID)
+		case binary.BigEndian.Uint64(buf[0:8]) != connID:
+			binary.BigEndian.PutUint32(resp[0:4], udpActionError)
+			resp = append(resp, "connection ID mismatch"...)
+		case tr.failWith != "":
+			binary.BigEndian.PutUint32(resp[0:4], udpActionError)
+			resp = append(resp, tr.failWith...)
+		case action == udpActionAnnounce:
+			resp = binary.BigEndian.AppendUint32(resp, 1800) // interval
+			resp = binary.BigEndian.AppendUint32(resp, 3)    // leechers
+			resp = binary.BigEndian.AppendUint32(resp, 5)    // seeders
+			resp = append(resp, 10, 0, 0, 1, 0x1a, 0xe1)
+			resp = append(resp, 10, 0, 0, 2, 0x1a, 0xe2)
+			for i := 0; i < int(tr.morePeers.Load()); i++ {
+				resp = append(resp, 10, 1, byte(i>>8), byte(i), 0x1a, 0xe1)
+			}
+		case action == udpActionScrape:
+			for i := 16; i+20 <= n; i += 20 {
+				resp = binary.BigEndian.AppendUint32(resp, uint32(buf[i])) // seeders
+				resp = binary.BigEndian.AppendUint32(resp, 7)              // completed
+				resp = binary.BigEndian.AppendUint32(resp, 2)              // leechers
+			}
+		}
+		tr.conn.WriteToUDP(resp, from)
+	}
+}
+
+func newTestUDPClient() *UDPTrackerClient {
+	c := NewUDPTrackerClient()
+	c.BaseTimeout = 50 * time.Millisecond
+	c.MaxRetries = 3
+	return c
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	tr := newTestUDPTracker(t, "")
+	client := newTestUDPClient()
+
+	resp, err := client.Announce(context.Background(), tr.addr(), AnnounceRequest{Port: 6881, Event: "started"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 1800 || resp.Leechers != 3 || resp.Seeders != 5 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].String() != "10.0.0.1:6881" || resp.Peers[1].String() != "10.0.0.2:6882" {
+		t.Errorf("unexpected peers %v", resp.Peers)
+	}
+
+	if _, err := client.Announce(context.Background(), tr.addr(), AnnounceRequest{Port: 6881}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.connects.Load(); got != 1 {
+		t.Errorf("expected connection ID to be reused, got %d connects", got)
+	}
+}
+
+func TestUDPTrackerManyPeers(t *testing.T) {
+	tr := newTestUDPTracker(t, "")
+	tr.morePeers.Store(1000)
+	client := newTestUDPClient()
+
+	resp, err := client.Announce(context.Background(), tr.addr(), AnnounceRequest{Port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1002 || resp.Peers[1001].String() != "10.1.3.231:6881" {
+		t.Errorf("got %d peers, want all 1002", len(resp.Peers))
+	}
+}
+
+func TestUDPTrackerRetransmits(t *testing.T) {
+	tr := newTestUDPTracker(t, "")
+	tr.dropNext.Store(2)
+	client := newTestUDPClient()
+
+	if _, err := client.Announce(context.Background(), tr.addr(), AnnounceRequest{Port: 6881}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPTrackerTimeout(t *testing.T) {
+	tr := newTestUDPTracker(t, "")
+	tr.dropNext.Store(100)
+	client := newTestUDPClient()
+	client.MaxRetries = 1
+
+	if _, err := client.Announce(context.Background(), tr.addr(), AnnounceRequest{}); err != errUDPTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestUDPTrackerErrorAction(t *testing.T) {
+	tr := newTestUDPTracker(t, "torrent not registered")
+	client := newTestUDPClient()
+
+	_, err := client.Announce(context.Background(), tr.addr(), AnnounceRequest{})
+	if err == nil || err.Error() != "tracker error: torrent not registered" {
+		t.Fatalf("expected tracker error, got %v", err)
+	}
+}
+
+func TestUDPTrackerStaleConnectionID(t *testing.T) {
+	tr := newTestUDPTracker(t, "")
+	client := newTestUDPClient()
+	client.storeConnectionID(tr.addr(), 1)
+
+	if _, err := client.Announce(context.Background(), tr.addr(), AnnounceRequest{Port: 6881}); err != nil {
+		t.Fatal(err)
+	}
+	if n := tr.connects.Load(); n != 1 {
+		t.Errorf("connected %d times, want 1", n)
+	}
+
+	// A tracker that keeps refusing is reported after one reconnect.
+	failing := newTestUDPTracker(t, "torrent not registered")
+	if _, err := client.Announce(context.Background(), failing.addr(), AnnounceRequest{}); err == nil {
+		t.Fatal("expected tracker error")
+	}
+	if _, err := client.Announce(context.Background(), failing.addr(), AnnounceRequest{}); err == nil {
+		t.Fatal("expected tracker error")
+	}
+	if n := failing.connects.Load(); n != 2 {
+		t.Errorf("connected %d times, want 2", n)
+	}
+}
+
+func TestAppendURLData(t *testing.T) {
+	if got := appendURLData([]byte{9}, ""); len(got) != 1 {
+		t.Errorf("options added without URL data: %v", got)
+	}
+
+	urlData := "/" + strings.Repeat("a", 300)
+	got := appendURLData(nil, urlData)
+	want := append([]byte{udpOptionURLData, 255}, urlData[:255]...)
+	want = append(want, udpOptionURLData, 46)
+	want = append(want, urlData[255:]...)
+	want = append(want, udpOptionEnd)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got options %q, want %q", got, want)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	tr := newTestUDPTracker(t, "")
+	client := newTestUDPClient()
+
+	hashes := [][20]byte{{1}, {2}, {3}}
+	results, err := client.Scrape(context.Background(), tr.addr(), hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for i, r := range results {
+		if r.Seeders != i+1 || r.Completed != 7 || r.Leechers != 2 {
+			t.Errorf("result %d: unexpected %+v", i, r)
+		}
+	}
+}
+
+func TestDiscoverPeersUDP(t *testing.T) {
+	tr := newTestUDPTracker(t, "")
+
+	torrent := Torrent{TrackerURL: "udp://" + tr.addr() + "/announce", Length: 1}
+	peers, err := DiscoverPeers(torrent, []byte("-PB0001-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+}
+
+func TestUDPTrackerContextCancel(t *testing.T) {
+	tr := newTestUDPTracker(t, "")
+	tr.dropNext.Store(100)
+	client := NewUDPTrackerClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.Announce(ctx, tr.addr(), AnnounceRequest{})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("announce ignored the context deadline")
+	}
+}
@@ -0,0 +1,297 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// maxRequestLength is the largest block a peer may request.
+const maxRequestLength = 128 * 1024
+
+type blockRequest struct {
+	index  uint32
+	begin  uint32
+	length uint32
+}
+
+func parseBlockRequest(payload []byte) (blockRequest, bool) {
+	if len(payload) != 12 {
+		return blockRequest{}, false
+	}
+	return blockRequest{
+		index:  binary.BigEndian.Uint32(payload[0:4]),
+		begin:  binary.BigEndian.Uint32(payload[4:8]),
+		length: binary.BigEndian.Uint32(payload[8:12]),
+	}, true
+}
+
+// handleInterested records whether the peer wants to download from us.
+// A newly interested peer is unchoked right away while upload slots are
+// free; otherwise it waits for the choker.
+func (pm *PeerManager) handleInterested(peer *PeerConn, interested bool) {
+	peer.mu.Lock()
+	peer.interested = interested
+	choked := peer.amChoking
+	peer.mu.Unlock()
+
+	if interested && choked && pm.unchokedCount() < pm.uploadSlotsWithOptimistic() {
+		pm.setChoking(peer, false)
+	}
+}
+
+// unchokedCount returns the number of peers we unchoke.
+func (pm *PeerManager) unchokedCount() int {
+	pm.mu.Lock()
+	peers := append([]*PeerConn(nil), pm.peers...)
+	pm.mu.Unlock()
+
+	n := 0
+	for _, p := range peers {
+		p.mu.Lock()
+		if !p.amChoking {
+			n++
+		}
+		p.mu.Unlock()
+	}
+	return n
+}
+
+func (pm *PeerManager) uploadSlotsWithOptimistic() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.uploadSlots + 1
+}
+
+// setChoking chokes or unchokes the peer. Choking drops the requests it
+// has queued, rejecting them explicitly when the peer uses the Fast
+// Extension, except those for allowed fast pieces.
+func (pm *PeerManager) setChoking(peer *PeerConn, choke bool) error {
+	peer.mu.Lock()
+	if peer.amChoking == choke {
+		peer.mu.Unlock()
+		return nil
+	}
+	peer.amChoking = choke
+	if !choke {
+		peer.lastUnchoked = time.Now()
+	}
+	var dropped []blockRequest
+	if choke {
+		kept := peer.requests[:0]
+		for _, req := range peer.requests {
+			if peer.ourAllowedFast[req.index] {
+				kept = append(kept, req)
+			} else {
+				dropped = append(dropped, req)
+			}
+		}
+		peer.requests = kept
+	}
+	peer.mu.Unlock()
+
+	id := uint8(MsgUnchoke)
+	if choke {
+		id = MsgChoke
+	}
+	if err := peer.Send(NewMessage(id)); err != nil {
+		return err
+	}
+	for _, req := range dropped {
+		pm.rejectRequest(peer, req)
+	}
+	return nil
+}
+
+// queueRequest queues a block the peer asked for. Requests for pieces we
+// do not have, requests while we choke the peer, unless for an allowed
+// fast piece, and requests beyond maxQueuedRequests are dropped, and
+// rejected if the peer uses the Fast Extension.
+func (pm *PeerManager) queueRequest(peer *PeerConn, payload []byte) {
+	req, ok := parseBlockRequest(payload)
+	if !ok {
+		fmt.Println("invalid request message payload length")
+		return
+	}
+	if int(req.index) >= len(pm.torrent.Pieces) || !pm.HasPiece(req.index) ||
+		req.length == 0 || req.length > maxRequestLength ||
+		uint64(req.begin)+uint64(req.length) > uint64(pm.torrent.PieceSize(req.index)) {
+		fmt.Printf("Ignoring invalid request for piece %d\n", req.index)
+		pm.rejectRequest(peer, req)
+		return
+	}
+
+	peer.mu.Lock()
+	if (peer.amChoking && !peer.ourAllowedFast[req.index]) || len(peer.requests) >= maxQueuedRequests {
+		peer.mu.Unlock()
+		pm.rejectRequest(peer, req)
+		return
+	}
+	peer.requests = append(peer.requests, req)
+	peer.mu.Unlock()
+
+	select {
+	case peer.requestC <- struct{}{}:
+	default:
+	}
+}
+
+// cancelRequest drops a queued request the peer no longer wants. Peers
+// using the Fast Extension expect a reject for it.
+func (pm *PeerManager) cancelRequest(peer *PeerConn, payload []byte) {
+	req, ok := parseBlockRequest(payload)
+	if !ok {
+		fmt.Println("invalid cancel message payload length")
+		return
+	}
+
+	peer.mu.Lock()
+	cancelled := false
+	for i, r := range peer.requests {
+		if r == req {
+			peer.requests = append(peer.requests[:i], peer.requests[i+1:]...)
+			cancelled = true
+			break
+		}
+	}
+	peer.mu.Unlock()
+
+	if cancelled {
+		pm.rejectRequest(peer, req)
+	}
+}
+
+func (p *PeerConn) nextRequest() (blockRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.requests) == 0 {
+		return blockRequest{}, false
+	}
+	req := p.requests[0]
+	p.requests = p.requests[1:]
+	return req, true
+}
+
+// serveRequests sends the peer the blocks it requested until it is
+// removed.
+func (pm *PeerManager) serveRequests(peer *PeerConn) {
+	for {
+		select {
+		case <-peer.requestC:
+		case <-peer.closeC:
+			return
+		}
+
+		for {
+			req, ok := peer.nextRequest()
+			if !ok {
+				break
+			}
+			start := int64(req.index)*int64(pm.torrent.PieceLength) + int64(req.begin)
+			block, err := pm.readPieceData(start, int(req.length))
+			if err != nil {
+				fmt.Printf("Error reading piece %d: %v\n", req.index, err)
+				continue
+			}
+
+			payload := make([]byte, 8+len(block))
+			binary.BigEndian.PutUint32(payload[0:4], req.index)
+			binary.BigEndian.PutUint32(payload[4:8], req.begin)
+			copy(payload[8:], block)
+			if err := peer.Send(&Message{ID: MsgPiece, Payload: payload}); err != nil {
+				return
+			}
+			pm.uploaded.Add(int64(len(block)))
+			peer.uploaded.Add(int64(len(block)))
+		}
+	}
+}
+
+// readPieceData reads length bytes at offset of the torrent's data from
+// the files they span.
+func (pm *PeerManager) readPieceData(offset int64, length int) ([]byte, error) {
+	data := make([]byte, length)
+	dataOffset := 0
+	currentOffset := offset
+
+	for _, f := range pm.files {
+		if currentOffset >= f.Length {
+			currentOffset -= f.Length
+			continue
+		}
+
+		readLen := int(min(f.Length-currentOffset, int64(length-dataOffset)))
+		pm.fileMu.Lock()
+		n, err := f.file.ReadAt(data[dataOffset:dataOffset+readLen], currentOffset)
+		pm.fileMu.Unlock()
+		if n != readLen {
+			return nil, fmt.Errorf("short read on file %s: %v", f.Path, err)
+		}
+
+		dataOffset += readLen
+		currentOffset = 0
+		if dataOffset == length {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("readPieceData: read beyond torrent size")
+}
+
+// bitfield returns the pieces we have in the wire format of a Bitfield
+// message.
+func (pm *PeerManager) bitfield() ([]byte, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	bitfield := make([]byte, (len(pm.have)+7)/8)
+	for i, have := range pm.have {
+		if have {
+			bitfield[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return bitfield, pm.haveCount > 0
+}
+
+// sendBitfield tells a new peer which pieces we have and returns the
+// pieces it was told about. Nothing is sent when we have none, unless the
+// peer uses the Fast Extension, which has Have All and Have None for either
+// extreme.
+func (pm *PeerManager) sendBitfield(peer *PeerConn) ([]byte, error) {
+	bitfield, ok := pm.bitfield()
+	switch {
+	case peer.fast && pm.IsComplete():
+		for i := range pm.torrent.Pieces {
+			bitfield[i/8] |= 1 << (7 - i%8)
+		}
+		return bitfield, peer.Send(NewMessage(MsgHaveAll))
+	case peer.fast && !ok:
+		return bitfield, peer.Send(NewMessage(MsgHaveNone))
+	case !ok:
+		return bitfield, nil
+	}
+	return bitfield, peer.Send(&Message{ID: MsgBitfield, Payload: bitfield})
+}
+
+// Verify checks the data already on disk against the piece hashes and marks
+// the pieces that match as complete, so existing downloads are resumed and
+// complete ones seeded. Pieces that cannot be read, e.g. beyond the end of
+// a partly written file, are left missing. It returns the number of
+// verified pieces.
+func (pm *PeerManager) Verify() int {
+	verified := 0
+	for index := range pm.torrent.Pieces {
+		start := int64(index) * int64(pm.torrent.PieceLength)
+		data, err := pm.readPieceData(start, pm.torrent.PieceSize(uint32(index)))
+		if err != nil {
+			continue
+		}
+		hash := sha1.Sum(data)
+		if bytes.Equal(hash[:], pm.torrent.Pieces[index]) {
+			pm.markHave(uint32(index))
+			verified++
+		}
+	}
+	return verified
+}
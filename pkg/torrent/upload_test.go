@@ -0,0 +1,204 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestTorrent returns a single-file torrent of random data split into
+// pieces of pieceLength, and the data.
+func newTestTorrent(t *testing.T, length, pieceLength int) (*Torrent, []byte) {
+	t.Helper()
+	data := make([]byte, length)
+	rand.Read(data)
+
+	torrent := &Torrent{Length: length, PieceLength: pieceLength}
+	rand.Read(torrent.InfoHash[:])
+	for start := 0; start < length; start += pieceLength {
+		hash := sha1.Sum(data[start:min(start+pieceLength, length)])
+		torrent.Pieces = append(torrent.Pieces, hash[:])
+	}
+	return torrent, data
+}
+
+// newSeeder returns a PeerManager holding all of the torrent's data.
+func newSeeder(t *testing.T, torrent *Torrent, data []byte) *PeerManager {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pm, err := NewPeerManager(torrent, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pm.Verify(); n != len(torrent.Pieces) {
+		t.Fatalf("verified %d pieces, want %d", n, len(torrent.Pieces))
+	}
+	return pm
+}
+
+func TestVerifyPartialData(t *testing.T) {
+	torrent, data := newTestTorrent(t, 3*blockSize+100, 2*blockSize)
+	dir := t.TempDir()
+	// Only the first piece is on disk.
+	if err := os.WriteFile(filepath.Join(dir, "file"), data[:2*blockSize], 0644); err != nil {
+		t.Fatal(err)
+	}
+	pm, err := NewPeerManager(torrent, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pm.Verify(); n != 1 || !pm.HasPiece(0) || pm.HasPiece(1) {
+		t.Errorf("verified %d pieces", n)
+	}
+	if bitfield, _ := pm.bitfield(); !bytes.Equal(bitfield, []byte{0x80}) {
+		t.Errorf("got bitfield %08b", bitfield)
+	}
+}
+
+func TestSeedToLeecher(t *testing.T) {
+	torrent, data := newTestTorrent(t, 5*blockSize+1234, 2*blockSize)
+	seeder := newSeeder(t, torrent, data)
+
+	seederID := GeneratePeerID()
+	l, err := Listen("127.0.0.1:0", seederID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Add(seeder)
+
+	dir := t.TempDir()
+	leecher, err := NewPeerManager(torrent, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leecherID := GeneratePeerID()
+	addr := netip.MustParseAddrPort(l.Addr().String())
+	leecher.ConnectPeers([]Peer{{Addr: addr}}, leecherID[:])
+
+	select {
+	case <-leecher.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not complete")
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data differs")
+	}
+	if up := seeder.Uploaded(); up < int64(len(data)) {
+		t.Errorf("seeder uploaded %d bytes, want at least %d", up, len(data))
+	}
+}
+
+func TestListenerRejectsUnknownTorrent(t *testing.T) {
+	torrent, data := newTestTorrent(t, blockSize, blockSize)
+	l, err := Listen("127.0.0.1:0", GeneratePeerID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Add(newSeeder(t, torrent, data))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	h := Handshake{PeerID: make([]byte, 20), InfoHash: [20]byte{0xff}}
+	if _, err := conn.Write(h.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 68)); err == nil {
+		t.Errorf("got %d bytes of handshake for an unknown torrent", n)
+	}
+}
+
+func requestPayload(index, begin, length uint32) []byte {
+	return NewRequestMessage(index, begin, length).Payload
+}
+
+func TestRequestQueue(t *testing.T) {
+	torrent, data := newTestTorrent(t, 2*blockSize, blockSize)
+	pm := newSeeder(t, torrent, data)
+	peer := newPeerConn(nil, [20]byte{}, netip.AddrPort{})
+
+	// Requests from a choked peer are ignored.
+	pm.queueRequest(peer, requestPayload(0, 0, blockSize))
+	if len(peer.requests) != 0 {
+		t.Fatal("request from choked peer queued")
+	}
+
+	peer.amChoking = false
+	pm.queueRequest(peer, requestPayload(0, 0, blockSize))
+	pm.queueRequest(peer, requestPayload(1, 0, blockSize))
+	// Out of range, too long and malformed requests are dropped.
+	pm.queueRequest(peer, requestPayload(2, 0, blockSize))
+	pm.queueRequest(peer, requestPayload(1, 1, blockSize))
+	pm.queueRequest(peer, requestPayload(0, 0, maxRequestLength+1))
+	pm.queueRequest(peer, []byte{1, 2, 3})
+	if len(peer.requests) != 2 {
+		t.Fatalf("got %d queued requests, want 2", len(peer.requests))
+	}
+
+	pm.cancelRequest(peer, requestPayload(0, 0, blockSize))
+	if len(peer.requests) != 1 || peer.requests[0] != (blockRequest{1, 0, blockSize}) {
+		t.Errorf("got %v after cancel", peer.requests)
+	}
+}
+
+func TestServeRequests(t *testing.T) {
+	torrent, data := newTestTorrent(t, 2*blockSize, blockSize)
+	pm := newSeeder(t, torrent, data)
+	peer, remote := newPipePeer(t, pm, netip.AddrPort{})
+	go pm.serveRequests(peer)
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := remote.Write(NewMessage(MsgInterested).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := ReadMessage(remote); err != nil || msg.ID != MsgUnchoke {
+		t.Fatalf("got %v, %v, want unchoke", msg, err)
+	}
+
+	if _, err := remote.Write(NewRequestMessage(1, 100, 200).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ReadMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != MsgPiece || binary.BigEndian.Uint32(msg.Payload[0:4]) != 1 ||
+		binary.BigEndian.Uint32(msg.Payload[4:8]) != 100 ||
+		!bytes.Equal(msg.Payload[8:], data[blockSize+100:blockSize+300]) {
+		t.Errorf("got message %d with %d bytes", msg.ID, len(msg.Payload))
+	}
+}
+
+func TestReadMessageTooLong(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go func() {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, maxMessageLength+1)
+		remote.Write(length)
+	}()
+	if msg, err := ReadMessage(local); err == nil {
+		t.Fatalf("read message of %d bytes, want an error", len(msg.Payload)+1)
+	}
+}
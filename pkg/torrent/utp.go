@@ -0,0 +1,39 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/utp"
+)
+
+// utpDialTimeout bounds the uTP connection attempt made before falling
+// back to TCP.
+const utpDialTimeout = 3 * time.Second
+
+// SetUTP makes connections to peers try uTP over socket before TCP.
+func (pm *PeerManager) SetUTP(socket *utp.Socket) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.utp = socket
+}
+
+// dial connects to addr over uTP if we have a socket for it, and over TCP
+// otherwise or when the peer does not answer uTP.
+func (pm *PeerManager) dial(addr netip.AddrPort) (net.Conn, error) {
+	pm.mu.Lock()
+	socket := pm.utp
+	pm.mu.Unlock()
+
+	if socket != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), utpDialTimeout)
+		conn, err := socket.DialContext(ctx, addr.String())
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return dialTCP(addr)
+}
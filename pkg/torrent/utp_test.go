@@ -0,0 +1,93 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/utp"
+)
+
+// download fetches torrent from addr into a new directory with a leecher
+// that dials over socket and returns the data.
+func download(t *testing.T, torrent *Torrent, addr netip.AddrPort, socket *utp.Socket) []byte {
+	t.Helper()
+	dir := t.TempDir()
+	leecher, err := NewPeerManager(torrent, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leecher.SetUTP(socket)
+	peerID := GeneratePeerID()
+	leecher.ConnectPeers([]Peer{{Addr: addr}}, peerID[:])
+
+	select {
+	case <-leecher.Done():
+	case <-time.After(15 * time.Second):
+		t.Fatal("download did not complete")
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func newUTPSocket(t *testing.T, addr string) *utp.Socket {
+	t.Helper()
+	socket, err := utp.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { socket.Close() })
+	return socket
+}
+
+func TestSeedToLeecherOverUTP(t *testing.T) {
+	torrent, data := newTestTorrent(t, 5*blockSize+1234, 2*blockSize)
+	seeder := newSeeder(t, torrent, data)
+
+	l, err := Listen("127.0.0.1:0", GeneratePeerID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Serve(newUTPSocket(t, fmt.Sprintf("127.0.0.1:%d", l.Port())))
+	l.Add(seeder)
+
+	addr := netip.MustParseAddrPort(l.Addr().String())
+	if got := download(t, torrent, addr, newUTPSocket(t, "127.0.0.1:0")); !bytes.Equal(got, data) {
+		t.Error("downloaded data differs")
+	}
+
+	seeder.mu.Lock()
+	defer seeder.mu.Unlock()
+	if len(seeder.peers) != 1 {
+		t.Fatalf("seeder has %d peers", len(seeder.peers))
+	}
+	if _, ok := seeder.peers[0].Conn.RemoteAddr().(*net.UDPAddr); !ok {
+		t.Errorf("leecher connected from %s, not over uTP", seeder.peers[0].Conn.RemoteAddr())
+	}
+}
+
+func TestUTPFallsBackToTCP(t *testing.T) {
+	torrent, data := newTestTorrent(t, 2*blockSize, blockSize)
+	seeder := newSeeder(t, torrent, data)
+
+	l, err := Listen("127.0.0.1:0", GeneratePeerID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Add(seeder)
+
+	addr := netip.MustParseAddrPort(l.Addr().String())
+	if got := download(t, torrent, addr, newUTPSocket(t, "127.0.0.1:0")); !bytes.Equal(got, data) {
+		t.Error("downloaded data differs")
+	}
+}
@@ -0,0 +1,227 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
+)
+
+// ServeHTTP answers /announce and /scrape, optionally prefixed with a
+// passkey path element when the server is private.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var passkey, action string
+	switch len(parts) {
+	case 1:
+		action = parts[0]
+	case 2:
+		passkey, action = parts[0], parts[1]
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if action != "announce" && action != "scrape" {
+		http.NotFound(w, r)
+		return
+	}
+	if err := s.checkPasskey(passkey); err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		writeFailure(w, fmt.Errorf("invalid query: %v", err))
+		return
+	}
+
+	if action == "announce" {
+		s.serveAnnounce(w, r, query)
+	} else {
+		s.serveScrape(w, query)
+	}
+}
+
+func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request, query url.Values) {
+	a, err := parseHTTPAnnounce(r, query)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	peers, st, err := s.handleAnnounce(a)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"interval":     durationSeconds(s.interval),
+		"min interval": durationSeconds(s.minInterval),
+		"complete":     st.seeders,
+		"incomplete":   st.leechers,
+		"downloaded":   st.completed,
+	}
+
+	if query.Get("compact") != "0" {
+		var peers4, peers6 []byte
+		for _, p := range peers {
+			if p.addr4.IsValid() {
+				peers4 = appendCompact(peers4, p.addr4)
+			}
+			if p.addr6.IsValid() {
+				peers6 = appendCompact(peers6, p.addr6)
+			}
+		}
+		resp["peers"] = peers4
+		if len(peers6) > 0 {
+			resp["peers6"] = peers6
+		}
+	} else {
+		noPeerID := query.Get("no_peer_id") == "1"
+		list := []interface{}{}
+		for _, p := range peers {
+			for _, addr := range []netip.AddrPort{p.addr4, p.addr6} {
+				if !addr.IsValid() {
+					continue
+				}
+				entry := map[string]interface{}{
+					"ip":   addr.Addr().String(),
+					"port": int(addr.Port()),
+				}
+				if !noPeerID {
+					entry["peer id"] = p.id
+				}
+				list = append(list, entry)
+			}
+		}
+		resp["peers"] = list
+	}
+
+	writeBencode(w, resp)
+}
+
+func (s *Server) serveScrape(w http.ResponseWriter, query url.Values) {
+	files := map[string]interface{}{}
+	for _, raw := range query["info_hash"] {
+		if len(raw) != 20 {
+			writeFailure(w, fmt.Errorf("invalid info_hash"))
+			return
+		}
+		st, ok := s.scrape([20]byte([]byte(raw)))
+		if !ok {
+			continue
+		}
+		files[raw] = map[string]interface{}{
+			"complete":   st.seeders,
+			"downloaded": st.completed,
+			"incomplete": st.leechers,
+		}
+	}
+
+	writeBencode(w, map[string]interface{}{"files": files})
+}
+
+func parseHTTPAnnounce(r *http.Request, query url.Values) (announce, error) {
+	var a announce
+
+	infoHash := query.Get("info_hash")
+	if len(infoHash) != 20 {
+		return a, fmt.Errorf("invalid info_hash")
+	}
+	a.infoHash = [20]byte([]byte(infoHash))
+
+	a.peerID = query.Get("peer_id")
+	if len(a.peerID) != 20 {
+		return a, fmt.Errorf("invalid peer_id")
+	}
+
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return a, fmt.Errorf("invalid port")
+	}
+
+	a.left, err = strconv.ParseInt(query.Get("left"), 10, 64)
+	if err != nil {
+		return a, fmt.Errorf("invalid left")
+	}
+
+	a.numWant = -1
+	if nw := query.Get("numwant"); nw != "" {
+		if a.numWant, err = strconv.Atoi(nw); err != nil || a.numWant < 0 {
+			return a, fmt.Errorf("invalid numwant")
+		}
+	}
+
+	switch a.event = query.Get("event"); a.event {
+	case "", "started", "completed", "stopped", "paused":
+	default:
+		return a, fmt.Errorf("invalid event")
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return a, fmt.Errorf("invalid remote address")
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil {
+		return a, fmt.Errorf("invalid remote address")
+	}
+	remote = remote.Unmap()
+	if remote.Is4() {
+		a.addr4 = netip.AddrPortFrom(remote, uint16(port))
+	} else {
+		a.addr6 = netip.AddrPortFrom(remote, uint16(port))
+	}
+
+	// BEP 7: a dual-stack client reports its address in the other family.
+	if v, ok := parseAddrParam(query.Get("ipv4"), uint16(port)); ok && v.Addr().Is4() && !a.addr4.IsValid() {
+		a.addr4 = v
+	}
+	if v, ok := parseAddrParam(query.Get("ipv6"), uint16(port)); ok && v.Addr().Is6() && !a.addr6.IsValid() {
+		a.addr6 = v
+	}
+
+	return a, nil
+}
+
+// parseAddrParam accepts either a bare address or an address with port.
+func parseAddrParam(value string, port uint16) (netip.AddrPort, bool) {
+	if value == "" {
+		return netip.AddrPort{}, false
+	}
+	if ap, err := netip.ParseAddrPort(value); err == nil {
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), port), true
+	}
+	return netip.AddrPort{}, false
+}
+
+func appendCompact(b []byte, addr netip.AddrPort) []byte {
+	b = append(b, addr.Addr().AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+func writeFailure(w http.ResponseWriter, err error) {
+	writeBencode(w, map[string]interface{}{"failure reason": err.Error()})
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	data, err := bencode.Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
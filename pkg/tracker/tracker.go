@@ -0,0 +1,269 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval    = 30 * time.Minute
+	defaultMinInterval = 5 * time.Minute
+	defaultNumWant     = 50
+	maxNumWant         = 200
+)
+
+type Config struct {
+	// Interval is the re-announce interval handed to clients.
+	Interval time.Duration
+	// MinInterval is the minimum re-announce interval handed to clients.
+	MinInterval time.Duration
+	// PeerTTL is how long a peer stays in a swarm without announcing.
+	// Defaults to twice Interval.
+	PeerTTL time.Duration
+	// Whitelist restricts the tracker to the given infohashes. An empty
+	// whitelist allows every torrent.
+	Whitelist [][20]byte
+	// Passkeys enables private tracking: every request must carry one of
+	// these keys as the first path element, e.g. /<passkey>/announce.
+	Passkeys []string
+}
+
+type peer struct {
+	id       string
+	addr4    netip.AddrPort
+	addr6    netip.AddrPort
+	left     int64
+	lastSeen time.Time
+}
+
+func (p *peer) seeding() bool {
+	return p.left == 0
+}
+
+type swarm struct {
+	peers     map[string]*peer
+	completed int
+}
+
+type announce struct {
+	infoHash [20]byte
+	peerID   string
+	addr4    netip.AddrPort
+	addr6    netip.AddrPort
+	left     int64
+	event    string
+	numWant  int
+}
+
+type stats struct {
+	seeders   int
+	leechers  int
+	completed int
+}
+
+// Server is an in-memory BitTorrent tracker speaking the HTTP announce and
+// scrape protocol as well as the UDP tracker protocol (BEP 15).
+type Server struct {
+	interval    time.Duration
+	minInterval time.Duration
+	peerTTL     time.Duration
+	whitelist   map[[20]byte]bool
+	passkeys    map[string]bool
+	secret      [32]byte
+
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+
+	closeOnce sync.Once
+	closeC    chan struct{}
+}
+
+func NewServer(cfg Config) *Server {
+	s := &Server{
+		interval:    cfg.Interval,
+		minInterval: cfg.MinInterval,
+		peerTTL:     cfg.PeerTTL,
+		swarms:      make(map[[20]byte]*swarm),
+		closeC:      make(chan struct{}),
+	}
+	if s.interval <= 0 {
+		s.interval = defaultInterval
+	}
+	if s.minInterval <= 0 {
+		s.minInterval = min(defaultMinInterval, s.interval)
+	}
+	if s.peerTTL <= 0 {
+		s.peerTTL = 2 * s.interval
+	}
+	if len(cfg.Whitelist) > 0 {
+		s.whitelist = make(map[[20]byte]bool)
+		for _, h := range cfg.Whitelist {
+			s.whitelist[h] = true
+		}
+	}
+	if len(cfg.Passkeys) > 0 {
+		s.passkeys = make(map[string]bool)
+		for _, k := range cfg.Passkeys {
+			s.passkeys[k] = true
+		}
+	}
+	rand.Read(s.secret[:])
+
+	go s.expireLoop()
+	return s
+}
+
+// Close stops the background peer expiry.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.closeC) })
+}
+
+func (s *Server) expireLoop() {
+	ticker := time.NewTicker(s.peerTTL / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.expire(time.Now())
+		case <-s.closeC:
+			return
+		}
+	}
+}
+
+// expire drops peers that have not announced within the peer TTL and
+// forgets swarms that become empty.
+func (s *Server) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, sw := range s.swarms {
+		for id, p := range sw.peers {
+			if now.Sub(p.lastSeen) > s.peerTTL {
+				delete(sw.peers, id)
+			}
+		}
+		if len(sw.peers) == 0 && sw.completed == 0 {
+			delete(s.swarms, hash)
+		}
+	}
+}
+
+func (s *Server) checkInfoHash(infoHash [20]byte) error {
+	if s.whitelist != nil && !s.whitelist[infoHash] {
+		return fmt.Errorf("torrent not registered with this tracker")
+	}
+	return nil
+}
+
+func (s *Server) checkPasskey(passkey string) error {
+	if s.passkeys == nil {
+		return nil
+	}
+	if passkey == "" || !s.passkeys[passkey] {
+		return fmt.Errorf("invalid passkey")
+	}
+	return nil
+}
+
+// handleAnnounce updates the swarm with the announcing peer and returns up
+// to numWant other peers together with the swarm statistics.
+func (s *Server) handleAnnounce(a announce) ([]*peer, stats, error) {
+	if err := s.checkInfoHash(a.infoHash); err != nil {
+		return nil, stats{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw, ok := s.swarms[a.infoHash]
+	if !ok {
+		sw = &swarm{peers: make(map[string]*peer)}
+		s.swarms[a.infoHash] = sw
+	}
+
+	if a.event == "stopped" {
+		delete(sw.peers, a.peerID)
+		return nil, sw.stats(), nil
+	}
+
+	p, ok := sw.peers[a.peerID]
+	if !ok {
+		p = &peer{id: a.peerID, left: -1}
+		sw.peers[a.peerID] = p
+	}
+	if a.event == "completed" && !p.seeding() {
+		sw.completed++
+	}
+	if a.addr4.IsValid() {
+		p.addr4 = a.addr4
+	}
+	if a.addr6.IsValid() {
+		p.addr6 = a.addr6
+	}
+	p.left = a.left
+	p.lastSeen = time.Now()
+
+	numWant := a.numWant
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxNumWant)
+
+	var candidates []*peer
+	for id, other := range sw.peers {
+		if id == a.peerID {
+			continue
+		}
+		// Seeders have no use for other seeders.
+		if p.seeding() && other.seeding() {
+			continue
+		}
+		candidates = append(candidates, other)
+	}
+	mrand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > numWant {
+		candidates = candidates[:numWant]
+	}
+
+	return candidates, sw.stats(), nil
+}
+
+func (s *Server) scrape(infoHash [20]byte) (stats, bool) {
+	if s.checkInfoHash(infoHash) != nil {
+		return stats{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		return stats{}, s.whitelist != nil
+	}
+	return sw.stats(), true
+}
+
+func (sw *swarm) stats() stats {
+	st := stats{completed: sw.completed}
+	for _, p := range sw.peers {
+		if p.seeding() {
+			st.seeders++
+		} else {
+			st.leechers++
+		}
+	}
+	return st
+}
+
+func durationSeconds(d time.Duration) int {
+	return int(math.Round(d.Seconds()))
+}
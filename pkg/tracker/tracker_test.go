@@ -0,0 +1,237 @@
+package tracker
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/torbenconto/pebl/pkg/bencode"
+	"github.com/torbenconto/pebl/pkg/torrent"
+)
+
+func testRequest(infoHash [20]byte, id string, port uint16, left int64) torrent.AnnounceRequest {
+	req := torrent.AnnounceRequest{
+		InfoHash: infoHash,
+		Port:     port,
+		Left:     left,
+		Event:    "started",
+	}
+	copy(req.PeerID[:], id)
+	return req
+}
+
+func TestHTTPAnnounceAndScrape(t *testing.T) {
+	s := NewServer(Config{Interval: time.Minute})
+	defer s.Close()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	hash := [20]byte{1, 2, 3}
+	announceURL := srv.URL + "/announce"
+
+	resp, err := torrent.Announce(announceURL, testRequest(hash, "-PB0001-aaaaaaaaaaaa", 6881, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 0 || resp.Interval != 60 {
+		t.Errorf("unexpected first response %+v", resp)
+	}
+
+	resp, err = torrent.Announce(announceURL, testRequest(hash, "-PB0001-bbbbbbbbbbbb", 6882, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("expected the first peer, got %v", resp.Peers)
+	}
+	if resp.Seeders != 1 || resp.Leechers != 1 {
+		t.Errorf("unexpected swarm counts %+v", resp)
+	}
+
+	results, err := torrent.Scrape(announceURL, [][20]byte{hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[hash]; r.Seeders != 1 || r.Leechers != 1 {
+		t.Errorf("unexpected scrape result %+v", r)
+	}
+
+	stop := testRequest(hash, "-PB0001-aaaaaaaaaaaa", 6881, 100)
+	stop.Event = "stopped"
+	if _, err := torrent.Announce(announceURL, stop); err != nil {
+		t.Fatal(err)
+	}
+	results, _ = torrent.Scrape(announceURL, [][20]byte{hash})
+	if r := results[hash]; r.Leechers != 0 {
+		t.Errorf("stopped peer still counted: %+v", r)
+	}
+}
+
+func TestHTTPAnnounceNonCompact(t *testing.T) {
+	s := NewServer(Config{})
+	defer s.Close()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	hash := [20]byte{9}
+	s.handleAnnounce(announce{
+		infoHash: hash,
+		peerID:   "-XX0001-000000000000",
+		addr6:    netip.MustParseAddrPort("[2001:db8::1]:51413"),
+		left:     10,
+		numWant:  -1,
+	})
+
+	r, err := http.Get(srv.URL + "/announce?compact=0&port=6881&left=1&peer_id=-PB0001-cccccccccccc&info_hash=%09%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := bencode.Decode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := decoded.(map[string]interface{})["peers"].([]interface{})
+	if len(peers) != 1 {
+		t.Fatalf("expected one peer, got %v", peers)
+	}
+	entry := peers[0].(map[string]interface{})
+	if entry["ip"] != "2001:db8::1" || entry["port"] != 51413 || entry["peer id"] != "-XX0001-000000000000" {
+		t.Errorf("unexpected peer entry %v", entry)
+	}
+}
+
+func TestHTTPWhitelistAndPasskey(t *testing.T) {
+	allowed := [20]byte{1}
+	s := NewServer(Config{Whitelist: [][20]byte{allowed}, Passkeys: []string{"secret"}})
+	defer s.Close()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	var terr *torrent.TrackerError
+
+	_, err := torrent.Announce(srv.URL+"/announce", testRequest(allowed, "-PB0001-aaaaaaaaaaaa", 6881, 1))
+	if !errors.As(err, &terr) || terr.FailureReason != "invalid passkey" {
+		t.Errorf("expected passkey failure, got %v", err)
+	}
+
+	_, err = torrent.Announce(srv.URL+"/secret/announce", testRequest([20]byte{2}, "-PB0001-aaaaaaaaaaaa", 6881, 1))
+	if !errors.As(err, &terr) {
+		t.Errorf("expected whitelist failure, got %v", err)
+	}
+
+	if _, err := torrent.Announce(srv.URL+"/secret/announce", testRequest(allowed, "-PB0001-aaaaaaaaaaaa", 6881, 1)); err != nil {
+		t.Errorf("expected announce to succeed, got %v", err)
+	}
+}
+
+func TestUDPAnnounceAndScrape(t *testing.T) {
+	s := NewServer(Config{Interval: time.Minute})
+	defer s.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go s.ServeUDP(conn)
+
+	hash := [20]byte{7}
+	announceURL := "udp://" + conn.LocalAddr().String() + "/announce"
+
+	if _, err := torrent.Announce(announceURL, testRequest(hash, "-PB0001-aaaaaaaaaaaa", 6881, 5)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := torrent.Announce(announceURL, testRequest(hash, "-PB0001-bbbbbbbbbbbb", 6882, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:6881" || resp.Leechers != 2 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	results, err := torrent.Scrape(announceURL, [][20]byte{hash, {8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[hash]; r.Leechers != 2 {
+		t.Errorf("unexpected scrape result %+v", r)
+	}
+}
+
+func TestUDPScrapeWithPasskeys(t *testing.T) {
+	s := NewServer(Config{Passkeys: []string{"secret"}})
+	defer s.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go s.ServeUDP(conn)
+
+	s.handleAnnounce(announce{infoHash: [20]byte{7}, peerID: "a", addr4: netip.MustParseAddrPort("10.0.0.1:1"), left: 1, numWant: -1})
+	announceURL := "udp://" + conn.LocalAddr().String() + "/secret/announce"
+	var terr *torrent.TrackerError
+	if _, err := torrent.Scrape(announceURL, [][20]byte{{7}}); !errors.As(err, &terr) {
+		t.Errorf("expected the private tracker to refuse a UDP scrape, got %v", err)
+	}
+}
+
+func TestUDPAnnounceWithPasskeys(t *testing.T) {
+	s := NewServer(Config{Passkeys: []string{"secret"}})
+	defer s.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go s.ServeUDP(conn)
+
+	addr := "udp://" + conn.LocalAddr().String()
+	var terr *torrent.TrackerError
+	_, err = torrent.Announce(addr+"/wrong/announce", testRequest([20]byte{7}, "-PB0001-aaaaaaaaaaaa", 6881, 1))
+	if !errors.As(err, &terr) || terr.FailureReason != "invalid passkey" {
+		t.Errorf("expected passkey failure, got %v", err)
+	}
+	if _, err := torrent.Announce(addr+"/secret/announce?x=1", testRequest([20]byte{7}, "-PB0001-aaaaaaaaaaaa", 6881, 1)); err != nil {
+		t.Errorf("expected announce to succeed, got %v", err)
+	}
+}
+
+func TestExpireDropsIdlePeers(t *testing.T) {
+	s := NewServer(Config{PeerTTL: time.Minute})
+	defer s.Close()
+
+	hash := [20]byte{3}
+	s.handleAnnounce(announce{infoHash: hash, peerID: "a", addr4: netip.MustParseAddrPort("10.0.0.1:1"), left: 1, numWant: -1})
+
+	s.expire(time.Now().Add(2 * time.Minute))
+
+	if st, _ := s.scrape(hash); st.leechers != 0 {
+		t.Errorf("expected idle peer to expire, got %+v", st)
+	}
+}
+
+func TestPasskeyFromURLData(t *testing.T) {
+	options := []byte{udpOptionURLData, 7}
+	options = append(options, "/secret"...)
+	options = append(options, udpOptionURLData, 9)
+	options = append(options, "/announce"...)
+	options = append(options, udpOptionEnd)
+
+	if got := passkeyFromURLData(options); got != "secret" {
+		t.Errorf("expected passkey secret, got %q", got)
+	}
+}
@@ -0,0 +1,224 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpConnectionWindow = time.Minute
+	udpMaxScrapeHashes  = 74
+
+	// BEP 41 option types carried after the announce request.
+	udpOptionEnd     = 0
+	udpOptionNOP     = 1
+	udpOptionURLData = 2
+)
+
+// ServeUDP answers UDP tracker requests on conn until it is closed.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if resp := s.handleUDPPacket(buf[:n], udpAddr.AddrPort()); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *Server) handleUDPPacket(packet []byte, from netip.AddrPort) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+	connID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	txID := binary.BigEndian.Uint32(packet[12:16])
+	from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+	if action == udpActionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		resp := udpHeader(udpActionConnect, txID)
+		return binary.BigEndian.AppendUint64(resp, s.connectionID(from.Addr(), time.Now()))
+	}
+
+	if !s.validConnectionID(connID, from.Addr()) {
+		return udpError(txID, "invalid connection id")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		return s.handleUDPAnnounce(packet, from, txID)
+	case udpActionScrape:
+		return s.handleUDPScrape(packet[16:], txID)
+	default:
+		return udpError(txID, "unknown action")
+	}
+}
+
+func (s *Server) handleUDPAnnounce(packet []byte, from netip.AddrPort, txID uint32) []byte {
+	if len(packet) < 98 {
+		return udpError(txID, "announce packet too short")
+	}
+
+	if s.passkeys != nil {
+		if err := s.checkPasskey(passkeyFromURLData(packet[98:])); err != nil {
+			return udpError(txID, err.Error())
+		}
+	}
+
+	a := announce{
+		infoHash: [20]byte(packet[16:36]),
+		peerID:   string(packet[36:56]),
+		left:     int64(binary.BigEndian.Uint64(packet[64:72])),
+		numWant:  int(int32(binary.BigEndian.Uint32(packet[92:96]))),
+	}
+	switch binary.BigEndian.Uint32(packet[80:84]) {
+	case 1:
+		a.event = "completed"
+	case 2:
+		a.event = "started"
+	case 3:
+		a.event = "stopped"
+	}
+
+	port := binary.BigEndian.Uint16(packet[96:98])
+	if from.Addr().Is4() {
+		a.addr4 = netip.AddrPortFrom(from.Addr(), port)
+	} else {
+		a.addr6 = netip.AddrPortFrom(from.Addr(), port)
+	}
+
+	peers, st, err := s.handleAnnounce(a)
+	if err != nil {
+		return udpError(txID, err.Error())
+	}
+
+	resp := udpHeader(udpActionAnnounce, txID)
+	resp = binary.BigEndian.AppendUint32(resp, uint32(durationSeconds(s.interval)))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(st.leechers))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(st.seeders))
+	// The peer list format follows the address family of the request.
+	for _, p := range peers {
+		if from.Addr().Is4() && p.addr4.IsValid() {
+			resp = appendCompact(resp, p.addr4)
+		} else if from.Addr().Is6() && p.addr6.IsValid() {
+			resp = appendCompact(resp, p.addr6)
+		}
+	}
+	return resp
+}
+
+// handleUDPScrape answers a scrape. UDP scrapes carry no URL data and so
+// no passkey, hence private trackers refuse them.
+func (s *Server) handleUDPScrape(hashes []byte, txID uint32) []byte {
+	if s.passkeys != nil {
+		return udpError(txID, "scrape requires a passkey")
+	}
+	if len(hashes) == 0 || len(hashes)%20 != 0 || len(hashes)/20 > udpMaxScrapeHashes {
+		return udpError(txID, "invalid scrape request")
+	}
+
+	resp := udpHeader(udpActionScrape, txID)
+	for i := 0; i < len(hashes); i += 20 {
+		st, _ := s.scrape([20]byte(hashes[i : i+20]))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(st.seeders))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(st.completed))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(st.leechers))
+	}
+	return resp
+}
+
+// connectionID derives a connection ID from the client address and the
+// current time window, so no per-client state is kept. An ID is accepted
+// during its own window and the following one.
+func (s *Server) connectionID(addr netip.Addr, now time.Time) uint64 {
+	window := now.Unix() / int64(udpConnectionWindow/time.Second)
+
+	mac := hmac.New(sha256.New, s.secret[:])
+	mac.Write(addr.AsSlice())
+	binary.Write(mac, binary.BigEndian, window)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (s *Server) validConnectionID(id uint64, addr netip.Addr) bool {
+	now := time.Now()
+	return id == s.connectionID(addr, now) || id == s.connectionID(addr, now.Add(-udpConnectionWindow))
+}
+
+// passkeyFromURLData extracts the passkey from the BEP 41 URL data of an
+// announce, which carries the path of a udp://host:port/<passkey>/announce
+// tracker URL.
+func passkeyFromURLData(options []byte) string {
+	var path []byte
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case udpOptionEnd:
+			i = len(options)
+		case udpOptionNOP:
+			i++
+		case udpOptionURLData:
+			if i+1 >= len(options) {
+				return ""
+			}
+			n := int(options[i+1])
+			if i+2+n > len(options) {
+				return ""
+			}
+			path = append(path, options[i+2:i+2+n]...)
+			i += 2 + n
+		default:
+			// Unknown options carry a length byte like URL data.
+			if i+1 >= len(options) {
+				return ""
+			}
+			i += 2 + int(options[i+1])
+		}
+	}
+
+	p := string(path)
+	if q := strings.IndexByte(p, '?'); q >= 0 {
+		p = p[:q]
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) != 2 || parts[1] != "announce" {
+		return ""
+	}
+	return parts[0]
+}
+
+func udpHeader(action, txID uint32) []byte {
+	b := make([]byte, 8, 32)
+	binary.BigEndian.PutUint32(b[0:4], action)
+	binary.BigEndian.PutUint32(b[4:8], txID)
+	return b
+}
+
+func udpError(txID uint32, msg string) []byte {
+	return append(udpHeader(udpActionError, txID), msg...)
+}
@@ -0,0 +1,626 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	packetSize = 1400
+	maxPayload = packetSize - headerSize
+
+	recvBufferSize = 1 << 20
+	sendBufferSize = 1 << 20
+	// maxOutOfOrder is how far ahead of the next expected packet we buffer
+	// data.
+	maxOutOfOrder = 1024
+
+	// LEDBAT keeps the queuing delay it adds near target, growing the
+	// window by at most maxWindowIncrease bytes per round trip.
+	target            = 100 * time.Millisecond
+	maxWindowIncrease = 3000
+	minWindow         = maxPayload
+	initialWindow     = 4 * maxPayload
+	maxWindow         = recvBufferSize
+	// baseDelayWindow is how long a delay sample stays a base delay
+	// candidate.
+	baseDelayWindow = 2 * time.Minute
+
+	initialRTO = time.Second
+	minRTO     = 500 * time.Millisecond
+	maxRTO     = 8 * time.Second
+	// maxTimeouts is the number of consecutive timeouts after which a
+	// connection is given up.
+	maxTimeouts = 8
+)
+
+var (
+	errReset   = errors.New("uTP connection reset by peer")
+	errTimeout = errors.New("uTP connection timed out")
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+// outPacket is a packet sent but not yet acknowledged.
+type outPacket struct {
+	typ           uint8
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	// sacked is set when a selective ack covered the packet.
+	sacked bool
+	// resent is set once the packet was retransmitted as lost.
+	resent bool
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	s      *Socket
+	raddr  net.Addr
+	key    connKey
+	sendID uint16
+
+	mu    sync.Mutex
+	state int
+	err   error
+
+	seqNr uint16
+	ackNr uint16
+
+	// outbuf holds unacknowledged packets in sequence order; curWindow
+	// counts their unsacked payload bytes.
+	outbuf    []*outPacket
+	curWindow int
+	maxWindow float64
+	peerWnd   int
+	sendBuf   []byte
+	dupAcks   int
+	// recoverySeq is the last packet sent when the window was last cut for
+	// a loss; later losses up to it don't cut it again.
+	recoverySeq  uint16
+	inRecovery   bool
+	rtt, rttVar  time.Duration
+	rto          time.Duration
+	timeouts     int
+	delays       [2]delaySample
+	replyMicro   uint32
+	inbuf        map[uint16][]byte
+	inbufBytes   int
+	readBuf      []byte
+	finRecvd     bool
+	eofSeq       uint16
+	closing      bool
+	finSent      bool
+	readDeadline time.Time
+	// writeDeadline applies to Write blocking on a full send buffer.
+	writeDeadline time.Time
+
+	readC      chan struct{}
+	writeC     chan struct{}
+	connectedC chan struct{}
+	closedC    chan struct{}
+}
+
+// delaySample is the lowest delay seen in a minute, for tracking the base
+// delay over baseDelayWindow.
+type delaySample struct {
+	start time.Time
+	delay time.Duration
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		s:          s,
+		raddr:      raddr,
+		key:        connKey{raddr.String(), recvID},
+		sendID:     sendID,
+		maxWindow:  initialWindow,
+		peerWnd:    recvBufferSize,
+		rto:        initialRTO,
+		inbuf:      make(map[uint16][]byte),
+		readC:      make(chan struct{}, 1),
+		writeC:     make(chan struct{}, 1),
+		connectedC: make(chan struct{}),
+		closedC:    make(chan struct{}),
+	}
+}
+
+// connect sends the SYN of an outgoing connection.
+func (c *Conn) connect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = stateSynSent
+	c.seqNr = 1
+	c.queue(stSyn, nil, time.Now())
+}
+
+// accept sets up an incoming connection from its SYN.
+func (c *Conn) accept(syn *packet) {
+	var b [2]byte
+	rand.Read(b[:])
+	c.state = stateConnected
+	c.seqNr = binary.BigEndian.Uint16(b[:])
+	c.ackNr = syn.seqNr
+	close(c.connectedC)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if c.closing {
+			return 0, net.ErrClosed
+		}
+		if len(c.readBuf) > 0 {
+			wasFull := len(c.readBuf) > recvBufferSize-maxPayload
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if wasFull && c.state == stateConnected {
+				// Tell the peer the window opened again.
+				c.sendState(time.Now())
+			}
+			return n, nil
+		}
+		if c.finRecvd && c.ackNr == c.eofSeq {
+			return 0, io.EOF
+		}
+		if c.state == stateClosed {
+			return 0, c.err
+		}
+		if err := c.wait(c.readC, c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		if c.closing {
+			return written, net.ErrClosed
+		}
+		if c.state == stateClosed {
+			return written, c.err
+		}
+		if space := sendBufferSize - len(c.sendBuf); space > 0 {
+			n := min(space, len(b))
+			c.sendBuf = append(c.sendBuf, b[:n]...)
+			b = b[n:]
+			written += n
+			c.flush(time.Now())
+			continue
+		}
+		if err := c.wait(c.writeC, c.writeDeadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// wait releases c.mu until ch is signalled, the connection is closed or
+// the deadline passes.
+func (c *Conn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-ch:
+	case <-c.closedC:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Close sends the data still buffered followed by a FIN. Close does not
+// wait for the peer to acknowledge them.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing || c.state == stateClosed {
+		return nil
+	}
+	c.closing = true
+	if c.state == stateSynSent {
+		c.destroyLocked(net.ErrClosed)
+		return nil
+	}
+	c.flush(time.Now())
+	signal(c.readC)
+	signal(c.writeC)
+	return nil
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	signal(c.readC)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	signal(c.writeC)
+	return nil
+}
+
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// destroyLocked tears the connection down with err.
+func (c *Conn) destroyLocked(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	c.err = err
+	close(c.closedC)
+	c.s.remove(c)
+}
+
+// handle processes a packet from the peer.
+func (c *Conn) handle(p *packet, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+	if p.typ == stReset {
+		c.destroyLocked(errReset)
+		return
+	}
+	c.peerWnd = int(p.wndSize)
+	c.replyMicro = timestamp(now) - p.timestamp
+
+	if p.typ == stSyn {
+		// A new or retransmitted SYN; our reply may have been lost.
+		c.sendState(now)
+		return
+	}
+	if c.state == stateSynSent {
+		if p.typ != stState && p.typ != stData || p.ackNr != c.seqNr-1 {
+			return
+		}
+		c.ackNr = p.seqNr - 1
+		c.state = stateConnected
+		close(c.connectedC)
+	}
+
+	c.processAck(p, now)
+	if (p.typ == stData || p.typ == stFin) && c.receive(p) {
+		c.sendState(now)
+	}
+
+	if c.closing && c.finSent && len(c.outbuf) == 0 {
+		// Everything we sent, FIN included, has arrived.
+		c.destroyLocked(net.ErrClosed)
+		return
+	}
+	c.flush(now)
+}
+
+// processAck removes the packets p acknowledges from outbuf, retransmits
+// those it shows lost and adjusts the window.
+func (c *Conn) processAck(p *packet, now time.Time) {
+	// Ignore acks for packets we have not sent.
+	if !seqLess(p.ackNr, c.seqNr) {
+		return
+	}
+
+	acked := 0
+	advanced := false
+	for len(c.outbuf) > 0 && !seqLess(p.ackNr, c.outbuf[0].seq) {
+		op := c.outbuf[0]
+		c.outbuf = c.outbuf[1:]
+		advanced = true
+		if !op.sacked {
+			acked += len(op.payload)
+			c.curWindow -= len(op.payload)
+			if op.transmissions == 1 {
+				c.updateRTT(now.Sub(op.sentAt))
+			}
+		}
+	}
+
+	// outbuf holds consecutive sequence numbers, so a packet's index
+	// follows from its sequence number.
+	for i := 0; i < len(p.sack)*8 && len(c.outbuf) > 0; i++ {
+		if p.sack[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		j := int(p.ackNr + 2 + uint16(i) - c.outbuf[0].seq)
+		if j >= len(c.outbuf) {
+			break
+		}
+		if op := c.outbuf[j]; !op.sacked {
+			op.sacked = true
+			acked += len(op.payload)
+			c.curWindow -= len(op.payload)
+		}
+	}
+
+	lost := false
+	if advanced {
+		// Progress ends the timeout backoff.
+		c.dupAcks = 0
+		c.timeouts = 0
+		if c.rtt > 0 {
+			c.rto = min(max(c.rtt+4*c.rttVar, minRTO), maxRTO)
+		}
+	} else if p.typ == stState && len(c.outbuf) > 0 && acked == 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 && !c.outbuf[0].resent {
+			c.retransmit(c.outbuf[0], now)
+			lost = true
+		}
+	}
+	// A packet with three later packets selectively acked is lost.
+	sackedAfter := 0
+	for i := len(c.outbuf) - 1; i >= 0; i-- {
+		op := c.outbuf[i]
+		if op.sacked {
+			sackedAfter++
+			continue
+		}
+		if sackedAfter >= 3 && !op.resent {
+			c.retransmit(op, now)
+			lost = true
+		}
+	}
+
+	if lost {
+		if !c.inRecovery || seqLess(c.recoverySeq, p.ackNr) {
+			c.maxWindow = max(c.maxWindow/2, minWindow)
+			c.inRecovery = true
+			c.recoverySeq = c.seqNr - 1
+		}
+	} else if acked > 0 {
+		c.updateWindow(acked, time.Duration(p.timestampDiff)*time.Microsecond, now)
+	}
+}
+
+// updateWindow grows or shrinks the congestion window with the queuing
+// delay our packets see, as LEDBAT does.
+func (c *Conn) updateWindow(acked int, delay time.Duration, now time.Time) {
+	queuing := time.Duration(0)
+	if delay > 0 {
+		if now.Sub(c.delays[1].start) >= baseDelayWindow/2 {
+			c.delays[0] = c.delays[1]
+			c.delays[1] = delaySample{start: now, delay: delay}
+		}
+		c.delays[1].delay = min(c.delays[1].delay, delay)
+		base := c.delays[1].delay
+		if !c.delays[0].start.IsZero() {
+			base = min(base, c.delays[0].delay)
+		}
+		queuing = delay - base
+	}
+
+	offTarget := float64(target-queuing) / float64(target)
+	windowFactor := min(float64(acked), c.maxWindow) / max(c.maxWindow, float64(acked))
+	c.maxWindow += maxWindowIncrease * offTarget * windowFactor
+	c.maxWindow = min(max(c.maxWindow, minWindow), maxWindow)
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = min(max(c.rtt+4*c.rttVar, minRTO), maxRTO)
+}
+
+// receive stores the data or FIN in p and delivers what is now in order.
+// It reports false for data beyond the receive window we advertise, which
+// is dropped without an ack.
+func (c *Conn) receive(p *packet) bool {
+	if !seqLess(c.ackNr, p.seqNr) || p.seqNr-c.ackNr > maxOutOfOrder {
+		return true
+	}
+	if c.finRecvd && seqLess(c.eofSeq, p.seqNr) {
+		return true
+	}
+	if _, ok := c.inbuf[p.seqNr]; ok {
+		return true
+	}
+	if len(c.readBuf)+c.inbufBytes+len(p.payload) > recvBufferSize {
+		return false
+	}
+	if p.typ == stFin {
+		c.finRecvd = true
+		c.eofSeq = p.seqNr
+	}
+	c.inbuf[p.seqNr] = p.payload
+	c.inbufBytes += len(p.payload)
+
+	for {
+		payload, ok := c.inbuf[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.inbuf, c.ackNr+1)
+		c.inbufBytes -= len(payload)
+		c.ackNr++
+		c.readBuf = append(c.readBuf, payload...)
+		signal(c.readC)
+	}
+	return true
+}
+
+// sendState acknowledges what we received, selectively acking the out of
+// order packets.
+func (c *Conn) sendState(now time.Time) {
+	p := c.header(stState, c.seqNr, now)
+	if len(c.inbuf) > 0 {
+		sack := make([]byte, 32)
+		last := 0
+		for seq := range c.inbuf {
+			i := int(seq - c.ackNr - 2)
+			if i >= 0 && i < len(sack)*8 {
+				sack[i/8] |= 1 << (i % 8)
+				last = max(last, i)
+			}
+		}
+		p.sack = sack[:(last/32+1)*4]
+	}
+	c.s.send(p, c.raddr)
+}
+
+func (c *Conn) header(typ uint8, seq uint16, now time.Time) *packet {
+	p := &packet{
+		typ:           typ,
+		connID:        c.sendID,
+		timestamp:     timestamp(now),
+		timestampDiff: c.replyMicro,
+		wndSize:       uint32(max(recvBufferSize-len(c.readBuf), 0)),
+		seqNr:         seq,
+		ackNr:         c.ackNr,
+	}
+	if typ == stSyn {
+		p.connID = c.key.id
+	}
+	return p
+}
+
+// queue assigns the next sequence number to a packet and sends it.
+func (c *Conn) queue(typ uint8, payload []byte, now time.Time) {
+	op := &outPacket{typ: typ, seq: c.seqNr, payload: payload}
+	c.seqNr++
+	c.outbuf = append(c.outbuf, op)
+	c.curWindow += len(payload)
+	c.transmit(op, now)
+}
+
+func (c *Conn) transmit(op *outPacket, now time.Time) {
+	op.sentAt = now
+	op.transmissions++
+	p := c.header(op.typ, op.seq, now)
+	p.payload = op.payload
+	c.s.send(p, c.raddr)
+}
+
+func (c *Conn) retransmit(op *outPacket, now time.Time) {
+	op.resent = true
+	c.transmit(op, now)
+}
+
+// flush sends as much buffered data as the window allows, then the FIN
+// once Close was called and all data is sent.
+func (c *Conn) flush(now time.Time) {
+	if c.state != stateConnected {
+		return
+	}
+	window := min(int(c.maxWindow), c.peerWnd)
+	for len(c.sendBuf) > 0 {
+		n := min(len(c.sendBuf), maxPayload)
+		// One packet is always allowed in flight so a closed window is
+		// probed.
+		if c.curWindow > 0 && c.curWindow+n > window {
+			break
+		}
+		payload := append([]byte(nil), c.sendBuf[:n]...)
+		c.sendBuf = c.sendBuf[n:]
+		c.queue(stData, payload, now)
+		signal(c.writeC)
+	}
+	if c.closing && !c.finSent && len(c.sendBuf) == 0 {
+		c.finSent = true
+		c.queue(stFin, nil, now)
+	}
+}
+
+// tick retransmits the oldest unacknowledged packet once its timeout
+// passed, and gives the connection up after maxTimeouts.
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+	var oldest *outPacket
+	for _, op := range c.outbuf {
+		if !op.sacked {
+			oldest = op
+			break
+		}
+	}
+	if oldest == nil || now.Sub(oldest.sentAt) < c.rto {
+		return
+	}
+
+	c.timeouts++
+	if c.timeouts > maxTimeouts {
+		c.destroyLocked(errTimeout)
+		return
+	}
+	c.rto = min(c.rto*2, maxRTO)
+	c.maxWindow = minWindow
+	c.dupAcks = 0
+	// Retransmissions may have been lost too; let selective acks detect
+	// them again.
+	for _, op := range c.outbuf {
+		op.resent = false
+	}
+	c.transmit(oldest, now)
+}
@@ -0,0 +1,98 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Packet types.
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+
+	extNone         = 0
+	extSelectiveAck = 1
+)
+
+type packet struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	// sack is the selective ack bitmask; bit i acknowledges ackNr+2+i.
+	sack    []byte
+	payload []byte
+}
+
+func (p *packet) marshal() []byte {
+	b := make([]byte, headerSize, headerSize+2+len(p.sack)+len(p.payload))
+	b[0] = p.typ<<4 | version
+	if len(p.sack) > 0 {
+		b[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(b[2:4], p.connID)
+	binary.BigEndian.PutUint32(b[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(b[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:16], p.wndSize)
+	binary.BigEndian.PutUint16(b[16:18], p.seqNr)
+	binary.BigEndian.PutUint16(b[18:20], p.ackNr)
+	if len(p.sack) > 0 {
+		b = append(b, extNone, byte(len(p.sack)))
+		b = append(b, p.sack...)
+	}
+	return append(b, p.payload...)
+}
+
+// parsePacket decodes a packet. The payload is copied out of b.
+func parsePacket(b []byte) (*packet, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("packet too short")
+	}
+	if b[0]&0x0f != version {
+		return nil, fmt.Errorf("unsupported version %d", b[0]&0x0f)
+	}
+	p := &packet{
+		typ:           b[0] >> 4,
+		connID:        binary.BigEndian.Uint16(b[2:4]),
+		timestamp:     binary.BigEndian.Uint32(b[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:12]),
+		wndSize:       binary.BigEndian.Uint32(b[12:16]),
+		seqNr:         binary.BigEndian.Uint16(b[16:18]),
+		ackNr:         binary.BigEndian.Uint16(b[18:20]),
+	}
+	if p.typ > stSyn {
+		return nil, fmt.Errorf("unknown packet type %d", p.typ)
+	}
+
+	ext := b[1]
+	b = b[headerSize:]
+	for ext != extNone {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, fmt.Errorf("truncated extension")
+		}
+		next, data := b[0], b[2:2+int(b[1])]
+		if ext == extSelectiveAck {
+			p.sack = append([]byte(nil), data...)
+		}
+		ext, b = next, b[2+len(data):]
+	}
+	p.payload = append([]byte(nil), b...)
+	return p, nil
+}
+
+// seqLess reports whether sequence number a comes before b, allowing for
+// wraparound.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
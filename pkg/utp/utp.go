@@ -0,0 +1,272 @@
+// Package utp implements the Micro Transport Protocol (BEP 29), a reliable
+// stream over UDP whose LEDBAT congestion control yields to other traffic.
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// acceptBacklog is the number of connections waiting for Accept; SYNs
+	// beyond it are reset.
+	acceptBacklog = 64
+	tickInterval  = 50 * time.Millisecond
+)
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket carries uTP connections over a single UDP socket. It is a
+// net.Listener for incoming connections and dials outgoing ones from the
+// same port.
+type Socket struct {
+	pc net.PacketConn
+
+	mu      sync.Mutex
+	conns   map[connKey]*Conn
+	acceptC chan *Conn
+
+	closeOnce sync.Once
+	closeC    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Listen opens a uTP socket on the UDP address addr.
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket runs uTP over pc. The socket owns pc and closes it with Close.
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:      pc,
+		conns:   make(map[connKey]*Conn),
+		acceptC: make(chan *Conn, acceptBacklog),
+		closeC:  make(chan struct{}),
+	}
+	s.wg.Add(2)
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the socket and all its connections.
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closeC)
+		err = s.pc.Close()
+		s.wg.Wait()
+
+		for _, c := range s.snapshot() {
+			c.mu.Lock()
+			c.destroyLocked(net.ErrClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+// Accept waits for the next incoming connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.acceptC:
+		return c, nil
+	case <-s.closeC:
+		return nil, net.ErrClosed
+	}
+}
+
+// Dial connects to the uTP socket at the UDP address addr.
+func (s *Socket) Dial(addr string) (*Conn, error) {
+	return s.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to the uTP socket at the UDP address addr, giving up
+// when ctx is done.
+func (s *Socket) DialContext(ctx context.Context, addr string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.closeC:
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+	var id uint16
+	for {
+		var b [2]byte
+		rand.Read(b[:])
+		id = binary.BigEndian.Uint16(b[:])
+		if _, ok := s.conns[connKey{raddr.String(), id}]; !ok {
+			break
+		}
+	}
+	c := newConn(s, raddr, id, id+1)
+	s.conns[c.key] = c
+	s.mu.Unlock()
+
+	c.connect()
+	select {
+	case <-c.connectedC:
+		return c, nil
+	case <-c.closedC:
+		return nil, fmt.Errorf("uTP connect to %s: %w", addr, c.closeErr())
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.destroyLocked(ctx.Err())
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Socket) snapshot() []*Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[c.key] == c {
+		delete(s.conns, c.key)
+	}
+}
+
+func (s *Socket) send(p *packet, addr net.Addr) {
+	s.pc.WriteTo(p.marshal(), addr)
+}
+
+// reset tells the sender of p that we have no connection for it.
+func (s *Socket) reset(p *packet, addr net.Addr) {
+	s.send(&packet{
+		typ:       stReset,
+		connID:    p.connID,
+		timestamp: timestamp(time.Now()),
+		ackNr:     p.seqNr,
+	}, addr)
+}
+
+func (s *Socket) readLoop() {
+	defer s.wg.Done()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case <-s.closeC:
+				return
+			default:
+			}
+			continue
+		}
+		p, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(p, addr, time.Now())
+	}
+}
+
+func (s *Socket) dispatch(p *packet, addr net.Addr, now time.Time) {
+	switch p.typ {
+	case stSyn:
+		s.mu.Lock()
+		key := connKey{addr.String(), p.connID + 1}
+		c := s.conns[key]
+		if c == nil {
+			c = newConn(s, addr, p.connID+1, p.connID)
+			c.accept(p)
+			select {
+			case s.acceptC <- c:
+				s.conns[key] = c
+			default:
+				s.mu.Unlock()
+				s.reset(p, addr)
+				return
+			}
+		}
+		s.mu.Unlock()
+		c.handle(p, now)
+		return
+
+	case stReset:
+		// The sender of a reset knows the ID we send with.
+		s.mu.Lock()
+		c := s.conns[connKey{addr.String(), p.connID}]
+		if c == nil {
+			for _, conn := range s.conns {
+				if conn.key.addr == addr.String() && conn.sendID == p.connID {
+					c = conn
+					break
+				}
+			}
+		}
+		s.mu.Unlock()
+		if c != nil {
+			c.handle(p, now)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	c := s.conns[connKey{addr.String(), p.connID}]
+	s.mu.Unlock()
+	if c == nil {
+		s.reset(p, addr)
+		return
+	}
+	c.handle(p, now)
+}
+
+func (s *Socket) tickLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, c := range s.snapshot() {
+				c.tick(now)
+			}
+		case <-s.closeC:
+			return
+		}
+	}
+}
+
+// timestamp returns t in the microseconds of packet headers.
+func timestamp(t time.Time) uint32 {
+	return uint32(t.UnixMicro())
+}
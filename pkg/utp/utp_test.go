@@ -0,0 +1,240 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	p := &packet{
+		typ:           stData,
+		connID:        0x1234,
+		timestamp:     1,
+		timestampDiff: 2,
+		wndSize:       3,
+		seqNr:         4,
+		ackNr:         5,
+		sack:          []byte{1, 0, 0, 0x80},
+		payload:       []byte("hello"),
+	}
+	got, err := parsePacket(p.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.typ != p.typ || got.connID != p.connID || got.timestamp != p.timestamp ||
+		got.timestampDiff != p.timestampDiff || got.wndSize != p.wndSize ||
+		got.seqNr != p.seqNr || got.ackNr != p.ackNr ||
+		!bytes.Equal(got.sack, p.sack) || !bytes.Equal(got.payload, p.payload) {
+		t.Errorf("got %+v, want %+v", got, p)
+	}
+
+	if _, err := parsePacket([]byte{0x41, 1, 0, 0}); err == nil {
+		t.Error("parsed a truncated packet")
+	}
+	bad := p.marshal()
+	bad[21] = 100
+	if _, err := parsePacket(bad); err == nil {
+		t.Error("parsed a packet with a truncated extension")
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	if !seqLess(1, 2) || seqLess(2, 1) || seqLess(3, 3) {
+		t.Error("seqLess wrong for small numbers")
+	}
+	if !seqLess(65535, 0) || seqLess(0, 65535) {
+		t.Error("seqLess wrong across wraparound")
+	}
+}
+
+// lossyConn drops a share of the packets written to it.
+type lossyConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	rand *rand.Rand
+	loss float64
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rand.Float64() < c.loss
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func newSocket(t *testing.T, loss float64, seed int64) *Socket {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSocket(&lossyConn{PacketConn: pc, rand: rand.New(rand.NewSource(seed)), loss: loss})
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// transfer sends data to an echo server over uTP and checks that it comes
+// back intact and that the server sees EOF after we close.
+func transfer(t *testing.T, loss float64, size int) {
+	server := newSocket(t, loss, 1)
+	client := newSocket(t, loss, 2)
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	errC := make(chan error, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			errC <- err
+			return
+		}
+		// Echo everything back, then close.
+		if _, err := io.Copy(conn, conn); err != nil {
+			errC <- err
+			return
+		}
+		errC <- conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := client.DialContext(ctx, server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echoed data differs")
+	}
+	conn.Close()
+
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("server did not see EOF")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	transfer(t, 0, 4<<20)
+}
+
+func TestTransferWithLoss(t *testing.T) {
+	transfer(t, 0.1, 512<<10)
+}
+
+func TestReceiveWindow(t *testing.T) {
+	s := newSocket(t, 0, 1)
+	c := newConn(s, s.Addr(), 1, 2)
+	c.state = stateConnected
+
+	// Data beyond the advertised window is dropped, in order or not.
+	payload := make([]byte, maxPayload)
+	fits := recvBufferSize / maxPayload
+	seq := uint16(1)
+	c.mu.Lock()
+	if !c.receive(&packet{typ: stData, seqNr: 3, payload: payload}) {
+		t.Fatal("out of order packet within the window dropped")
+	}
+	for ; int(seq) <= fits; seq++ {
+		if seq != 3 && !c.receive(&packet{typ: stData, seqNr: seq, payload: payload}) {
+			t.Fatalf("packet %d within the window dropped", seq)
+		}
+	}
+	if c.receive(&packet{typ: stData, seqNr: seq, payload: payload}) {
+		t.Error("packet beyond the window accepted")
+	}
+	if c.receive(&packet{typ: stData, seqNr: seq + 5, payload: payload}) {
+		t.Error("out of order packet beyond the window accepted")
+	}
+	if len(c.readBuf) != fits*maxPayload || c.ackNr != seq-1 {
+		t.Errorf("buffered %d bytes up to %d", len(c.readBuf), c.ackNr)
+	}
+	c.mu.Unlock()
+
+	// Reading opens the window again.
+	if _, err := c.Read(make([]byte, maxPayload)); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.receive(&packet{typ: stData, seqNr: seq, payload: payload}) {
+		t.Error("packet dropped after the window opened")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	server := newSocket(t, 0, 1)
+	client := newSocket(t, 0, 2)
+	go server.Accept()
+
+	conn, err := client.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+	var ne net.Error
+	if _, err := conn.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
+
+func TestDialNoListener(t *testing.T) {
+	client := newSocket(t, 0, 1)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := client.DialContext(ctx, pc.LocalAddr().String()); err == nil {
+		t.Error("dial succeeded without a uTP peer")
+	}
+}
+
+func TestResetUnknownConnection(t *testing.T) {
+	server := newSocket(t, 0, 1)
+	client := newSocket(t, 0, 2)
+	go server.Accept()
+
+	conn, err := client.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server forgets the connection, so our next packet is reset.
+	for _, c := range server.snapshot() {
+		server.remove(c)
+	}
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, errReset) {
+		t.Errorf("got %v, want reset", err)
+	}
+}
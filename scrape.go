@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/torbenconto/pebl/pkg/torrent"
+)
+
+func runScrape(args []string) error {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 0, "timeout for each HTTP tracker request")
+	proxy := fs.String("proxy", "", "proxy URL for HTTP trackers")
+	caFile := fs.String("ca", "", "PEM file with extra root certificates for HTTPS trackers")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: pebl scrape [flags] <torrent>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one torrent file")
+	}
+
+	httpClient, err := torrent.NewTrackerHTTPClient(torrent.TrackerHTTPConfig{
+		Timeout: *timeout,
+		Proxy:   *proxy,
+		CAFile:  *caFile,
+	})
+	if err != nil {
+		return err
+	}
+	client := torrent.NewTrackerClient(httpClient)
+
+	t, err := torrent.ReadMetaInfoFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("infohash %x\n", t.InfoHash)
+
+	var succeeded int
+	for _, tier := range t.Trackers.Tiers() {
+		for _, trackerURL := range tier {
+			results, err := client.Scrape(context.Background(), trackerURL, [][20]byte{t.InfoHash})
+			if err != nil {
+				fmt.Printf("%s: %v\n", trackerURL, err)
+				continue
+			}
+			r, ok := results[t.InfoHash]
+			if !ok {
+				fmt.Printf("%s: torrent not known to tracker\n", trackerURL)
+				continue
+			}
+			succeeded++
+			fmt.Printf("%s: seeders %d, leechers %d, completed %d\n", trackerURL, r.Seeders, r.Leechers, r.Completed)
+		}
+	}
+
+	if succeeded == 0 {
+		return fmt.Errorf("no tracker could be scraped")
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/torbenconto/pebl/pkg/tracker"
+)
+
+func runTracker(args []string) error {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	httpAddr := fs.String("http", ":6969", "HTTP listen address, empty to disable")
+	udpAddr := fs.String("udp", ":6969", "UDP listen address, empty to disable")
+	interval := fs.Duration("interval", 0, "announce interval handed to clients")
+	whitelistFile := fs.String("whitelist", "", "file with allowed infohashes in hex, one per line")
+	passkeys := fs.String("passkeys", "", "comma separated passkeys; enables private tracking")
+	fs.Parse(args)
+
+	cfg := tracker.Config{Interval: *interval}
+	if *whitelistFile != "" {
+		whitelist, err := readWhitelist(*whitelistFile)
+		if err != nil {
+			return err
+		}
+		cfg.Whitelist = whitelist
+	}
+	if *passkeys != "" {
+		cfg.Passkeys = strings.Split(*passkeys, ",")
+	}
+
+	server := tracker.NewServer(cfg)
+	defer server.Close()
+
+	errC := make(chan error, 2)
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		fmt.Printf("UDP tracker listening on %s\n", conn.LocalAddr())
+		go func() { errC <- server.ServeUDP(conn) }()
+	}
+	if *httpAddr != "" {
+		ln, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("HTTP tracker listening on %s\n", ln.Addr())
+		go func() { errC <- http.Serve(ln, server) }()
+	}
+	if *udpAddr == "" && *httpAddr == "" {
+		return fmt.Errorf("nothing to serve")
+	}
+
+	return <-errC
+}
+
+func readWhitelist(path string) ([][20]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hashes [][20]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(line)
+		if err != nil || len(raw) != 20 {
+			return nil, fmt.Errorf("invalid infohash %q in whitelist", line)
+		}
+		hashes = append(hashes, [20]byte(raw))
+	}
+	return hashes, scanner.Err()
+}